@@ -0,0 +1,154 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/trranminhquang/go-boilerplate/internal/conf"
+	"github.com/trranminhquang/go-boilerplate/internal/secrets"
+)
+
+// configCmd represents the config command
+var configCmd = cobra.Command{
+	Use:   "config",
+	Short: "Inspect the application configuration",
+	Long:  "Print, validate and document the configuration resolved from files and the environment",
+}
+
+var configShowCmd = cobra.Command{
+	Use:   "show",
+	Short: "Print the effective configuration",
+	Long:  "Print every configuration field with its resolved value and the source it was loaded from. Secrets are redacted.",
+	Run: func(cmd *cobra.Command, args []string) {
+		watcher, config := loadConfigForInspection(cmd.ErrOrStderr())
+		printConfig(cmd.OutOrStdout(), watcher.Describe(config))
+	},
+}
+
+var configValidateCmd = cobra.Command{
+	Use:   "validate",
+	Short: "Validate the configuration",
+	Long:  "Load and validate the configuration, reporting every error found. Exits non-zero when the configuration is invalid.",
+	Run: func(cmd *cobra.Command, args []string) {
+		loadConfigForInspection(cmd.ErrOrStderr())
+		fmt.Fprintln(cmd.OutOrStdout(), "Configuration is valid")
+	},
+}
+
+var configDocsCmd = cobra.Command{
+	Use:   "docs",
+	Short: "Print a reference of all configuration variables",
+	Long:  "Print a Markdown table of every environment variable with its type, default and whether it is required",
+	Run: func(cmd *cobra.Command, args []string) {
+		printConfigDocs(cmd.OutOrStdout(), conf.Docs())
+	},
+}
+
+var secretKeyID string
+
+var configEncryptCmd = cobra.Command{
+	Use:   "encrypt NAME",
+	Short: "Encrypt a secret for the file secret provider",
+	Long:  "Read a secret value from stdin and print it encrypted for storage under NAME in the SECRETS_FILE, using a key from SECRETS_DECRYPTION_KEYS",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := conf.LoadFile(configFile); err != nil {
+			return err
+		}
+		if err := conf.LoadDirectory(watchDir); err != nil {
+			return err
+		}
+
+		config, err := conf.LoadSecretsFromEnv()
+		if err != nil {
+			return err
+		}
+
+		value, err := io.ReadAll(cmd.InOrStdin())
+		if err != nil {
+			return err
+		}
+
+		es, err := secrets.Encrypt(args[0], strings.TrimRight(string(value), "\r\n"), secretKeyID, config.DecryptionKeys)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(cmd.OutOrStdout(), es.String())
+		return nil
+	},
+}
+
+func init() {
+	configEncryptCmd.Flags().StringVar(&secretKeyID, "key-id", "", "ID of the key in SECRETS_DECRYPTION_KEYS to encrypt with")
+	_ = configEncryptCmd.MarkFlagRequired("key-id")
+
+	configCmd.AddCommand(&configShowCmd, &configValidateCmd, &configDocsCmd, &configEncryptCmd)
+}
+
+// loadConfigForInspection loads the configuration like the other commands do
+// but reports failures in a readable form and exits with a non-zero status.
+func loadConfigForInspection(w io.Writer) (*conf.Watcher, *conf.GlobalConfiguration) {
+	watcher := conf.NewWatcher(configFile, watchDir)
+
+	var errs []string
+	if err := watcher.LoadFile(); err != nil {
+		errs = append(errs, fmt.Sprintf("config file: %v", err))
+	}
+	if err := watcher.LoadDirectory(); err != nil {
+		errs = append(errs, fmt.Sprintf("config directory: %v", err))
+	}
+
+	config, err := watcher.Load()
+	var verr *conf.ValidationError
+	if errors.As(err, &verr) {
+		for _, e := range verr.Errors {
+			errs = append(errs, e.Error())
+		}
+	} else if err != nil {
+		errs = append(errs, err.Error())
+	}
+
+	if len(errs) > 0 {
+		fmt.Fprintln(w, "Invalid configuration:")
+		for _, e := range errs {
+			fmt.Fprintf(w, "  - %s\n", e)
+		}
+		os.Exit(1)
+	}
+
+	return watcher, config
+}
+
+func printConfig(w io.Writer, values []conf.FieldValue) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VARIABLE\tVALUE\tSOURCE")
+	for _, v := range values {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", v.EnvName, v.Value, v.Source)
+	}
+	_ = tw.Flush()
+}
+
+func printConfigDocs(w io.Writer, docs []conf.FieldDoc) {
+	fmt.Fprintln(w, "| Variable | File key | Type | Default | Required |")
+	fmt.Fprintln(w, "|----------|----------|------|---------|----------|")
+	for _, d := range docs {
+		required := "no"
+		if d.Required {
+			required = "yes"
+		}
+		fmt.Fprintf(w, "| `%s` | `%s` | `%s` | %s | %s |\n", d.EnvName, d.FileKey, d.Type, codeOrEmpty(d.Default), required)
+	}
+}
+
+func codeOrEmpty(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "`" + s + "`"
+}
@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/trranminhquang/go-boilerplate/internal/conf"
+	"github.com/trranminhquang/go-boilerplate/internal/db"
+	"github.com/trranminhquang/go-boilerplate/internal/worker"
+	"github.com/trranminhquang/go-boilerplate/pkg/messaging"
+	"github.com/trranminhquang/go-boilerplate/pkg/utils"
+)
+
+// Dead-letter command flags
+var (
+	dlqLimit int
+	dlqWait  time.Duration
+)
+
+// dlqCmd represents the dlq command
+var dlqCmd = cobra.Command{
+	Use:   "dlq",
+	Short: "Inspect and redrive dead letters",
+	Long:  "List, replay or purge the messages of the dead-letter topic (MESSAGING_DEAD_LETTER_TOPIC)",
+}
+
+var dlqListCmd = cobra.Command{
+	Use:   "list",
+	Short: "List dead letters",
+	Long:  "Print the dead letters with the reason they failed. Listing does not remove them from the topic.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		tw := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tTOPIC\tHANDLER\tATTEMPTS\tFAILED AT\tERROR")
+
+		config := loadGlobalConfig()
+		registry, closeDB, err := queueRegistry(config)
+		if err != nil {
+			return err
+		}
+		defer closeDB()
+
+		err = readDeadLetters(cmd.Context(), config, registry, true, func(dl *worker.DeadLetter) error {
+			printDeadLetter(tw, dl)
+			return nil
+		})
+		if flushErr := tw.Flush(); err == nil {
+			err = flushErr
+		}
+		return err
+	},
+}
+
+var dlqReplayCmd = cobra.Command{
+	Use:   "replay",
+	Short: "Publish dead letters back to their original topic",
+	Long:  "Publish each dead letter back to the topic it was consumed from, without the failure metadata, and remove it from the dead-letter topic",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config := loadGlobalConfig()
+		registry, closeDB, err := queueRegistry(config)
+		if err != nil {
+			return err
+		}
+		defer closeDB()
+
+		dlq, err := newDeadLetterQueue(config, registry)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := dlq.Close(); err != nil {
+				logrus.WithError(err).Error("Failed to close dead-letter producer")
+			}
+		}()
+
+		return readDeadLetters(cmd.Context(), config, registry, false, func(dl *worker.DeadLetter) error {
+			if err := dlq.Replay(cmd.Context(), dl); err != nil {
+				return fmt.Errorf("failed to replay message %s: %w", dl.Message.ID, err)
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Replayed %s to %s\n", dl.Message.ID, dl.Topic)
+			return nil
+		})
+	},
+}
+
+var dlqPurgeCmd = cobra.Command{
+	Use:   "purge",
+	Short: "Discard dead letters",
+	Long:  "Remove dead letters from the dead-letter topic without replaying them",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config := loadGlobalConfig()
+		registry, closeDB, err := queueRegistry(config)
+		if err != nil {
+			return err
+		}
+		defer closeDB()
+
+		return readDeadLetters(cmd.Context(), config, registry, false, func(dl *worker.DeadLetter) error {
+			fmt.Fprintf(cmd.OutOrStdout(), "Purged %s\n", dl.Message.ID)
+			return nil
+		})
+	},
+}
+
+func init() {
+	dlqCmd.PersistentFlags().IntVarP(&dlqLimit, "limit", "n", 0, "Maximum number of dead letters to process, 0 for all")
+	dlqCmd.PersistentFlags().DurationVar(&dlqWait, "wait", 5*time.Second, "Stop once no dead letter arrived for this long")
+
+	dlqCmd.AddCommand(&dlqListCmd, &dlqReplayCmd, &dlqPurgeCmd)
+}
+
+// queueRegistry returns a messaging registry connected to the database when
+// the configured queue type is postgres, and a function closing the
+// connection
+func queueRegistry(config *conf.GlobalConfiguration) (*messaging.Registry, func(), error) {
+	if !usesQueueDB(config) {
+		return messagingRegistry(nil), func() {}, nil
+	}
+
+	conn, err := db.Dial(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+	return messagingRegistry(conn), func() { utils.SafeClose(conn) }, nil
+}
+
+// newDeadLetterQueue creates a dead-letter queue with a producer of the
+// configured queue type
+func newDeadLetterQueue(config *conf.GlobalConfiguration, registry *messaging.Registry) (*worker.DeadLetterQueue, error) {
+	producer, err := registry.CreateProducer(config.Messaging.Type, worker.QueueConfig(&config.Messaging))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dead-letter producer: %w", err)
+	}
+	return worker.NewDeadLetterQueue(producer, config.Messaging.DeadLetterTopic), nil
+}
+
+// readDeadLetters consumes the dead-letter topic and calls fn for every dead
+// letter. Browsing reads the whole topic without a consumer group, so it
+// leaves the offsets used by replay and purge, and the dead letters of queues
+// that remove acknowledged messages like postgres, in place. Otherwise the
+// dead letters are consumed with the redrive consumer group.
+func readDeadLetters(ctx context.Context, config *conf.GlobalConfiguration, registry *messaging.Registry, browse bool, fn func(*worker.DeadLetter) error) error {
+	if config.Messaging.DeadLetterTopic == "" {
+		return errors.New("no dead-letter topic configured, set MESSAGING_DEAD_LETTER_TOPIC")
+	}
+
+	queueConfig := worker.QueueConfig(&config.Messaging)
+	queueConfig["topics"] = []string{config.Messaging.DeadLetterTopic}
+	queueConfig["initial_offset"] = "earliest"
+	if browse {
+		queueConfig["browse"] = true
+		delete(queueConfig, "group_id")
+	} else {
+		queueConfig["group_id"] = config.Messaging.GroupID + "-dlq-redrive"
+	}
+
+	consumer, err := registry.CreateConsumer(config.Messaging.Type, queueConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create dead-letter consumer: %w", err)
+	}
+
+	n, err := worker.ReadDeadLetters(ctx, consumer, dlqLimit, dlqWait, fn)
+	logrus.Infof("Processed %d dead letter(s) from %s", n, config.Messaging.DeadLetterTopic)
+	return err
+}
+
+// printDeadLetter prints dl as a row of the dead letter table
+func printDeadLetter(w io.Writer, dl *worker.DeadLetter) {
+	fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\n",
+		dl.Message.ID,
+		dl.Topic,
+		dl.Handler,
+		dl.Attempts,
+		dl.FailedAt.Format(time.RFC3339),
+		strings.ReplaceAll(dl.Error, "\n", " "),
+	)
+}
@@ -1,21 +1,47 @@
 package cmd
 
 import (
+	"context"
+	"errors"
+	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/trranminhquang/go-boilerplate/internal/conf"
+	"github.com/trranminhquang/go-boilerplate/internal/db"
+	"github.com/trranminhquang/go-boilerplate/internal/observability"
+	"github.com/trranminhquang/go-boilerplate/internal/secrets"
+	"github.com/trranminhquang/go-boilerplate/pkg/crypto"
+	"github.com/trranminhquang/go-boilerplate/pkg/utils"
 )
 
 var (
 	configFile = ""
 	watchDir   = ""
+	profile    = ""
 	runAll     = false
+
+	// dbCloseDelay is how long a replaced database connection stays open
+	dbCloseDelay = time.Minute
+
+	configOnce    sync.Once
+	watchOnce     sync.Once
+	configWatcher atomic.Pointer[conf.Watcher]
 )
 
 var rootCmd = cobra.Command{
 	Use:   "app",
 	Short: "Go Boilerplate Application",
 	Long:  "A simple boilerplate for building REST APIs and workers in Go",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if profile != "" {
+			os.Setenv(conf.ProfileEnvVar, profile)
+		}
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		if runAll {
 			var wg sync.WaitGroup
@@ -24,7 +50,7 @@ var rootCmd = cobra.Command{
 			// Start worker in a separate goroutine
 			go func() {
 				defer wg.Done()
-				startWorker(cmd.Context())
+				startWorker(cmd.Context(), cmd.Flags())
 			}()
 
 			// Start server in a separate goroutine
@@ -44,10 +70,134 @@ var rootCmd = cobra.Command{
 
 // RootCommand returns the root command for the application
 func RootCommand() *cobra.Command {
-	rootCmd.AddCommand(&serveCmd, &workerCmd)
-	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "", "base configuration file to load")
+	secrets.Register()
+
+	rootCmd.AddCommand(&serveCmd, &workerCmd, &configCmd, &dlqCmd)
+	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "", "base configuration file to load (.env, .yaml, .json or .toml)")
 	rootCmd.PersistentFlags().StringVarP(&watchDir, "config-dir", "d", "", "directory containing a sorted list of config files to watch for changes")
+	rootCmd.PersistentFlags().StringVarP(&profile, "profile", "p", "", "configuration profile layering base.env, <profile>.env and local.env of the config dir (overrides APP_ENV)")
 	rootCmd.Flags().BoolVar(&runAll, "all", false, "run both server and worker")
+	addWorkerFlags(rootCmd.Flags())
 
 	return &rootCmd
 }
+
+// loadGlobalConfig loads the configuration files given on the command line
+// into the environment and builds the global configuration from it. The
+// configuration is loaded once and shared by every component of the process.
+func loadGlobalConfig() *conf.GlobalConfiguration {
+	configOnce.Do(func() {
+		watcher := conf.NewWatcher(configFile, watchDir)
+		if err := watcher.LoadFile(); err != nil {
+			logrus.WithError(err).Fatal("Unable to load config file")
+		}
+
+		if err := watcher.LoadDirectory(); err != nil {
+			logrus.WithError(err).Error("Unable to load config from watch directory")
+		}
+
+		config, err := watcher.Load()
+		if err != nil {
+			fatalConfigError(err)
+		}
+
+		if err := observability.ConfigureLogging(&config.Logging); err != nil {
+			logrus.WithError(err).Fatal("Unable to configure logging")
+		}
+		setPasswordHashCost(config)
+
+		watcher.Subscribe(func(change conf.ConfigChange) {
+			if err := observability.ConfigureLogging(&change.New.Logging); err != nil {
+				logrus.WithError(err).Error("Unable to reconfigure logging")
+			}
+		})
+
+		configWatcher.Store(watcher)
+	})
+
+	return configWatcher.Load().Config()
+}
+
+// setPasswordHashCost applies the configured cost to the password hashes
+// generated from now on. It is static, reloads do not change it.
+func setPasswordHashCost(config *conf.GlobalConfiguration) {
+	crypto.PasswordHashCost = crypto.DefaultHashCost
+	if config.PasswordHashCost == conf.HashCostQuick {
+		crypto.PasswordHashCost = crypto.QuickHashCost
+	}
+}
+
+// fatalConfigError logs every invalid field of err before exiting, so all of
+// them can be fixed at once.
+func fatalConfigError(err error) {
+	var verr *conf.ValidationError
+	if !errors.As(err, &verr) {
+		logrus.WithError(err).Fatal("Unable to load config from environment")
+	}
+
+	for _, e := range verr.Errors {
+		logrus.Error(e.Error())
+	}
+	logrus.Fatalf("Invalid configuration: %d error(s)", len(verr.Errors))
+}
+
+// watchConfig reloads the configuration when the watch directory or a secret
+// file changes,
+// until ctx is canceled. It only starts watching once per process.
+func watchConfig(ctx context.Context) {
+	watchOnce.Do(func() {
+		go configWatcher.Load().Watch(ctx)
+	})
+}
+
+// redialDB connects to the database of a reloaded configuration when its
+// database settings changed, so that rotated credentials take effect without
+// a restart. It returns nil when nothing changed or the new settings can't be
+// connected to, in which case the current connection should be kept.
+func redialDB(change conf.ConfigChange) *db.Connection {
+	changed := false
+	for _, field := range change.Fields {
+		if strings.HasPrefix(field, "DB.") {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	conn, err := db.Dial(change.New)
+	if err != nil {
+		logrus.WithError(err).Error("Unable to reconnect to database, keeping the current connection")
+		return nil
+	}
+	logrus.Info("Reconnected to database with the reloaded configuration")
+	return conn
+}
+
+// closeDBLater closes a connection replaced by redialDB once the work still
+// using it had time to finish.
+func closeDBLater(conn *db.Connection) {
+	time.AfterFunc(dbCloseDelay, func() {
+		utils.SafeClose(conn)
+	})
+}
+
+// Reload re-reads the configuration file, the watch directory and the
+// environment, and applies the settings that can change at runtime. It also
+// reopens the log file so that rotated logs are released.
+func Reload() {
+	watcher := configWatcher.Load()
+	if watcher == nil {
+		logrus.Warn("Configuration is not loaded yet, ignoring reload")
+		return
+	}
+
+	if err := watcher.Reload(); err != nil {
+		logrus.WithError(err).Error("Unable to reload configuration")
+	}
+
+	if err := observability.ConfigureLogging(&watcher.Config().Logging); err != nil {
+		logrus.WithError(err).Error("Unable to reopen log file")
+	}
+}
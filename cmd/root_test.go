@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/trranminhquang/go-boilerplate/internal/conf"
+)
+
+func TestRootWorkerFlags(t *testing.T) {
+	t.Setenv("DB_DRIVER", "postgres")
+	t.Setenv("DATABASE_URL", "postgres://localhost/test")
+	config, err := conf.LoadGlobalFromEnv()
+	if err != nil {
+		t.Fatalf("LoadGlobalFromEnv: %v", err)
+	}
+
+	// --all runs the worker with the flags of the root command
+	root := RootCommand()
+	if err := root.ParseFlags([]string{"--all", "--queue-type=memory", "--workers=3"}); err != nil {
+		t.Fatalf("ParseFlags: %v", err)
+	}
+	if !runAll {
+		t.Error("--all was not set")
+	}
+
+	worker, err := workerConfig(config, root.Flags())
+	if err != nil {
+		t.Fatalf("workerConfig: %v", err)
+	}
+	if worker.Messaging.Type != "memory" || worker.Worker.Count != 3 {
+		t.Errorf("worker runs %d workers on %q, want 3 on memory", worker.Worker.Count, worker.Messaging.Type)
+	}
+	if config.Messaging.Type == "memory" {
+		t.Error("the flags modified the shared configuration")
+	}
+}
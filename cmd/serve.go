@@ -13,6 +13,8 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/trranminhquang/go-boilerplate/internal/api"
 	"github.com/trranminhquang/go-boilerplate/internal/conf"
+	"github.com/trranminhquang/go-boilerplate/internal/db"
+	"github.com/trranminhquang/go-boilerplate/pkg/utils"
 	"golang.org/x/sys/unix"
 )
 
@@ -29,24 +31,32 @@ var serveCmd = cobra.Command{
 // startServer initializes and runs the HTTP server
 func startServer(ctx context.Context) {
 	// Load configuration
-	if err := conf.LoadFile(configFile); err != nil {
-		logrus.WithError(err).Fatal("Unable to load config file")
-	}
-
-	if err := conf.LoadDirectory(watchDir); err != nil {
-		logrus.WithError(err).Error("Unable to load config from watch directory")
-	}
+	config := loadGlobalConfig()
 
-	config, err := conf.LoadGlobalFromEnv()
+	// Connect to database
+	conn, err := db.Dial(config)
 	if err != nil {
-		logrus.WithError(err).Fatal("Unable to load config from environment")
+		logrus.WithError(err).Fatal("Unable to connect to database")
 	}
 
 	// Setup server
 	addr := net.JoinHostPort(config.API.Host, config.API.Port)
-	apiServer := api.NewApiWithVersion("1.0.0", config)
+	apiServer := api.NewApiWithVersion("1.0.0", config, conn)
+	defer func() {
+		utils.SafeClose(apiServer.DB())
+	}()
 	logrus.WithField("version", apiServer.Version()).Infof("API starting on: %s", addr)
 
+	// Swap reloaded configuration into the running API, reconnecting to the
+	// database when its settings changed
+	configWatcher.Load().Subscribe(func(change conf.ConfigChange) {
+		apiServer.SetConfig(change.New)
+		if conn := redialDB(change); conn != nil {
+			closeDBLater(apiServer.SetDB(conn))
+		}
+	})
+	watchConfig(ctx)
+
 	// Create base context
 	baseCtx, baseCancel := context.WithCancel(context.Background())
 	defer baseCancel()
@@ -4,15 +4,21 @@ import (
 	"context"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/trranminhquang/go-boilerplate/internal/conf"
+	"github.com/trranminhquang/go-boilerplate/internal/db"
 	"github.com/trranminhquang/go-boilerplate/internal/worker"
 	"github.com/trranminhquang/go-boilerplate/pkg/kafka"
 	"github.com/trranminhquang/go-boilerplate/pkg/messaging"
+	"github.com/trranminhquang/go-boilerplate/pkg/messaging/memory"
+	"github.com/trranminhquang/go-boilerplate/pkg/messaging/postgres"
 )
 
-// Worker command flags
+// Worker command flags, overriding the loaded configuration when set
 var (
 	numWorkers int
 	queueSize  int
@@ -20,6 +26,12 @@ var (
 	brokers    string
 	topics     string
 	groupID    string
+	ordered    bool
+
+	drainTimeout time.Duration
+
+	relayOutbox     bool
+	outboxBatchSize int
 )
 
 // workerCmd represents the worker command
@@ -28,53 +40,113 @@ var workerCmd = cobra.Command{
 	Short: "Start message queue workers",
 	Long:  "Start workers to process tasks from message queues like Kafka",
 	Run: func(cmd *cobra.Command, args []string) {
-		startWorker(cmd.Context())
+		startWorker(cmd.Context(), cmd.Flags())
 	},
 }
 
 func init() {
-	defaultOpts := worker.DefaultOptions()
-
-	workerCmd.Flags().IntVarP(&numWorkers, "workers", "w", defaultOpts.WorkerCount, "Number of concurrent workers")
-	workerCmd.Flags().IntVarP(&queueSize, "queue-size", "q", defaultOpts.QueueSize, "Maximum size of the job queue")
-	workerCmd.Flags().StringVarP(&queueType, "queue-type", "t", defaultOpts.QueueType, "Type of message queue to use (kafka)")
-	workerCmd.Flags().StringVarP(&brokers, "brokers", "b", defaultOpts.QueueConfig["brokers"].(string), "Comma-separated list of message queue brokers")
-	workerCmd.Flags().StringVarP(&topics, "topics", "", defaultOpts.QueueConfig["topics"].(string), "Comma-separated list of topics to consume")
-	workerCmd.Flags().StringVarP(&groupID, "group-id", "g", defaultOpts.QueueConfig["group_id"].(string), "Consumer group ID")
+	addWorkerFlags(workerCmd.Flags())
 }
 
-// startWorker initializes and runs the worker process
-func startWorker(ctx context.Context) {
-	logrus.Info("Starting worker with concurrency: ", numWorkers)
+// addWorkerFlags defines the worker flags on flags. They are defined on the
+// worker command, and on the root command for --all.
+func addWorkerFlags(flags *pflag.FlagSet) {
+	flags.IntVarP(&numWorkers, "workers", "w", 0, "Number of concurrent workers (overrides WORKER_COUNT)")
+	flags.IntVarP(&queueSize, "queue-size", "q", 0, "Maximum size of the job queue (overrides WORKER_QUEUE_SIZE)")
+	flags.StringVarP(&queueType, "queue-type", "t", "", "Type of message queue to use: kafka, postgres, or memory to run without a broker (overrides MESSAGING_TYPE)")
+	flags.StringVarP(&brokers, "brokers", "b", "", "Comma-separated list of message queue brokers (overrides MESSAGING_BROKERS)")
+	flags.StringVarP(&topics, "topics", "", "", "Comma-separated list of topics to consume (overrides MESSAGING_TOPICS)")
+	flags.StringVarP(&groupID, "group-id", "g", "", "Consumer group ID (overrides MESSAGING_GROUP_ID)")
+	flags.BoolVar(&ordered, "ordered", false, "Process messages with the same key or partition in order (overrides WORKER_ORDERED)")
+	flags.DurationVar(&drainTimeout, "drain-timeout", 0, "How long shutdown waits for queued messages before interrupting them (overrides WORKER_DRAIN_TIMEOUT)")
 
-	// Create messaging registry
-	registry := messaging.NewRegistry()
+	flags.BoolVar(&relayOutbox, "outbox", false, "Relay messages from the database outbox to the message queue (overrides WORKER_OUTBOX_ENABLED)")
+	flags.IntVar(&outboxBatchSize, "outbox-batch-size", 0, "Maximum number of outbox messages relayed per transaction (overrides WORKER_OUTBOX_BATCH_SIZE)")
+}
 
-	// Register Kafka implementation
-	kafka.Register(registry)
+// workerConfig returns a copy of config overridden with the worker flags that
+// were set on the command line, and validates it. config itself is shared with
+// the rest of the process and is left untouched. The copy shares its slices
+// and maps with config, so flags must replace them rather than modify them.
+func workerConfig(config *conf.GlobalConfiguration, flags *pflag.FlagSet) (*conf.GlobalConfiguration, error) {
+	c := *config
+	config = &c
 
-	// Create queue configuration based on command line flags
-	queueConfig := map[string]interface{}{
-		"brokers":  strings.Split(brokers, ","),
-		"topics":   strings.Split(topics, ","),
-		"group_id": groupID,
+	if flags.Changed("workers") {
+		config.Worker.Count = numWorkers
+	}
+	if flags.Changed("queue-size") {
+		config.Worker.QueueSize = queueSize
+	}
+	if flags.Changed("queue-type") {
+		config.Messaging.Type = queueType
+	}
+	if flags.Changed("brokers") {
+		config.Messaging.Brokers = strings.Split(brokers, ",")
+	}
+	if flags.Changed("topics") {
+		config.Messaging.Topics = strings.Split(topics, ",")
+	}
+	if flags.Changed("group-id") {
+		config.Messaging.GroupID = groupID
+	}
+	if flags.Changed("ordered") {
+		config.Worker.Ordered = ordered
+	}
+	if flags.Changed("drain-timeout") {
+		config.Worker.DrainTimeout = drainTimeout
+	}
+	if flags.Changed("outbox") {
+		config.Worker.Outbox.Enabled = relayOutbox
+	}
+	if flags.Changed("outbox-batch-size") {
+		config.Worker.Outbox.BatchSize = outboxBatchSize
 	}
 
-	// Create queue worker options
-	options := worker.WorkerOptions{
-		ConsumerType:   queueType,
-		ConsumerConfig: queueConfig,
-		WorkerCount:    numWorkers,
-		QueueSize:      queueSize,
+	if err := config.Validate(); err != nil {
+		return nil, err
 	}
+	return config, nil
+}
+
+// startWorker initializes and runs the worker process
+func startWorker(ctx context.Context, flags *pflag.FlagSet) {
+	config, err := workerConfig(loadGlobalConfig(), flags)
+	if err != nil {
+		logrus.WithError(err).Fatal("Invalid worker configuration")
+	}
+
+	logrus.Info("Starting worker with concurrency: ", config.Worker.Count)
+
+	// Connect to the database once, the postgres queue and the outbox relay
+	// share the connection
+	var conn, queueConn *db.Connection
+	if usesQueueDB(config) || config.Worker.Outbox.Enabled {
+		if conn, err = db.Dial(config); err != nil {
+			logrus.WithError(err).Fatal("Failed to connect to database")
+		}
+	}
+	if usesQueueDB(config) {
+		queueConn = conn
+	}
+
+	// Create messaging registry
+	registry := messagingRegistry(queueConn)
 
 	// Create queue worker
-	queueWorker, err := worker.NewQueueWorker(options, registry)
+	queueWorker, err := worker.NewQueueWorker(config, registry)
 	if err != nil {
 		logrus.WithError(err).Fatal("Failed to create queue worker")
 	}
 
-	// Register message handlers
+	// Register message handlers and middlewares. Recover comes first so that
+	// it also recovers panics of the other middlewares.
+	queueWorker.Use(
+		worker.Recover(),
+		worker.Tracing(),
+		worker.Logging(logrus.StandardLogger()),
+		worker.Metrics(worker.NewExpvarMetrics("worker")),
+	)
 	registerMessageHandlers(queueWorker)
 
 	// Start the worker
@@ -84,10 +156,45 @@ func startWorker(ctx context.Context) {
 
 	logrus.Info("Worker started and consuming messages")
 
+	// Start the outbox relay, if enabled
+	var relay *worker.OutboxRelay
+	if config.Worker.Outbox.Enabled {
+		relay = startOutboxRelay(config, registry, conn)
+	}
+
+	// Apply reloaded settings to the running worker and relay, reconnecting
+	// the relay to the database when its settings changed. The flags keep
+	// overriding the reloaded configuration. The postgres queue keeps the
+	// initial connection, which is therefore never closed.
+	configWatcher.Load().Subscribe(func(change conf.ConfigChange) {
+		config, err := workerConfig(change.New, flags)
+		if err != nil {
+			logrus.WithError(err).Error("Invalid reloaded worker configuration, keeping the current one")
+			return
+		}
+
+		queueWorker.SetConfig(config)
+		if relay != nil {
+			relay.SetConfig(&config.Worker.Outbox)
+			if newConn := redialDB(change); newConn != nil {
+				if old := relay.SetDB(newConn); old != queueConn {
+					closeDBLater(old)
+				}
+			}
+		}
+	})
+	watchConfig(ctx)
+
 	// Wait for context cancellation (CTRL+C or shutdown signal)
 	<-ctx.Done()
 	logrus.Info("Shutting down worker...")
 
+	if relay != nil {
+		if err := relay.Stop(); err != nil {
+			logrus.WithError(err).Error("Error stopping outbox relay")
+		}
+	}
+
 	// Stop the worker
 	if err := queueWorker.Stop(); err != nil {
 		logrus.WithError(err).Error("Error stopping worker")
@@ -97,42 +204,87 @@ func startWorker(ctx context.Context) {
 	os.Exit(0)
 }
 
+// startOutboxRelay starts relaying the outbox messages of conn with a
+// producer of the configured queue type
+func startOutboxRelay(config *conf.GlobalConfiguration, registry *messaging.Registry, conn *db.Connection) *worker.OutboxRelay {
+	producer, err := registry.CreateProducer(config.Messaging.Type, worker.QueueConfig(&config.Messaging))
+	if err != nil {
+		logrus.WithError(err).Fatal("Failed to create outbox producer")
+	}
+
+	relay := worker.NewOutboxRelay(conn, producer, &config.Worker.Outbox)
+	relay.Start()
+
+	return relay
+}
+
+// messagingRegistry returns a registry with the available messaging
+// implementations. The postgres implementation uses conn, which is only
+// needed when the configured queue type is postgres, see usesQueueDB.
+func messagingRegistry(conn *db.Connection) *messaging.Registry {
+	registry := messaging.NewRegistry()
+	kafka.Register(registry)
+	memory.Register(registry)
+	postgres.Register(registry, conn)
+	return registry
+}
+
+// usesQueueDB reports whether the configured queue type keeps its messages in
+// the database
+func usesQueueDB(config *conf.GlobalConfiguration) bool {
+	return config.Messaging.Type == "postgres"
+}
+
 // registerMessageHandlers registers handlers for different message types
 func registerMessageHandlers(queueWorker *worker.QueueWorker) {
 	// User-related message handlers
-	queueWorker.RegisterHandler(messaging.UserCreated, handleUserCreated)
+	worker.RegisterTyped(queueWorker, messaging.UserCreated, handleUserCreated)
 
 	// Order-related message handlers
-	queueWorker.RegisterHandler(messaging.OrderPlaced, handleOrderPlaced)
+	worker.RegisterTyped(queueWorker, messaging.OrderPlaced, handleOrderPlaced)
 
-	// Payment-related message handlers
-	queueWorker.RegisterHandler(messaging.PaymentReceived, handlePaymentReceived)
+	// Payment-related message handlers, payments must not be processed twice
+	// when a message is redelivered
+	worker.RegisterTyped(queueWorker, messaging.PaymentReceived, handlePaymentReceived)
+	queueWorker.UseFor(messaging.PaymentReceived, worker.Deduplicate(worker.NewMemoryDedupStore(24*time.Hour)))
 
 	// Notification-related message handlers
-	queueWorker.RegisterHandler(messaging.NotificationSent, handleNotificationSent)
+	worker.RegisterTyped(queueWorker, messaging.NotificationSent, handleNotificationSent)
 }
 
 // Message handler functions
-func handleUserCreated(ctx context.Context, msg *messaging.Message) error {
-	logrus.WithField("messageID", msg.ID).Info("Handling user created message")
+func handleUserCreated(ctx context.Context, msg *messaging.Message, event messaging.UserEvent) error {
+	logrus.WithFields(logrus.Fields{
+		"messageID": msg.ID,
+		"userID":    event.UserID,
+	}).Info("Handling user created message")
 	// Process user creation message
 	return nil
 }
 
-func handleOrderPlaced(ctx context.Context, msg *messaging.Message) error {
-	logrus.WithField("messageID", msg.ID).Info("Handling order placed message")
+func handleOrderPlaced(ctx context.Context, msg *messaging.Message, event messaging.OrderEvent) error {
+	logrus.WithFields(logrus.Fields{
+		"messageID": msg.ID,
+		"orderID":   event.OrderID,
+	}).Info("Handling order placed message")
 	// Process order placement message
 	return nil
 }
 
-func handlePaymentReceived(ctx context.Context, msg *messaging.Message) error {
-	logrus.WithField("messageID", msg.ID).Info("Handling payment received message")
+func handlePaymentReceived(ctx context.Context, msg *messaging.Message, event messaging.PaymentEvent) error {
+	logrus.WithFields(logrus.Fields{
+		"messageID": msg.ID,
+		"paymentID": event.PaymentID,
+	}).Info("Handling payment received message")
 	// Process payment message
 	return nil
 }
 
-func handleNotificationSent(ctx context.Context, msg *messaging.Message) error {
-	logrus.WithField("messageID", msg.ID).Info("Handling notification sent message")
+func handleNotificationSent(ctx context.Context, msg *messaging.Message, event messaging.NotificationEvent) error {
+	logrus.WithFields(logrus.Fields{
+		"messageID":      msg.ID,
+		"notificationID": event.NotificationID,
+	}).Info("Handling notification sent message")
 	// Process notification message
 	return nil
 }
@@ -2,9 +2,11 @@ package api
 
 import (
 	"net/http"
+	"sync/atomic"
 
 	"github.com/sebest/xff"
 	"github.com/trranminhquang/go-boilerplate/internal/conf"
+	"github.com/trranminhquang/go-boilerplate/internal/db"
 )
 
 const (
@@ -12,13 +14,31 @@ const (
 )
 
 type API struct {
-	config  *conf.GlobalConfiguration
+	config  atomic.Pointer[conf.GlobalConfiguration]
+	db      atomic.Pointer[db.Connection]
 	handler http.Handler
 	version string
 }
 
 func (a *API) Config() *conf.GlobalConfiguration {
-	return a.config
+	return a.config.Load()
+}
+
+// SetConfig atomically replaces the configuration used by the API. Requests
+// already in flight keep using the configuration they started with.
+func (a *API) SetConfig(config *conf.GlobalConfiguration) {
+	a.config.Store(config)
+}
+
+// DB returns the database connection used by the API.
+func (a *API) DB() *db.Connection {
+	return a.db.Load()
+}
+
+// SetDB atomically replaces the database connection used by the API and
+// returns the previous one, which requests in flight may still be using.
+func (a *API) SetDB(conn *db.Connection) *db.Connection {
+	return a.db.Swap(conn)
 }
 
 func (a *API) Version() string {
@@ -30,16 +50,17 @@ func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 // NewAPI instantiates a new REST API
-func NewAPI(config *conf.GlobalConfiguration, opts ...Option) *API {
-	return NewApiWithVersion(defaultVersion, config, opts...)
+func NewAPI(config *conf.GlobalConfiguration, db *db.Connection, opts ...Option) *API {
+	return NewApiWithVersion(defaultVersion, config, db, opts...)
 }
 
 // NewAPIWithVersion creates a new REST API using the specified version
-func NewApiWithVersion(version string, config *conf.GlobalConfiguration, opts ...Option) *API {
+func NewApiWithVersion(version string, config *conf.GlobalConfiguration, db *db.Connection, opts ...Option) *API {
 	api := &API{
-		config:  config,
 		version: version,
 	}
+	api.config.Store(config)
+	api.db.Store(db)
 
 	for _, o := range opts {
 		o.apply(api)
@@ -53,6 +74,15 @@ func NewApiWithVersion(version string, config *conf.GlobalConfiguration, opts ..
 
 	r.Get("/health", api.HealthCheck)
 
+	r.Route("/users", func(r *router) {
+		r.Post("/", api.UserCreate)
+
+		r.Route("/{user_id}", func(r *router) {
+			r.Get("/", api.UserGet)
+			r.Put("/", api.UserUpdate)
+		})
+	})
+
 	api.handler = r
 
 	return api
@@ -62,6 +92,7 @@ type HealthCheckResponse struct {
 	Version     string `json:"version"`
 	Name        string `json:"name"`
 	Description string `json:"description"`
+	Profile     string `json:"profile,omitempty"`
 }
 
 func (a *API) HealthCheck(w http.ResponseWriter, r *http.Request) error {
@@ -69,5 +100,6 @@ func (a *API) HealthCheck(w http.ResponseWriter, r *http.Request) error {
 		Version:     a.version,
 		Name:        "Go Boilerplate",
 		Description: "A simple boilerplate for building REST APIs in Go",
+		Profile:     a.Config().Profile,
 	})
 }
@@ -3,6 +3,8 @@ package api
 import (
 	"fmt"
 	"net/http"
+
+	"github.com/sirupsen/logrus"
 )
 
 type HTTPError struct {
@@ -45,13 +47,54 @@ func (e *HTTPError) WithInternalMessage(fmtString string, args ...any) *HTTPErro
 	return e
 }
 
+func httpError(httpStatus int, fmtString string, args ...any) *HTTPError {
+	return &HTTPError{
+		HTTPStatus: httpStatus,
+		Message:    fmt.Sprintf(fmtString, args...),
+	}
+}
+
+func badRequestError(fmtString string, args ...any) *HTTPError {
+	return httpError(http.StatusBadRequest, fmtString, args...)
+}
+
+func notFoundError(fmtString string, args ...any) *HTTPError {
+	return httpError(http.StatusNotFound, fmtString, args...)
+}
+
+func conflictError(fmtString string, args ...any) *HTTPError {
+	return httpError(http.StatusConflict, fmtString, args...)
+}
+
+func internalServerError(fmtString string, args ...any) *HTTPError {
+	return httpError(http.StatusInternalServerError, fmtString, args...)
+}
+
 func HandleResponseError(err error, w http.ResponseWriter, r *http.Request) {
+	log := logrus.WithFields(logrus.Fields{
+		"method": r.Method,
+		"path":   r.URL.Path,
+	})
+
 	switch e := err.(type) {
 	case *HTTPError:
 		switch {
-		case e.HTTPStatus > http.StatusInternalServerError:
+		case e.HTTPStatus >= http.StatusInternalServerError:
+			log.WithError(e.Cause()).Error(e.Error())
+		default:
+			log.WithError(e.Cause()).Info(e.Error())
+		}
 
+		if jsonErr := sendJSON(w, e.HTTPStatus, e); jsonErr != nil {
+			log.WithError(jsonErr).Warn("Failed to send JSON on ResponseWriter")
 		}
 
+	default:
+		log.WithError(err).Error("Unhandled server error")
+
+		se := internalServerError(http.StatusText(http.StatusInternalServerError))
+		if jsonErr := sendJSON(w, se.HTTPStatus, se); jsonErr != nil {
+			log.WithError(jsonErr).Warn("Failed to send JSON on ResponseWriter")
+		}
 	}
 }
@@ -0,0 +1,181 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gobuffalo/validate/v3"
+	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
+	"github.com/trranminhquang/go-boilerplate/internal/db"
+	"github.com/trranminhquang/go-boilerplate/internal/models"
+	"github.com/trranminhquang/go-boilerplate/pkg/utils"
+)
+
+// UserCreateParams parameters for creating a user
+type UserCreateParams struct {
+	Email    string                 `json:"email"`
+	Phone    string                 `json:"phone"`
+	Password string                 `json:"password"`
+	UserData map[string]interface{} `json:"user_metadata"`
+}
+
+// UserUpdateParams parameters for updating a user
+type UserUpdateParams struct {
+	Email    *string                `json:"email"`
+	Phone    *string                `json:"phone"`
+	UserData map[string]interface{} `json:"user_metadata"`
+}
+
+// UserCreate creates a user. Its user_created event is enqueued in the same
+// transaction, so it is published if and only if the user is committed.
+func (a *API) UserCreate(w http.ResponseWriter, r *http.Request) error {
+	body, err := utils.GetBodyBytes(r)
+	if err != nil {
+		return internalServerError("Could not read body").WithInternalError(err)
+	}
+
+	params := &UserCreateParams{}
+	if err := json.Unmarshal(body, params); err != nil {
+		return badRequestError("Could not parse request body as JSON: %v", err)
+	}
+	if params.Email == "" && params.Phone == "" {
+		return badRequestError("An email or phone is required")
+	}
+
+	user, err := models.NewUser(params.Phone, params.Email, params.Password, params.UserData)
+	if err != nil {
+		return internalServerError("Error creating user").WithInternalError(err)
+	}
+
+	err = a.DB().WithContext(r.Context()).Transaction(func(tx *db.Connection) error {
+		return models.CreateUser(tx, user)
+	})
+	if err != nil {
+		return internalServerError("Database error saving new user").WithInternalError(err)
+	}
+
+	w.Header().Set("ETag", userETag(user))
+	return sendJSON(w, http.StatusCreated, user)
+}
+
+// UserGet returns a user along with an ETag identifying its current version
+func (a *API) UserGet(w http.ResponseWriter, r *http.Request) error {
+	user, err := a.loadUser(a.DB().WithContext(r.Context()), r)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("ETag", userETag(user))
+	return sendJSON(w, http.StatusOK, user)
+}
+
+// UserUpdate updates a user. When an If-Match header is sent, the update is
+// only applied if the user still matches that ETag, otherwise the update is
+// applied to the version just read. Concurrent modifications result in a
+// 409 Conflict. A body without any field returns the user unchanged.
+func (a *API) UserUpdate(w http.ResponseWriter, r *http.Request) error {
+	body, err := utils.GetBodyBytes(r)
+	if err != nil {
+		return internalServerError("Could not read body").WithInternalError(err)
+	}
+
+	params := &UserUpdateParams{}
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, params); err != nil {
+			return badRequestError("Could not parse request body as JSON: %v", err)
+		}
+	}
+
+	conn := a.DB().WithContext(r.Context()).Primary()
+	user, err := a.loadUser(conn, r)
+	if err != nil {
+		return err
+	}
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != "*" {
+		updatedAt, err := parseUserETag(ifMatch)
+		if err != nil {
+			return badRequestError("Invalid If-Match header")
+		}
+		if updatedAt.UnixMicro() != user.UpdatedAt.UnixMicro() {
+			return conflictError("User was modified by another request")
+		}
+	}
+
+	var columns []string
+	if params.Email != nil {
+		user.Email = db.NullString(strings.ToLower(*params.Email))
+		columns = append(columns, "email")
+	}
+	if params.Phone != nil {
+		user.Phone = db.NullString(*params.Phone)
+		columns = append(columns, "phone")
+	}
+	if params.UserData != nil {
+		user.UserMetaData = params.UserData
+		columns = append(columns, "raw_user_meta_data")
+	}
+
+	// Nothing to update, the user is returned as is
+	if len(columns) == 0 {
+		w.Header().Set("ETag", userETag(user))
+		return sendJSON(w, http.StatusOK, user)
+	}
+
+	err = conn.Transaction(func(tx *db.Connection) error {
+		return tx.UpdateOnlyIfUnchanged(user, columns...)
+	})
+	if err != nil {
+		var conflict *db.ConflictError
+		if errors.As(err, &conflict) {
+			return conflictError("User was modified by another request").WithInternalError(err)
+		}
+		var verrs *validate.Errors
+		if errors.As(err, &verrs) {
+			return badRequestError("Invalid user: %v", verrs)
+		}
+		return internalServerError("Error updating user").WithInternalError(err)
+	}
+
+	w.Header().Set("ETag", userETag(user))
+	return sendJSON(w, http.StatusOK, user)
+}
+
+func (a *API) loadUser(conn *db.Connection, r *http.Request) (*models.User, error) {
+	userID, err := uuid.FromString(chi.URLParam(r, "user_id"))
+	if err != nil {
+		return nil, notFoundError("User not found")
+	}
+
+	user, err := models.FindUserByID(conn, userID)
+	if err != nil {
+		if models.IsNotFoundError(err) {
+			return nil, notFoundError("User not found")
+		}
+		return nil, internalServerError("Database error finding user").WithInternalError(err)
+	}
+	return user, nil
+}
+
+// userETag derives a strong ETag from the user's last modification time.
+func userETag(user *models.User) string {
+	return `"` + strconv.FormatInt(user.UpdatedAt.UnixMicro(), 10) + `"`
+}
+
+// parseUserETag parses an ETag sent back by a client. Weak validators are
+// accepted as well since proxies commonly weaken the ETags they forward, e.g.
+// when compressing the response.
+func parseUserETag(etag string) (time.Time, error) {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	micros, err := strconv.ParseInt(strings.Trim(etag, `"`), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.UnixMicro(micros), nil
+}
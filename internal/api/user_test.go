@@ -0,0 +1,152 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/trranminhquang/go-boilerplate/internal/conf"
+	"github.com/trranminhquang/go-boilerplate/internal/db"
+	"github.com/trranminhquang/go-boilerplate/internal/models"
+)
+
+// newTestAPI serves the API on the database of TEST_DATABASE_URL with an
+// empty users table, and skips the test when it is not set. SQLite databases
+// need the sqlite build tag, e.g.
+//
+//	TEST_DATABASE_URL=sqlite3:///tmp/test.db go test -tags sqlite ./internal/api
+func newTestAPI(t *testing.T) (*API, *db.Connection) {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	config := &conf.GlobalConfiguration{DB: conf.DBConfiguration{URL: url}}
+	conn, err := db.Dial(config)
+	if err != nil {
+		t.Fatalf("dialing %s: %v", url, err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	for _, stmt := range []string{
+		"DROP TABLE IF EXISTS users",
+		`CREATE TABLE users (
+			id varchar(36) PRIMARY KEY,
+			email text NULL,
+			email_confirmed_at timestamp NULL,
+			phone text NULL,
+			phone_confirmed_at timestamp NULL,
+			encrypted_password text NULL,
+			raw_user_meta_data text NULL,
+			confirmed_at timestamp NULL,
+			created_at timestamp NOT NULL,
+			updated_at timestamp NOT NULL
+		)`,
+	} {
+		if err := conn.RawQuery(stmt).Exec(); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	t.Cleanup(func() {
+		_ = conn.RawQuery("DROP TABLE IF EXISTS users").Exec()
+	})
+
+	return NewAPI(config, conn), conn
+}
+
+// createUser inserts a user with the specified email
+func createUser(t *testing.T, conn *db.Connection, email string) *models.User {
+	t.Helper()
+
+	user, err := models.NewUser("", email, "", nil)
+	if err != nil {
+		t.Fatalf("NewUser: %v", err)
+	}
+	if err := conn.Create(user); err != nil {
+		t.Fatalf("creating user: %v", err)
+	}
+	return user
+}
+
+// serve sends a request to the API, with an If-Match header when ifMatch is
+// not empty
+func serve(a *API, method, path, body, ifMatch string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if ifMatch != "" {
+		r.Header.Set("If-Match", ifMatch)
+	}
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, r)
+	return w
+}
+
+func TestUserGetETag(t *testing.T) {
+	a, conn := newTestAPI(t)
+	user := createUser(t, conn, "get@example.com")
+
+	w := serve(a, http.MethodGet, "/users/"+user.ID.String(), "", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET returned %d: %s", w.Code, w.Body)
+	}
+	stored, err := models.FindUserByID(conn, user.ID)
+	if err != nil {
+		t.Fatalf("FindUserByID: %v", err)
+	}
+	if etag := w.Header().Get("ETag"); etag != userETag(stored) {
+		t.Errorf("GET returned ETag %s, want %s", etag, userETag(stored))
+	}
+}
+
+func TestUserUpdateIfMatch(t *testing.T) {
+	a, conn := newTestAPI(t)
+	user := createUser(t, conn, "before@example.com")
+	path := "/users/" + user.ID.String()
+
+	etag := serve(a, http.MethodGet, path, "", "").Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("GET returned no ETag")
+	}
+
+	// An update matching the current version returns the ETag of the new
+	// one, which GET returns as well
+	w := serve(a, http.MethodPut, path, `{"email": "after@example.com"}`, etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT returned %d: %s", w.Code, w.Body)
+	}
+	updated := w.Header().Get("ETag")
+	if updated == "" || updated == etag {
+		t.Errorf("PUT returned ETag %q, want a new one", updated)
+	}
+	if got := serve(a, http.MethodGet, path, "", "").Header().Get("ETag"); got != updated {
+		t.Errorf("GET returned ETag %s after the update, want %s", got, updated)
+	}
+
+	// The previous ETag is stale
+	w = serve(a, http.MethodPut, path, `{"email": "stale@example.com"}`, etag)
+	if w.Code != http.StatusConflict {
+		t.Errorf("PUT with a stale If-Match returned %d, want 409: %s", w.Code, w.Body)
+	}
+	stored, err := models.FindUserByID(conn, user.ID)
+	if err != nil {
+		t.Fatalf("FindUserByID: %v", err)
+	}
+	if stored.Email != "after@example.com" {
+		t.Errorf("stored email %s after a stale update, want after@example.com", stored.Email)
+	}
+
+	// Weak validators are accepted, malformed ones are not
+	w = serve(a, http.MethodPut, path, `{"phone": "123"}`, "W/"+updated)
+	if w.Code != http.StatusOK {
+		t.Errorf("PUT with a weak If-Match returned %d, want 200: %s", w.Code, w.Body)
+	}
+	w = serve(a, http.MethodPut, path, `{"phone": "456"}`, `"not-an-etag"`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("PUT with a malformed If-Match returned %d, want 400: %s", w.Code, w.Body)
+	}
+}
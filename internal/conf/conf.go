@@ -1,25 +1,50 @@
 package conf
 
 import (
+	"errors"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/gobuffalo/pop/v6"
 	"github.com/gobwas/glob"
 	"github.com/joho/godotenv"
 	"github.com/kelseyhightower/envconfig"
+	"github.com/sirupsen/logrus"
 )
 
 // GlobalConfiguration holds all the configuration that applies to all instances.
 type GlobalConfiguration struct {
-	API APIConfiguration
-	DB  DBConfiguration
+	// Profile is the active configuration profile, e.g. "prod".
+	Profile string `json:"profile" envconfig:"APP_ENV"`
 
-	SiteURL         string `json:"site_url" split_words:"true" default:"http://localhost:8080"`
-	URIAllowListMap map[string]glob.Glob
+	API       APIConfiguration
+	DB        DBConfiguration
+	Logging   LoggingConfig `envconfig:"LOG"`
+	Secrets   SecretsConfiguration
+	Messaging MessagingConfiguration
+	Worker    WorkerConfiguration
+
+	SiteURL string `json:"site_url" split_words:"true" default:"http://localhost:8080"`
+	// URIAllowList holds glob patterns of the redirect URLs that are allowed
+	// besides SiteURL.
+	URIAllowList    []string             `json:"uri_allow_list" split_words:"true"`
+	URIAllowListMap map[string]glob.Glob `ignored:"true"`
+
+	// PasswordHashCost is the cost of the new password hashes, HashCostQuick
+	// trades their strength for speed in tests.
+	PasswordHashCost string `json:"password_hash_cost" split_words:"true" default:"default"`
 }
 
+// The password hash costs, see GlobalConfiguration.PasswordHashCost.
+const (
+	HashCostDefault = "default"
+	HashCostQuick   = "quick"
+)
+
 type APIConfiguration struct {
 	Host            string
 	Port            string `envconfig:"PORT" default:"8080"`
@@ -35,13 +60,276 @@ func (c *APIConfiguration) Validate() error {
 	// 	return err
 	// }
 
-	return nil
+	v := &validator{}
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		v.errorf("PORT", "must be a port number between 1 and 65535, got %q", c.Port)
+	}
+	v.nonNegative("API_MAX_REQUEST_DURATION", c.MaxRequestDuration)
+	return v.err()
+}
+
+// LoggingConfig holds the logging related configuration.
+type LoggingConfig struct {
+	Level string `json:"level" default:"info"`
+	// File is the path logs are appended to. Logs are written to stderr
+	// when it is empty. The file is reopened on SIGHUP.
+	File string `json:"file"`
+}
+
+func (c *LoggingConfig) Validate() error {
+	v := &validator{}
+	if _, err := logrus.ParseLevel(c.Level); err != nil {
+		v.errorf("LOG_LEVEL", "unknown log level %q", c.Level)
+	}
+	return v.err()
+}
+
+// MessagingConfiguration holds the message queue connection configuration.
+type MessagingConfiguration struct {
+	// Type is the name of the messaging implementation: "kafka",
+	// "postgres" to queue messages in the database, or "memory" for the
+	// in-process broker.
+	Type    string   `json:"type" default:"kafka"`
+	Brokers []string `json:"brokers" default:"localhost:9092"`
+	Topics  []string `json:"topics" default:"default-topic"`
+	GroupID string   `json:"group_id" split_words:"true" default:"go-worker-group"`
+	// DeadLetterTopic receives the messages that could not be handled.
+	// Dead-lettering is disabled when it is empty.
+	DeadLetterTopic string `json:"dead_letter_topic" split_words:"true" default:"dead-letter"`
+	// EventSource is the source attribute of the CloudEvents envelope
+	// stamped on published messages.
+	EventSource string `json:"event_source" split_words:"true" default:"go-boilerplate"`
+	// EventMode is how published messages carry their envelope: "binary" in
+	// their metadata, or "structured" in their payload.
+	EventMode string `json:"event_mode" split_words:"true" default:"binary"`
+	// InitialOffset is where a consumer group without committed offsets
+	// starts consuming: "earliest" or "latest".
+	InitialOffset string `json:"initial_offset" split_words:"true" default:"latest"`
+
+	Kafka    KafkaConfiguration    `json:"kafka"`
+	Postgres PostgresConfiguration `json:"postgres"`
+}
+
+func (c *MessagingConfiguration) Validate() error {
+	v := &validator{}
+	if c.Type == "" {
+		v.errorf("MESSAGING_TYPE", "is required")
+	}
+	if len(c.Brokers) == 0 {
+		v.errorf("MESSAGING_BROKERS", "is required")
+	}
+	if len(c.Topics) == 0 {
+		v.errorf("MESSAGING_TOPICS", "is required")
+	}
+	if c.GroupID == "" {
+		v.errorf("MESSAGING_GROUP_ID", "is required")
+	}
+	if c.EventSource == "" {
+		v.errorf("MESSAGING_EVENT_SOURCE", "is required")
+	}
+	if c.EventMode != "binary" && c.EventMode != "structured" {
+		v.errorf("MESSAGING_EVENT_MODE", "must be binary or structured, got %q", c.EventMode)
+	}
+	if c.InitialOffset != "earliest" && c.InitialOffset != "latest" {
+		v.errorf("MESSAGING_INITIAL_OFFSET", "must be earliest or latest, got %q", c.InitialOffset)
+	}
+	v.add(c.Kafka.Validate())
+	v.add(c.Postgres.Validate())
+	return v.err()
+}
+
+// KafkaConfiguration holds the settings specific to the kafka messaging
+// implementation.
+type KafkaConfiguration struct {
+	ClientID string `json:"client_id" split_words:"true" default:"go-boilerplate"`
+	// Acks is how many replicas must persist a message before it is
+	// considered published: "all", "leader" or "none".
+	Acks string `json:"acks" default:"all"`
+	// Idempotent producers do not duplicate messages when retrying. It
+	// requires acks to be "all".
+	Idempotent bool `json:"idempotent" default:"true"`
+	// Compression of message batches: "none", "gzip", "snappy", "lz4" or
+	// "zstd".
+	Compression string `json:"compression" default:"snappy"`
+	// Linger is how long the producer waits for more messages to batch
+	// together before sending a batch.
+	Linger time.Duration `json:"linger" default:"0s"`
+	// BatchMaxBytes bounds the size of a batch of messages.
+	BatchMaxBytes int `json:"batch_max_bytes" split_words:"true" default:"1000000"`
+	// CommitInterval is how often consumers commit the offsets of the
+	// acknowledged messages.
+	CommitInterval time.Duration `json:"commit_interval" split_words:"true" default:"1s"`
+	// RedeliveryDelay is how long a consumer waits before consuming a
+	// partition again from a message that was not acknowledged. It doubles
+	// with every redelivery of the same message up to MaxRedeliveryDelay.
+	RedeliveryDelay    time.Duration `json:"redelivery_delay" split_words:"true" default:"1s"`
+	MaxRedeliveryDelay time.Duration `json:"max_redelivery_delay" split_words:"true" default:"1m"`
+}
+
+func (c *KafkaConfiguration) Validate() error {
+	v := &validator{}
+	switch c.Acks {
+	case "all", "leader", "none":
+	default:
+		v.errorf("MESSAGING_KAFKA_ACKS", "must be all, leader or none, got %q", c.Acks)
+	}
+	if c.Idempotent && c.Acks != "all" {
+		v.errorf("MESSAGING_KAFKA_IDEMPOTENT", "requires MESSAGING_KAFKA_ACKS to be all, got %q", c.Acks)
+	}
+	switch c.Compression {
+	case "none", "gzip", "snappy", "lz4", "zstd":
+	default:
+		v.errorf("MESSAGING_KAFKA_COMPRESSION", "must be none, gzip, snappy, lz4 or zstd, got %q", c.Compression)
+	}
+	v.nonNegative("MESSAGING_KAFKA_LINGER", c.Linger)
+	if c.BatchMaxBytes < 1 {
+		v.errorf("MESSAGING_KAFKA_BATCH_MAX_BYTES", "must be at least 1, got %d", c.BatchMaxBytes)
+	}
+	if c.CommitInterval <= 0 {
+		v.errorf("MESSAGING_KAFKA_COMMIT_INTERVAL", "must be positive, got %s", c.CommitInterval)
+	}
+	if c.RedeliveryDelay <= 0 {
+		v.errorf("MESSAGING_KAFKA_REDELIVERY_DELAY", "must be positive, got %s", c.RedeliveryDelay)
+	}
+	if c.MaxRedeliveryDelay < c.RedeliveryDelay {
+		v.errorf("MESSAGING_KAFKA_MAX_REDELIVERY_DELAY", "must be at least MESSAGING_KAFKA_REDELIVERY_DELAY, got %s", c.MaxRedeliveryDelay)
+	}
+	return v.err()
+}
+
+// PostgresConfiguration holds the settings specific to the postgres
+// messaging implementation, which queues messages in the jobs table.
+type PostgresConfiguration struct {
+	// PollInterval is how often consumers look for due jobs when they are
+	// not notified of new ones, e.g. for jobs scheduled to run later
+	PollInterval time.Duration `json:"poll_interval" split_words:"true" default:"1s"`
+	// VisibilityTimeout is how long a claimed job is hidden from the other
+	// consumers. It is extended while the job is handled, so it only
+	// matters when a consumer dies.
+	VisibilityTimeout time.Duration `json:"visibility_timeout" split_words:"true" default:"30s"`
+	// BatchSize is the maximum number of jobs claimed at once
+	BatchSize int `json:"batch_size" split_words:"true" default:"10"`
+	// RetryDelay and MaxRetryDelay bound the exponential backoff of jobs
+	// that were not acknowledged
+	RetryDelay    time.Duration `json:"retry_delay" split_words:"true" default:"1s"`
+	MaxRetryDelay time.Duration `json:"max_retry_delay" split_words:"true" default:"5m"`
+}
+
+func (c *PostgresConfiguration) Validate() error {
+	v := &validator{}
+	if c.PollInterval <= 0 {
+		v.errorf("MESSAGING_POSTGRES_POLL_INTERVAL", "must be positive, got %s", c.PollInterval)
+	}
+	if c.VisibilityTimeout < time.Second {
+		v.errorf("MESSAGING_POSTGRES_VISIBILITY_TIMEOUT", "must be at least 1s, got %s", c.VisibilityTimeout)
+	}
+	if c.BatchSize < 1 {
+		v.errorf("MESSAGING_POSTGRES_BATCH_SIZE", "must be at least 1, got %d", c.BatchSize)
+	}
+	v.nonNegative("MESSAGING_POSTGRES_RETRY_DELAY", c.RetryDelay)
+	v.nonNegative("MESSAGING_POSTGRES_MAX_RETRY_DELAY", c.MaxRetryDelay)
+	return v.err()
+}
+
+// WorkerConfiguration holds the configuration of the queue workers.
+type WorkerConfiguration struct {
+	// Count is the number of concurrent workers to run
+	Count int `json:"count" default:"4"`
+	// QueueSize is the maximum number of jobs that can be queued
+	QueueSize int `json:"queue_size" split_words:"true" default:"100"`
+	// Ordered processes messages with the same key or partition sequentially
+	Ordered bool `json:"ordered" default:"false"`
+	// JobTimeout bounds the execution of a message handler, 0 disables it
+	JobTimeout time.Duration `json:"job_timeout" split_words:"true" default:"30s"`
+	// JobTimeouts overrides JobTimeout per message type, e.g.
+	// "user_created:5s,order_placed:1m"
+	JobTimeouts map[string]time.Duration `json:"job_timeouts" split_words:"true"`
+	// DrainTimeout is how long shutdown waits for queued jobs to finish
+	// before interrupting them
+	DrainTimeout time.Duration       `json:"drain_timeout" split_words:"true" default:"30s"`
+	Retry        RetryConfiguration  `json:"retry"`
+	Outbox       OutboxConfiguration `json:"outbox"`
+}
+
+func (c *WorkerConfiguration) Validate() error {
+	v := &validator{}
+	if c.Count < 1 {
+		v.errorf("WORKER_COUNT", "must be at least 1, got %d", c.Count)
+	}
+	if c.QueueSize < 0 {
+		v.errorf("WORKER_QUEUE_SIZE", "must not be negative, got %d", c.QueueSize)
+	}
+	v.nonNegative("WORKER_JOB_TIMEOUT", c.JobTimeout)
+	v.nonNegative("WORKER_DRAIN_TIMEOUT", c.DrainTimeout)
+	for msgType, timeout := range c.JobTimeouts {
+		if timeout < 0 {
+			v.errorf("WORKER_JOB_TIMEOUTS", "timeout of %s must not be negative, got %s", msgType, timeout)
+		}
+	}
+	v.add(c.Retry.Validate())
+	v.add(c.Outbox.Validate())
+	return v.err()
+}
+
+// RetryConfiguration holds the default retry policy of failed messages.
+type RetryConfiguration struct {
+	// MaxAttempts is the number of times a message is handled before it is
+	// given up on, including the first attempt
+	MaxAttempts int `json:"max_attempts" split_words:"true" default:"5"`
+	// BaseDelay and MaxDelay bound the exponential backoff between attempts
+	BaseDelay time.Duration `json:"base_delay" split_words:"true" default:"1s"`
+	MaxDelay  time.Duration `json:"max_delay" split_words:"true" default:"1m"`
+}
+
+func (c *RetryConfiguration) Validate() error {
+	v := &validator{}
+	if c.MaxAttempts < 1 {
+		v.errorf("WORKER_RETRY_MAX_ATTEMPTS", "must be at least 1, got %d", c.MaxAttempts)
+	}
+	v.nonNegative("WORKER_RETRY_BASE_DELAY", c.BaseDelay)
+	v.nonNegative("WORKER_RETRY_MAX_DELAY", c.MaxDelay)
+	if c.BaseDelay > c.MaxDelay {
+		v.errorf("WORKER_RETRY_BASE_DELAY", "must not exceed WORKER_RETRY_MAX_DELAY (%s), got %s", c.MaxDelay, c.BaseDelay)
+	}
+	return v.err()
+}
+
+// OutboxConfiguration holds the configuration of the outbox relay.
+type OutboxConfiguration struct {
+	Enabled bool `json:"enabled" default:"false"`
+	// PollInterval is how long the relay sleeps when the outbox is empty
+	PollInterval time.Duration `json:"poll_interval" split_words:"true" default:"1s"`
+	// BatchSize is the maximum number of messages claimed per transaction
+	BatchSize int `json:"batch_size" split_words:"true" default:"100"`
+	// MaxAttempts is the number of publish attempts before a message is
+	// marked as failed
+	MaxAttempts int `json:"max_attempts" split_words:"true" default:"10"`
+	// RetryDelay and MaxRetryDelay bound the exponential backoff between
+	// attempts
+	RetryDelay    time.Duration `json:"retry_delay" split_words:"true" default:"1s"`
+	MaxRetryDelay time.Duration `json:"max_retry_delay" split_words:"true" default:"5m"`
+}
+
+func (c *OutboxConfiguration) Validate() error {
+	v := &validator{}
+	if c.BatchSize < 1 {
+		v.errorf("WORKER_OUTBOX_BATCH_SIZE", "must be at least 1, got %d", c.BatchSize)
+	}
+	if c.MaxAttempts < 1 {
+		v.errorf("WORKER_OUTBOX_MAX_ATTEMPTS", "must be at least 1, got %d", c.MaxAttempts)
+	}
+	if c.PollInterval <= 0 {
+		v.errorf("WORKER_OUTBOX_POLL_INTERVAL", "must be positive, got %s", c.PollInterval)
+	}
+	v.nonNegative("WORKER_OUTBOX_RETRY_DELAY", c.RetryDelay)
+	v.nonNegative("WORKER_OUTBOX_MAX_RETRY_DELAY", c.MaxRetryDelay)
+	return v.err()
 }
 
 // DBConfiguration holds all the database related configuration.
 type DBConfiguration struct {
 	Driver    string `json:"driver" required:"true"`
-	URL       string `json:"url" envconfig:"DATABASE_URL" required:"true"`
+	URL       string `json:"url" envconfig:"DATABASE_URL" required:"true" secret:"true"`
 	Namespace string `json:"namespace" envconfig:"DB_NAMESPACE" default:"public"`
 	// MaxPoolSize defaults to 0 (unlimited).
 	MaxPoolSize       int           `json:"max_pool_size" split_words:"true"`
@@ -51,38 +339,127 @@ type DBConfiguration struct {
 	HealthCheckPeriod time.Duration `json:"health_check_period" split_words:"true"`
 	MigrationsPath    string        `json:"migrations_path" split_words:"true" default:"./migrations"`
 	CleanupEnabled    bool          `json:"cleanup_enabled" split_words:"true" default:"false"`
+
+	// ReplicaURLs is an optional list of read replicas. Find, First, Last,
+	// All and Count calls made outside of a transaction are spread across
+	// the healthy replicas. Query builders such as Where and RawQuery always
+	// use the primary unless called on db.Connection.Replica().
+	ReplicaURLs []string `json:"replica_urls" envconfig:"REPLICA_URLS" secret:"true"`
+	// ReplicaMaxLag is the replication lag after which a replica is ejected
+	// from the read rotation until it catches up.
+	ReplicaMaxLag      time.Duration `json:"replica_max_lag" split_words:"true" default:"10s"`
+	ReplicaCheckPeriod time.Duration `json:"replica_check_period" split_words:"true" default:"5s"`
 }
 
 func (c *DBConfiguration) Validate() error {
+	v := &validator{}
+
+	if !pop.DialectSupported(pop.CanonicalDialect(c.Driver)) {
+		v.errorf("DB_DRIVER", "unknown driver %q, expected one of %s", c.Driver, strings.Join(pop.AvailableDialects, ", "))
+	}
+
+	if err := validateDatabaseURL(c.URL); err != nil {
+		v.errorf("DATABASE_URL", "%v", err)
+	}
+	for i, u := range c.ReplicaURLs {
+		if err := validateDatabaseURL(u); err != nil {
+			v.errorf("DB_REPLICA_URLS", "replica %d: %v", i, err)
+		}
+	}
+
+	if c.MaxPoolSize < 0 {
+		v.errorf("DB_MAX_POOL_SIZE", "must not be negative, got %d", c.MaxPoolSize)
+	}
+	if c.MaxIdlePoolSize < 0 {
+		v.errorf("DB_MAX_IDLE_POOL_SIZE", "must not be negative, got %d", c.MaxIdlePoolSize)
+	} else if c.MaxPoolSize > 0 && c.MaxIdlePoolSize > c.MaxPoolSize {
+		v.errorf("DB_MAX_IDLE_POOL_SIZE", "must not exceed DB_MAX_POOL_SIZE (%d), got %d", c.MaxPoolSize, c.MaxIdlePoolSize)
+	}
+
+	v.nonNegative("DB_CONN_MAX_LIFETIME", c.ConnMaxLifetime)
+	v.nonNegative("DB_CONN_MAX_IDLE_TIME", c.ConnMaxIdleTime)
+	v.nonNegative("DB_HEALTH_CHECK_PERIOD", c.HealthCheckPeriod)
+	v.nonNegative("DB_REPLICA_MAX_LAG", c.ReplicaMaxLag)
+	v.nonNegative("DB_REPLICA_CHECK_PERIOD", c.ReplicaCheckPeriod)
+
+	return v.err()
+}
+
+// validateDatabaseURL checks that u is an absolute URL. The error never
+// includes u since it may contain credentials.
+func validateDatabaseURL(u string) error {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return errors.New("is not a valid URL")
+	}
+	if parsed.Scheme == "" {
+		return errors.New("must be an absolute URL with a scheme")
+	}
 	return nil
 }
 
-// Validate validates all of configuration.
+// Validate validates all of configuration. Every invalid field is reported
+// in the returned *ValidationError rather than stopping at the first one.
 func (c *GlobalConfiguration) Validate() error {
 	validatables := []interface {
 		Validate() error
 	}{
 		&c.API,
 		&c.DB,
+		&c.Logging,
+		&c.Messaging,
+		&c.Worker,
 	}
 
+	v := &validator{}
 	for _, validatable := range validatables {
-		if err := validatable.Validate(); err != nil {
-			return err
+		v.add(validatable.Validate())
+	}
+
+	c.validateProfile(v)
+
+	if u, err := url.ParseRequestURI(c.SiteURL); err != nil || u.Scheme == "" || u.Host == "" {
+		v.errorf("SITE_URL", "must be an absolute URL, got %q", c.SiteURL)
+	}
+
+	for _, pattern := range c.URIAllowList {
+		if _, err := glob.Compile(pattern, '.', '/'); err != nil {
+			v.errorf("URI_ALLOW_LIST", "invalid pattern %q: %v", pattern, err)
 		}
 	}
 
+	if c.PasswordHashCost != HashCostDefault && c.PasswordHashCost != HashCostQuick {
+		v.errorf("PASSWORD_HASH_COST", "must be %s or %s, got %q", HashCostDefault, HashCostQuick, c.PasswordHashCost)
+	}
+
+	return v.err()
+}
+
+// ApplyDefaults derives the fields that are not loaded from the environment.
+func (c *GlobalConfiguration) ApplyDefaults() error {
+	c.URIAllowListMap = make(map[string]glob.Glob, len(c.URIAllowList))
+	for _, pattern := range c.URIAllowList {
+		g, err := glob.Compile(pattern, '.', '/')
+		if err != nil {
+			return err
+		}
+		c.URIAllowListMap[pattern] = g
+	}
 	return nil
 }
 
 // LoadFile calls godotenv.Load() when the given filename is empty ignoring any
-// errors loading, otherwise it calls godotenv.Overload(filename).
+// errors loading, otherwise it calls godotenv.Overload(filename). Files with a
+// .yaml, .yml, .json or .toml extension are decoded onto the configuration
+// fields instead and never override the environment.
 //
 // godotenv.Load: preserves env, ".env" path is optional
 // godotenv.Overload: overrides env, "filename" path must exist
 func LoadFile(filename string) error {
 	var err error
-	if filename != "" {
+	if filename != "" && structuredFormat(filename) != "" {
+		err = loadStructuredFile(filename)
+	} else if filename != "" {
 		err = godotenv.Overload(filename)
 	} else {
 		err = godotenv.Load()
@@ -96,7 +473,8 @@ func LoadFile(filename string) error {
 
 // LoadDirectory does nothing when configDir is empty, otherwise it will attempt
 // to load a list of configuration files located in configDir by using ReadDir
-// to obtain a sorted list of files containing a .env suffix.
+// to obtain a sorted list of files containing a .env suffix. When APP_ENV is
+// set, base.env, <profile>.env and local.env are loaded last in that order.
 //
 // When the list is empty it will do nothing, otherwise it passes the file list
 // to godotenv.Overload to pull them into the current environment.
@@ -105,14 +483,28 @@ func LoadDirectory(configDir string) error {
 		return nil
 	}
 
-	// Returns entries sorted by filename
-	ents, err := os.ReadDir(configDir)
+	paths, err := directoryPaths(configDir, os.Getenv(ProfileEnvVar))
 	if err != nil {
 		// We mimic the behavior of LoadGlobal here, if an explicit path is
 		// provided we return an error.
 		return err
 	}
 
+	// If at least one path was found we load the configuration files in the
+	// directory. We don't call override without config files because it will
+	// override the env vars previously set with a ".env", if one exists.
+	return loadDirectoryPaths(paths...)
+}
+
+// directoryPaths returns the sorted list of files in configDir containing a
+// .env suffix, with the files of profile layered on top.
+func directoryPaths(configDir, profile string) ([]string, error) {
+	// Returns entries sorted by filename
+	ents, err := os.ReadDir(configDir)
+	if err != nil {
+		return nil, err
+	}
+
 	var paths []string
 	for _, ent := range ents {
 		if ent.IsDir() {
@@ -128,11 +520,7 @@ func LoadDirectory(configDir string) error {
 		// ent.Name() does not include the watch dir.
 		paths = append(paths, filepath.Join(configDir, name))
 	}
-
-	// If at least one path was found we load the configuration files in the
-	// directory. We don't call override without config files because it will
-	// override the env vars previously set with a ".env", if one exists.
-	return loadDirectoryPaths(paths...)
+	return profilePaths(paths, profile), nil
 }
 
 func loadDirectoryPaths(p ...string) error {
@@ -158,17 +546,46 @@ func LoadGlobalFromEnv() (*GlobalConfiguration, error) {
 }
 
 func loadGlobal(config *GlobalConfiguration) error {
-	if err := envconfig.Process("", config); err != nil {
+	restore, err := resolveSecrets()
+	if err != nil {
 		return err
 	}
+	defer restore()
 
-	// if err := config.ApplyDefaults(); err != nil {
-	// 	return err
-	// }
+	// envconfig stops at the first missing variable, so check them all
+	// upfront to report every one of them at once.
+	if err := checkRequired(); err != nil {
+		return err
+	}
+
+	if err := envconfig.Process("", config); err != nil {
+		return err
+	}
 
 	if err := config.Validate(); err != nil {
 		return err
 	}
-	// return populateGlobal(config)
-	return nil
+
+	return config.ApplyDefaults()
+}
+
+// checkRequired reports every required field that is missing from the
+// environment.
+func checkRequired() error {
+	v := &validator{}
+	for _, f := range configFields() {
+		if f.Field.Tag.Get("required") != "true" || f.Field.Tag.Get("default") != "" {
+			continue
+		}
+		if _, ok := os.LookupEnv(f.Key); ok {
+			continue
+		}
+		if f.Alt != "" {
+			if _, ok := os.LookupEnv(f.Alt); ok {
+				continue
+			}
+		}
+		v.errorf(f.EnvName(), "is required")
+	}
+	return v.err()
 }
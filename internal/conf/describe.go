@@ -0,0 +1,151 @@
+package conf
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const redacted = "********"
+
+// FieldDoc documents a configuration field, as derived from its struct tags.
+type FieldDoc struct {
+	// Path is the Go path of the field, e.g. "DB.URL".
+	Path string
+	// EnvName is the environment variable the field is read from.
+	EnvName string
+	// FileKey is the key of the field in YAML, JSON and TOML files.
+	FileKey  string
+	Type     string
+	Default  string
+	Required bool
+	// Secret fields are redacted when displayed.
+	Secret bool
+}
+
+// FieldValue is the resolved value of a configuration field.
+type FieldValue struct {
+	FieldDoc
+
+	// Value is the formatted value, redacted for secret fields.
+	Value string
+	// Source is where the value came from: a file path, "environment",
+	// "default" or "unset".
+	Source string
+}
+
+// Docs returns the documentation of every configuration field.
+func Docs() []FieldDoc {
+	fields := configFields()
+	docs := make([]FieldDoc, 0, len(fields))
+	for _, f := range fields {
+		docs = append(docs, f.doc())
+	}
+	return docs
+}
+
+func (f *configField) doc() FieldDoc {
+	return FieldDoc{
+		Path:     f.Path,
+		EnvName:  f.EnvName(),
+		FileKey:  f.FileKey,
+		Type:     f.Field.Type.String(),
+		Default:  f.Field.Tag.Get("default"),
+		Required: f.Field.Tag.Get("required") == "true",
+		Secret:   f.Field.Tag.Get("secret") == "true",
+	}
+}
+
+// Describe returns the value of every field of config along with where it was
+// loaded from. Secret values are redacted.
+func (w *Watcher) Describe(config *GlobalConfiguration) []FieldValue {
+	root := reflect.ValueOf(config).Elem()
+
+	fields := configFields()
+	values := make([]FieldValue, 0, len(fields))
+	for _, f := range fields {
+		fv := FieldValue{FieldDoc: f.doc()}
+
+		fv.Source = w.Source(f.Key)
+		if fv.Source == "" && f.Alt != "" {
+			fv.Source = w.Source(f.Alt)
+		}
+		if fv.Source == "" {
+			fv.Source = "unset"
+			if fv.Default != "" {
+				fv.Source = "default"
+			}
+		}
+
+		fv.Value = formatValue(fieldByPath(root, f.Path))
+		if fv.Secret {
+			fv.Value = redact(fv.Value)
+		}
+		values = append(values, fv)
+	}
+	return values
+}
+
+func formatValue(v reflect.Value) string {
+	switch val := v.Interface().(type) {
+	case time.Duration:
+		return val.String()
+	case []string:
+		return strings.Join(val, ",")
+	}
+
+	// Maps are printed in the key:value,... form envconfig parses
+	if v.Kind() == reflect.Map {
+		items := make([]string, 0, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			items = append(items, formatValue(iter.Key())+":"+formatValue(iter.Value()))
+		}
+		sort.Strings(items)
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// redact hides secret values. URLs keep their scheme, user, host and path,
+// which still allows telling where a process connects to, but their password,
+// query parameter values and fragment are hidden since they may hold
+// credentials, e.g. ?sslpassword=... or ?token=...
+func redact(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	parts := strings.Split(value, ",")
+	for i, part := range parts {
+		if u, err := url.Parse(part); err == nil && u.Scheme != "" && u.Host != "" {
+			parts[i] = redactURL(u)
+		} else {
+			parts[i] = redacted
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func redactURL(u *url.URL) string {
+	if u.RawQuery != "" {
+		query, err := url.ParseQuery(u.RawQuery)
+		if err != nil {
+			u.RawQuery = redacted
+		} else {
+			params := make([]string, 0, len(query))
+			for key := range query {
+				params = append(params, url.QueryEscape(key)+"="+redacted)
+			}
+			sort.Strings(params)
+			u.RawQuery = strings.Join(params, "&")
+		}
+	}
+	if u.Fragment != "" {
+		u.Fragment, u.RawFragment = redacted, ""
+	}
+	return u.Redacted()
+}
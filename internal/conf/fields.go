@@ -0,0 +1,113 @@
+package conf
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// These mirror the expressions envconfig uses to split camel cased field
+// names into words.
+var (
+	gatherRegexp  = regexp.MustCompile("([^A-Z]+|[A-Z]+[^A-Z]+|[A-Z]+)")
+	acronymRegexp = regexp.MustCompile("([A-Z]+)([A-Z][^A-Z]+)")
+)
+
+// configField describes a leaf field of GlobalConfiguration and where its
+// value is loaded from.
+type configField struct {
+	// Path is the Go path of the field, e.g. "DB.URL".
+	Path string
+
+	// FileKey is the key of the field in structured configuration files,
+	// e.g. "db.url".
+	FileKey string
+
+	// Key is the environment variable envconfig reads first, and Alt the
+	// unprefixed variable it falls back to when the field has an envconfig
+	// tag.
+	Key string
+	Alt string
+
+	Field reflect.StructField
+}
+
+// EnvName returns the environment variable operators are expected to set.
+func (f *configField) EnvName() string {
+	if f.Alt != "" {
+		return f.Alt
+	}
+	return f.Key
+}
+
+// configFields returns the leaf fields of GlobalConfiguration in declaration
+// order, using the same naming rules as envconfig.Process("", ...).
+func configFields() []configField {
+	return gatherFields("", "", "", reflect.TypeOf(GlobalConfiguration{}))
+}
+
+func gatherFields(pathPrefix, filePrefix, envPrefix string, t reflect.Type) []configField {
+	var fields []configField
+	for i := 0; i < t.NumField(); i++ {
+		ftype := t.Field(i)
+		if !ftype.IsExported() || ftype.Tag.Get("ignored") == "true" {
+			continue
+		}
+
+		f := configField{
+			Path:    joinPath(pathPrefix, ftype.Name, "."),
+			FileKey: joinPath(filePrefix, fileKey(ftype), "."),
+			Alt:     strings.ToUpper(ftype.Tag.Get("envconfig")),
+			Field:   ftype,
+		}
+
+		key := ftype.Name
+		if ftype.Tag.Get("split_words") == "true" {
+			key = strings.Join(splitWords(ftype.Name), "_")
+		}
+		if f.Alt != "" {
+			key = f.Alt
+		}
+		f.Key = strings.ToUpper(joinPath(envPrefix, key, "_"))
+
+		if ftype.Type.Kind() == reflect.Struct && ftype.Type != reflect.TypeOf(time.Time{}) {
+			fields = append(fields, gatherFields(f.Path, f.FileKey, f.Key, ftype.Type)...)
+			continue
+		}
+
+		// Only nested fields fall back to the unprefixed variable.
+		if envPrefix == "" {
+			f.Alt = ""
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// fileKey returns the json tag name of the field, or its snake cased name.
+func fileKey(f reflect.StructField) string {
+	if name, _, _ := strings.Cut(f.Tag.Get("json"), ","); name != "" && name != "-" {
+		return name
+	}
+	return strings.ToLower(strings.Join(splitWords(f.Name), "_"))
+}
+
+func splitWords(name string) []string {
+	var words []string
+	for _, w := range gatherRegexp.FindAllString(name, -1) {
+		if m := acronymRegexp.FindStringSubmatch(w); len(m) == 3 {
+			words = append(words, m[1], m[2])
+		} else {
+			words = append(words, w)
+		}
+	}
+	return words
+}
+
+func joinPath(prefix, name, sep string) string {
+	if prefix == "" {
+		return name
+	}
+	return prefix + sep + name
+}
@@ -0,0 +1,173 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// structuredFormat returns the format of filename based on its extension, or
+// an empty string for dotenv files.
+func structuredFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".json":
+		return "json"
+	case ".toml":
+		return "toml"
+	}
+	return ""
+}
+
+// readStructuredFile reads a YAML, JSON or TOML configuration file and
+// returns its values keyed by environment variable name. Keys are the json
+// names of the configuration fields, nested by section, e.g. db.url. Values
+// for variables already set according to isSet are skipped, so that the
+// environment takes precedence over the file. Unknown keys are an error.
+func readStructuredFile(filename string, isSet func(string) bool) (map[string]string, error) {
+	data, err := os.ReadFile(filename) // #nosec G304
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make(map[string]interface{})
+	switch format := structuredFormat(filename); format {
+	case "yaml":
+		err = yaml.Unmarshal(data, &raw)
+	case "json":
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		err = dec.Decode(&raw)
+	case "toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("unsupported configuration file format: %s", filename)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", filename, err)
+	}
+
+	fields := make(map[string]configField)
+	for _, f := range configFields() {
+		fields[f.FileKey] = f
+	}
+
+	flat := make(map[string]interface{})
+	flatten("", raw, fields, flat)
+
+	var unknown []string
+	values := make(map[string]string)
+	for key, v := range flat {
+		f, ok := fields[key]
+		if !ok {
+			unknown = append(unknown, key)
+			continue
+		}
+
+		value, err := envString(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", filename, key, err)
+		}
+
+		if isSet(f.Key) || (f.Alt != "" && isSet(f.Alt)) {
+			continue
+		}
+		values[f.EnvName()] = value
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown configuration keys in %s: %s", filename, strings.Join(unknown, ", "))
+	}
+	return values, nil
+}
+
+// flatten turns nested sections into dotted keys. The values of map fields,
+// e.g. worker.job_timeouts, are kept whole.
+func flatten(prefix string, m map[string]interface{}, fields map[string]configField, out map[string]interface{}) {
+	for k, v := range m {
+		key := joinPath(prefix, k, ".")
+		if section, ok := v.(map[string]interface{}); ok && !isMapField(fields, key) {
+			flatten(key, section, fields, out)
+			continue
+		}
+		out[key] = v
+	}
+}
+
+func isMapField(fields map[string]configField, key string) bool {
+	f, ok := fields[key]
+	return ok && f.Field.Type.Kind() == reflect.Map
+}
+
+// envString formats a decoded value the way envconfig expects to parse it.
+func envString(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case json.Number:
+		return v.String(), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			s, err := envString(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		// Maps are written in the key:value,... form envconfig parses
+		items := make([]string, 0, len(v))
+		for key, item := range v {
+			s, err := envString(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, key+":"+s)
+		}
+		sort.Strings(items)
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value type %T", v)
+}
+
+// loadStructuredFile sets the variables of a structured configuration file
+// that are not already present in the environment.
+func loadStructuredFile(filename string) error {
+	values, err := readStructuredFile(filename, func(key string) bool {
+		_, ok := os.LookupEnv(key)
+		return ok
+	})
+	if err != nil {
+		return err
+	}
+
+	for key, value := range values {
+		if err := os.Setenv(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package conf
+
+import (
+	"net"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ProfileEnvVar selects the configuration profile. The --profile flag sets
+// it as well.
+const ProfileEnvVar = "APP_ENV"
+
+// The known configuration profiles.
+const (
+	ProfileDev     = "dev"
+	ProfileTest    = "test"
+	ProfileStaging = "staging"
+	ProfileProd    = "prod"
+)
+
+// Profiles lists the known configuration profiles.
+var Profiles = []string{ProfileDev, ProfileTest, ProfileStaging, ProfileProd}
+
+const (
+	// baseProfileFile is loaded first for every profile.
+	baseProfileFile = "base.env"
+	// localProfileFile is loaded last so developers can override any profile
+	// without touching the shared files.
+	localProfileFile = "local.env"
+)
+
+// profilePaths layers the profile files on top of the sorted paths of a
+// config directory. Other .env files are loaded first in their sorted order,
+// followed by base.env, <profile>.env and local.env. The files of the other
+// profiles are skipped, and so are the files of every profile when profile is
+// empty.
+func profilePaths(paths []string, profile string) []string {
+	layers := []string{baseProfileFile, localProfileFile}
+	if profile != "" {
+		layers = []string{baseProfileFile, profile + ".env", localProfileFile}
+	}
+	found := make(map[string]string, len(layers))
+
+	var result []string
+	for _, p := range paths {
+		name := filepath.Base(p)
+		switch {
+		case slices.Contains(layers, name):
+			found[name] = p
+		case slices.Contains(Profiles, strings.TrimSuffix(name, ".env")):
+			// belongs to another profile
+		default:
+			result = append(result, p)
+		}
+	}
+
+	for _, name := range layers {
+		if p, ok := found[name]; ok {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// validateProfile checks that the profile is known and refuses settings that
+// are unsafe in production.
+func (c *GlobalConfiguration) validateProfile(v *validator) {
+	if c.Profile == "" {
+		return
+	}
+	if !slices.Contains(Profiles, c.Profile) {
+		v.errorf(ProfileEnvVar, "unknown profile %q, expected one of %s", c.Profile, strings.Join(Profiles, ", "))
+		return
+	}
+	if c.Profile != ProfileProd {
+		return
+	}
+
+	if u, err := url.Parse(c.SiteURL); err == nil && isLocalHost(u.Hostname()) {
+		v.errorf("SITE_URL", "must not point to %s in the %s profile", u.Hostname(), c.Profile)
+	}
+	switch strings.ToLower(c.Logging.Level) {
+	case "debug", "trace":
+		v.errorf("LOG_LEVEL", "must not be %s in the %s profile", c.Logging.Level, c.Profile)
+	}
+	if c.PasswordHashCost != HashCostDefault {
+		v.errorf("PASSWORD_HASH_COST", "must be %s in the %s profile, got %q", HashCostDefault, c.Profile, c.PasswordHashCost)
+	}
+}
+
+func isLocalHost(host string) bool {
+	if strings.EqualFold(host, "localhost") || strings.HasSuffix(strings.ToLower(host), ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsUnspecified())
+}
@@ -0,0 +1,199 @@
+package conf
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+// SecretPrefix marks an environment variable value as a reference to a
+// secret held by the configured SecretProvider, e.g. DATABASE_URL=secret:db.
+const SecretPrefix = "secret:"
+
+// SecretsConfiguration selects the SecretProvider used to resolve secret
+// references.
+type SecretsConfiguration struct {
+	// Provider is the name of a registered SecretProvider. Secret references
+	// are rejected when it is empty.
+	Provider string `json:"provider"`
+	// File is the path of the secrets file used by file based providers.
+	File string `json:"file"`
+	// DecryptionKeys maps key IDs to base64 URL encoded 256 bit keys, as
+	// "id1:key1,id2:key2".
+	DecryptionKeys map[string]string `json:"decryption_keys" split_words:"true" secret:"true"`
+}
+
+// SecretProvider resolves named secrets. Providers are asked again on every
+// configuration load, so rotated secrets are picked up by a reload.
+type SecretProvider interface {
+	GetSecret(name string) (string, error)
+}
+
+// SecretProviderFactory creates a SecretProvider from the configuration.
+type SecretProviderFactory func(config *SecretsConfiguration) (SecretProvider, error)
+
+var (
+	secretProvidersMu sync.RWMutex
+	secretProviders   = make(map[string]SecretProviderFactory)
+
+	// resolveMu serializes configuration loads, since secrets are only
+	// placed in the environment for the duration of a load.
+	resolveMu sync.Mutex
+)
+
+// LoadSecretsFromEnv returns the secrets configuration from the environment.
+func LoadSecretsFromEnv() (*SecretsConfiguration, error) {
+	config := new(SecretsConfiguration)
+	if err := envconfig.Process("SECRETS", config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// RegisterSecretProvider makes a SecretProvider available under name.
+func RegisterSecretProvider(name string, factory SecretProviderFactory) {
+	secretProvidersMu.Lock()
+	defer secretProvidersMu.Unlock()
+
+	secretProviders[name] = factory
+}
+
+func newSecretProvider(config *SecretsConfiguration) (SecretProvider, error) {
+	secretProvidersMu.RLock()
+	factory, ok := secretProviders[config.Provider]
+	secretProvidersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown secret provider %q", config.Provider)
+	}
+	return factory(config)
+}
+
+// secretEnv temporarily places resolved secrets in the environment so that
+// envconfig can process them like any other variable.
+type secretEnv struct {
+	previous map[string]envValue
+}
+
+func (s *secretEnv) set(key, value string) {
+	if _, ok := s.previous[key]; !ok {
+		v, ok := os.LookupEnv(key)
+		s.previous[key] = envValue{v, ok}
+	}
+	_ = os.Setenv(key, value)
+}
+
+func (s *secretEnv) restore() {
+	for key, v := range s.previous {
+		setEnv(key, v)
+	}
+	resolveMu.Unlock()
+}
+
+// resolveSecrets resolves the secrets of every configuration field for the
+// duration of a load. A variable that is not set is read from the file named
+// by the same variable with a _FILE suffix. A variable whose value starts
+// with SecretPrefix is replaced by the secret from the SecretProvider. The
+// returned function restores the environment and must always be called.
+func resolveSecrets() (func(), error) {
+	resolveMu.Lock()
+	env := &secretEnv{previous: make(map[string]envValue)}
+
+	fields := configFields()
+	for _, f := range fields {
+		if err := resolveSecretFile(env, f); err != nil {
+			env.restore()
+			return nil, err
+		}
+	}
+
+	config, err := LoadSecretsFromEnv()
+	if err != nil {
+		env.restore()
+		return nil, err
+	}
+
+	var provider SecretProvider
+	for _, f := range fields {
+		for _, key := range []string{f.Key, f.Alt} {
+			value, ok := os.LookupEnv(key)
+			if key == "" || !ok || !strings.HasPrefix(value, SecretPrefix) {
+				continue
+			}
+
+			if provider == nil {
+				if config.Provider == "" {
+					env.restore()
+					return nil, fmt.Errorf("%s references a secret but SECRETS_PROVIDER is not set", key)
+				}
+				var err error
+				if provider, err = newSecretProvider(config); err != nil {
+					env.restore()
+					return nil, err
+				}
+			}
+
+			secret, err := provider.GetSecret(strings.TrimPrefix(value, SecretPrefix))
+			if err != nil {
+				env.restore()
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			env.set(key, secret)
+		}
+	}
+
+	return env.restore, nil
+}
+
+// secretFiles returns the files secrets are currently read from: the files
+// named by _FILE variables and the secrets file of file based providers.
+func secretFiles() []string {
+	var paths []string
+	for _, f := range configFields() {
+		for _, key := range []string{f.Key, f.Alt} {
+			if key == "" {
+				continue
+			}
+			if path := os.Getenv(key + "_FILE"); path != "" {
+				paths = append(paths, path)
+			}
+		}
+	}
+	if path := os.Getenv("SECRETS_FILE"); path != "" {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// resolveSecretFile sets the variable of f from its _FILE variable, unless
+// the variable itself is set.
+func resolveSecretFile(env *secretEnv, f configField) error {
+	keys := []string{f.Key}
+	if f.Alt != "" {
+		keys = append(keys, f.Alt)
+	}
+
+	for _, key := range keys {
+		if _, ok := os.LookupEnv(key); ok {
+			return nil
+		}
+	}
+
+	for _, key := range keys {
+		path, ok := os.LookupEnv(key + "_FILE")
+		if !ok {
+			continue
+		}
+
+		data, err := os.ReadFile(path) // #nosec G304
+		if err != nil {
+			return fmt.Errorf("%s_FILE: %w", key, err)
+		}
+		env.set(key, strings.TrimRight(string(data), "\r\n"))
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package conf
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// FieldError is a validation error of a single configuration field, named by
+// its environment variable.
+type FieldError struct {
+	EnvName string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.EnvName + ": " + e.Message
+}
+
+// ValidationError aggregates every error found while validating the
+// configuration.
+type ValidationError struct {
+	Errors []error
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (e *ValidationError) Unwrap() []error {
+	return e.Errors
+}
+
+// validator collects the errors of a validation pass.
+type validator struct {
+	errs []error
+}
+
+func (v *validator) errorf(envName, format string, args ...any) {
+	v.errs = append(v.errs, &FieldError{EnvName: envName, Message: fmt.Sprintf(format, args...)})
+}
+
+// add appends err, flattening nested validation errors.
+func (v *validator) add(err error) {
+	if err == nil {
+		return
+	}
+	if ve, ok := err.(*ValidationError); ok {
+		v.errs = append(v.errs, ve.Errors...)
+		return
+	}
+	v.errs = append(v.errs, err)
+}
+
+func (v *validator) nonNegative(envName string, d time.Duration) {
+	if d < 0 {
+		v.errorf(envName, "must not be negative, got %s", d)
+	}
+}
+
+func (v *validator) err() error {
+	if len(v.errs) == 0 {
+		return nil
+	}
+	return &ValidationError{Errors: v.errs}
+}
@@ -0,0 +1,551 @@
+package conf
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/joho/godotenv"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultPollInterval is how often the watch directory is checked when
+	// file system notifications are unavailable.
+	DefaultPollInterval = 10 * time.Second
+
+	// reloadDebounce coalesces the burst of events produced by editors and
+	// atomic file swaps into a single reload.
+	reloadDebounce = 250 * time.Millisecond
+)
+
+// ConfigChange describes a configuration that was reloaded.
+type ConfigChange struct {
+	Old *GlobalConfiguration
+	New *GlobalConfiguration
+
+	// Fields lists the changed fields by their Go path, e.g. "API.Port".
+	Fields []string
+}
+
+// envValue is the value of an environment variable, or its absence.
+type envValue struct {
+	value string
+	ok    bool
+}
+
+// staticFields can only be changed by restarting the process. Reloads keep
+// their current value. The database settings are not static, subscribers
+// reconnect when they change so that rotated credentials take effect. The
+// messaging settings are used to create the
+// consumers and producers, and the worker settings listed here to size the
+// worker pool and start the outbox relay. The password hash cost is applied
+// once at startup.
+var staticFields = []string{
+	"Profile", "API.Host", "API.Port", "Messaging", "PasswordHashCost",
+	"Worker.Count", "Worker.QueueSize", "Worker.Ordered", "Worker.Outbox.Enabled",
+}
+
+// Watcher keeps the global configuration in sync with the configuration file
+// and the .env files of a watch directory. Reloaded configurations are
+// validated before they are swapped in, so an invalid reload never affects
+// the live configuration.
+type Watcher struct {
+	file         string
+	dir          string
+	PollInterval time.Duration
+
+	mu         sync.Mutex
+	fileValues map[string]string
+	dirValues  map[string]string
+	// dirSources maps the variables in dirValues to the file they came from.
+	dirSources map[string]string
+	// base holds the environment as it was before any file was applied, so
+	// that variables removed from the files can be restored.
+	base    map[string]envValue
+	applied map[string]string
+
+	config      atomic.Pointer[GlobalConfiguration]
+	subscribers []func(ConfigChange)
+	// notifyMu serializes the calls to the subscribers, which are made
+	// without holding mu
+	notifyMu sync.Mutex
+	logger   *logrus.Entry
+}
+
+// NewWatcher creates a watcher for configFile and configDir, which follow the
+// same rules as LoadFile and LoadDirectory. Only configDir and the secret
+// files are watched for changes, configFile is re-read on every Reload.
+func NewWatcher(configFile, configDir string) *Watcher {
+	return &Watcher{
+		file:         configFile,
+		dir:          configDir,
+		PollInterval: DefaultPollInterval,
+		fileValues:   make(map[string]string),
+		dirValues:    make(map[string]string),
+		dirSources:   make(map[string]string),
+		base:         make(map[string]envValue),
+		applied:      make(map[string]string),
+		logger:       logrus.WithField("component", "config-watcher"),
+	}
+}
+
+// LoadFile applies the configuration file to the environment, the same way
+// the package level LoadFile does.
+func (w *Watcher) LoadFile() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	values, err := w.readFile()
+	if err != nil {
+		return err
+	}
+	w.fileValues = values
+	w.apply(w.merged())
+	return nil
+}
+
+// LoadDirectory applies the .env files of the watch directory to the
+// environment, the same way the package level LoadDirectory does.
+func (w *Watcher) LoadDirectory() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	values, sources, err := w.readDirectory()
+	if err != nil {
+		return err
+	}
+	w.dirValues, w.dirSources = values, sources
+	w.apply(w.merged())
+	return nil
+}
+
+// Load builds the configuration from the environment and makes it the
+// current configuration.
+func (w *Watcher) Load() (*GlobalConfiguration, error) {
+	config, err := LoadGlobalFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	w.config.Store(config)
+	return config, nil
+}
+
+// Config returns the current configuration.
+func (w *Watcher) Config() *GlobalConfiguration {
+	return w.config.Load()
+}
+
+// Subscribe registers fn to be called after every reload that changed at
+// least one field. Subscribers are called sequentially in registration order.
+func (w *Watcher) Subscribe(fn func(ConfigChange)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.subscribers = append(w.subscribers, fn)
+}
+
+// Reload re-reads the configuration file and the watch directory and
+// rebuilds the configuration. When the new configuration fails to load or
+// validate the environment is rolled back and the current configuration is
+// kept. Fields that require a restart keep their current value.
+//
+// Subscribers are called once the watcher is unlocked, so that a slow one,
+// e.g. reconnecting to the database, does not block Source and Subscribe.
+func (w *Watcher) Reload() error {
+	w.mu.Lock()
+	change, err := w.reload()
+	if err != nil || len(change.Fields) == 0 {
+		w.mu.Unlock()
+		return err
+	}
+
+	// Lock notifyMu before unlocking mu, so that concurrent reloads notify
+	// the subscribers in the order they were applied
+	w.notifyMu.Lock()
+	defer w.notifyMu.Unlock()
+	subscribers := append([]func(ConfigChange){}, w.subscribers...)
+	w.mu.Unlock()
+
+	for _, fn := range subscribers {
+		fn(change)
+	}
+	return nil
+}
+
+// reload applies the configuration files and returns the resulting change.
+// The caller must hold mu.
+func (w *Watcher) reload() (ConfigChange, error) {
+	fileValues, err := w.readFile()
+	if err != nil {
+		return ConfigChange{}, err
+	}
+	dirValues, dirSources, err := w.readDirectory()
+	if err != nil {
+		return ConfigChange{}, err
+	}
+
+	prevFile, prevDir, prevSources := w.fileValues, w.dirValues, w.dirSources
+	w.fileValues, w.dirValues, w.dirSources = fileValues, dirValues, dirSources
+	rollback := w.apply(w.merged())
+
+	config, err := LoadGlobalFromEnv()
+	if err != nil {
+		rollback()
+		w.fileValues, w.dirValues, w.dirSources = prevFile, prevDir, prevSources
+		return ConfigChange{}, fmt.Errorf("rejected configuration reload: %w", err)
+	}
+
+	old := w.config.Load()
+	if old != nil {
+		if restart := keepStaticFields(old, config); len(restart) > 0 {
+			w.logger.WithField("fields", restart).Warn("Configuration changes require a restart to take effect")
+		}
+	}
+	w.config.Store(config)
+
+	change := ConfigChange{
+		Old:    old,
+		New:    config,
+		Fields: changedFields(old, config),
+	}
+	if len(change.Fields) > 0 {
+		w.logger.WithField("fields", change.Fields).Info("Configuration reloaded")
+	}
+	return change, nil
+}
+
+// Watch reloads the configuration whenever the watch directory or a secret
+// file changes, until ctx is canceled. Secret files are those named by _FILE
+// variables and SECRETS_FILE, and are watched through their directory so that
+// atomically swapped files are noticed. It uses file system notifications and
+// falls back to polling every PollInterval when they are unavailable.
+func (w *Watcher) Watch(ctx context.Context) {
+	dirs := w.watchDirs()
+	if len(dirs) == 0 {
+		return
+	}
+
+	fsw, err := fsnotify.NewWatcher()
+	if err == nil {
+		for _, dir := range dirs {
+			if err = fsw.Add(dir); err != nil {
+				_ = fsw.Close()
+				break
+			}
+		}
+	}
+	if err != nil {
+		w.logger.WithError(err).Warn("File system notifications unavailable, polling for changes")
+		w.poll(ctx)
+		return
+	}
+	defer fsw.Close()
+
+	debounce := time.NewTimer(reloadDebounce)
+	debounce.Stop()
+	defer debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-fsw.Events:
+			if !ok {
+				return
+			}
+			w.logger.WithField("event", event.String()).Debug("Watched file changed")
+			debounce.Reset(reloadDebounce)
+		case err, ok := <-fsw.Errors:
+			if !ok {
+				return
+			}
+			w.logger.WithError(err).Warn("Error watching configuration directory")
+		case <-debounce.C:
+			w.reloadAndLog()
+		}
+	}
+}
+
+// poll reloads the configuration whenever the size, modification time or
+// list of .env files in the watch directory, or a secret file, changes.
+func (w *Watcher) poll(ctx context.Context) {
+	interval := w.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := w.fingerprint()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if current := w.fingerprint(); current != last {
+				last = current
+				w.reloadAndLog()
+			}
+		}
+	}
+}
+
+func (w *Watcher) reloadAndLog() {
+	if err := w.Reload(); err != nil {
+		w.logger.WithError(err).Error("Unable to reload configuration")
+	}
+}
+
+// watchDirs returns the watch directory and the directories of the secret
+// files, without duplicates.
+func (w *Watcher) watchDirs() []string {
+	var dirs []string
+	seen := make(map[string]bool)
+	add := func(dir string) {
+		if dir != "" && !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	add(w.dir)
+	for _, p := range secretFiles() {
+		add(filepath.Dir(p))
+	}
+	return dirs
+}
+
+func (w *Watcher) fingerprint() string {
+	var paths []string
+	if w.dir != "" {
+		var err error
+		if paths, err = directoryPaths(w.dir, w.profile()); err != nil {
+			return err.Error()
+		}
+	}
+	paths = append(paths, secretFiles()...)
+
+	var b strings.Builder
+	for _, p := range paths {
+		info, err := os.Stat(p)
+		if err != nil {
+			fmt.Fprintf(&b, "%s:%v;", p, err)
+			continue
+		}
+		fmt.Fprintf(&b, "%s:%d:%d;", p, info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String()
+}
+
+// readFile returns the values of the configuration file. Without an explicit
+// file the optional .env file is read. Values of the .env file and of
+// structured files never override variables set in the environment.
+func (w *Watcher) readFile() (map[string]string, error) {
+	if w.file != "" && structuredFormat(w.file) != "" {
+		return readStructuredFile(w.file, func(key string) bool {
+			return w.baseValue(key).ok
+		})
+	} else if w.file != "" {
+		return godotenv.Read(w.file)
+	}
+
+	values, err := godotenv.Read()
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for key := range values {
+		if w.baseValue(key).ok {
+			delete(values, key)
+		}
+	}
+	return values, nil
+}
+
+// merged returns the file values overridden by the directory values.
+func (w *Watcher) merged() map[string]string {
+	values := make(map[string]string, len(w.fileValues)+len(w.dirValues))
+	for k, v := range w.fileValues {
+		values[k] = v
+	}
+	for k, v := range w.dirValues {
+		values[k] = v
+	}
+	return values
+}
+
+// baseValue returns the value key had before any file was applied.
+func (w *Watcher) baseValue(key string) envValue {
+	if v, ok := w.base[key]; ok {
+		return v
+	}
+	value, ok := os.LookupEnv(key)
+	return envValue{value, ok}
+}
+
+// profile returns the profile selecting the files of the watch directory.
+// It is taken from the environment or the configuration file, never from
+// the watch directory itself.
+func (w *Watcher) profile() string {
+	if v := w.baseValue(ProfileEnvVar); v.ok {
+		return v.value
+	}
+	return w.fileValues[ProfileEnvVar]
+}
+
+// readDirectory returns the merged values of the .env files in the watch
+// directory, later files taking precedence, along with the file each value
+// came from.
+func (w *Watcher) readDirectory() (map[string]string, map[string]string, error) {
+	values := make(map[string]string)
+	sources := make(map[string]string)
+	if w.dir == "" {
+		return values, sources, nil
+	}
+
+	paths, err := directoryPaths(w.dir, w.profile())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, p := range paths {
+		fileValues, err := godotenv.Read(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		for k, v := range fileValues {
+			values[k] = v
+			sources[k] = p
+		}
+	}
+	return values, sources, nil
+}
+
+// Source returns where the environment variable key got its value from: a
+// file path, "environment", or an empty string when it is not set. Values
+// read through a _FILE variable report the path of that file.
+func (w *Watcher) Source(key string) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if p, ok := w.dirSources[key]; ok {
+		return p
+	}
+	if _, ok := w.fileValues[key]; ok {
+		if w.file == "" {
+			return ".env"
+		}
+		return w.file
+	}
+	if _, ok := os.LookupEnv(key); ok {
+		return "environment"
+	}
+	if path, ok := os.LookupEnv(key + "_FILE"); ok {
+		return path
+	}
+	return ""
+}
+
+// apply sets values in the environment and restores the original value of
+// variables that were applied before but are no longer present. It returns a
+// function undoing the changes.
+func (w *Watcher) apply(values map[string]string) func() {
+	previous := make(map[string]envValue)
+	prevApplied := w.applied
+
+	set := func(key string, v envValue) {
+		if _, ok := previous[key]; !ok {
+			value, ok := os.LookupEnv(key)
+			previous[key] = envValue{value, ok}
+		}
+		setEnv(key, v)
+	}
+
+	for key, value := range values {
+		w.base[key] = w.baseValue(key)
+		set(key, envValue{value, true})
+	}
+	for key := range w.applied {
+		if _, ok := values[key]; !ok {
+			set(key, w.base[key])
+		}
+	}
+	w.applied = values
+
+	return func() {
+		for key, v := range previous {
+			setEnv(key, v)
+		}
+		w.applied = prevApplied
+	}
+}
+
+func setEnv(key string, v envValue) {
+	if v.ok {
+		_ = os.Setenv(key, v.value)
+	} else {
+		_ = os.Unsetenv(key)
+	}
+}
+
+// keepStaticFields copies the fields that require a restart from old into
+// config and returns the names of those that differed.
+func keepStaticFields(old, config *GlobalConfiguration) []string {
+	var restart []string
+	for _, name := range staticFields {
+		ov := fieldByPath(reflect.ValueOf(old).Elem(), name)
+		nv := fieldByPath(reflect.ValueOf(config).Elem(), name)
+		if !reflect.DeepEqual(ov.Interface(), nv.Interface()) {
+			restart = append(restart, name)
+			nv.Set(ov)
+		}
+	}
+	return restart
+}
+
+func fieldByPath(v reflect.Value, path string) reflect.Value {
+	for _, name := range strings.Split(path, ".") {
+		v = v.FieldByName(name)
+	}
+	return v
+}
+
+// changedFields returns the paths of the leaf fields that differ between a
+// and b. A nil a is treated as every field having changed.
+func changedFields(a, b *GlobalConfiguration) []string {
+	if a == nil {
+		a = &GlobalConfiguration{}
+	}
+	var fields []string
+	diffStruct("", reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem(), &fields)
+	return fields
+}
+
+func diffStruct(prefix string, a, b reflect.Value, fields *[]string) {
+	for i := 0; i < a.NumField(); i++ {
+		name := a.Type().Field(i).Name
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+
+		fa, fb := a.Field(i), b.Field(i)
+		if fa.Kind() == reflect.Struct && fa.Type() != reflect.TypeOf(time.Time{}) {
+			diffStruct(name, fa, fb, fields)
+			continue
+		}
+		if !reflect.DeepEqual(fa.Interface(), fb.Interface()) {
+			*fields = append(*fields, name)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package db
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"net/url"
 	"time"
 
@@ -15,6 +16,12 @@ import (
 // Connection is the interface a storage provider must implement.
 type Connection struct {
 	*pop.Connection
+
+	replicas *replicaSet
+
+	// savepoints is the number of savepoints enclosing this connection
+	// within its transaction.
+	savepoints int
 }
 
 // Dial will connect to that storage engine
@@ -60,14 +67,40 @@ func Dial(config *conf.GlobalConfiguration) (*Connection, error) {
 		options["pool_max_conn_idle_time"] = config.DB.ConnMaxIdleTime.String()
 	}
 
+	db, err := openConnection(&config.DB, driver, config.DB.URL, options)
+	if err != nil {
+		return nil, err
+	}
+
+	// if config.Metrics.Enabled {
+	// 	registerOpenTelemetryDatabaseStats(db)
+	// }
+
+	conn := &Connection{Connection: db}
+
+	if len(config.DB.ReplicaURLs) > 0 {
+		replicas, err := dialReplicas(&config.DB, driver, options)
+		if err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+		conn.replicas = replicas
+	}
+
+	return conn, nil
+}
+
+// openConnection opens and checks a single pop connection to dsn using the
+// pool settings from config.
+func openConnection(config *conf.DBConfiguration, driver, dsn string, options map[string]string) (*pop.Connection, error) {
 	db, err := pop.NewConnection(&pop.ConnectionDetails{
-		Dialect:         config.DB.Driver,
+		Dialect:         config.Driver,
 		Driver:          driver,
-		URL:             config.DB.URL,
-		Pool:            config.DB.MaxPoolSize,
-		IdlePool:        config.DB.MaxIdlePoolSize,
-		ConnMaxLifetime: config.DB.ConnMaxLifetime,
-		ConnMaxIdleTime: config.DB.ConnMaxIdleTime,
+		URL:             dsn,
+		Pool:            config.MaxPoolSize,
+		IdlePool:        config.MaxIdlePoolSize,
+		ConnMaxLifetime: config.ConnMaxLifetime,
+		ConnMaxIdleTime: config.ConnMaxIdleTime,
 		Options:         options,
 	})
 	if err != nil {
@@ -76,12 +109,7 @@ func Dial(config *conf.GlobalConfiguration) (*Connection, error) {
 	if err := db.Open(); err != nil {
 		return nil, errors.Wrap(err, "checking database connection")
 	}
-
-	// if config.Metrics.Enabled {
-	// 	registerOpenTelemetryDatabaseStats(db)
-	// }
-
-	return &Connection{db}, nil
+	return db, nil
 }
 
 type CommitWithError struct {
@@ -103,11 +131,15 @@ func NewCommitWithError(err error) *CommitWithError {
 	return &CommitWithError{Err: err}
 }
 
+// Transaction runs fn in a new transaction. When c already has a transaction
+// fn runs inside a savepoint instead, so that its failure only rolls back the
+// work done by fn. Returning a *CommitWithError from fn commits (or releases
+// the savepoint) and returns the error to the caller.
 func (c *Connection) Transaction(fn func(*Connection) error) error {
 	if c.TX == nil {
 		var returnErr error
 		if terr := c.Connection.Transaction(func(tx *pop.Connection) error {
-			err := fn(&Connection{tx})
+			err := fn(&Connection{Connection: tx})
 			switch err.(type) {
 			case *CommitWithError:
 				returnErr = err
@@ -126,11 +158,44 @@ func (c *Connection) Transaction(fn func(*Connection) error) error {
 		}
 		return returnErr
 	}
-	return fn(c)
+	return c.savepoint(fn)
+}
+
+// savepoint runs fn inside a savepoint of the current transaction, rolling
+// back to it when fn fails and releasing it otherwise.
+func (c *Connection) savepoint(fn func(*Connection) error) error {
+	name := fmt.Sprintf("sp_%d", c.savepoints+1)
+	if err := c.RawQuery("SAVEPOINT " + name).Exec(); err != nil {
+		return errors.Wrap(err, "creating savepoint")
+	}
+
+	err := fn(&Connection{Connection: c.Connection, savepoints: c.savepoints + 1})
+	if _, ok := err.(*CommitWithError); err != nil && !ok {
+		if rerr := c.RawQuery("ROLLBACK TO SAVEPOINT " + name).Exec(); rerr != nil {
+			return errors.Wrapf(rerr, "rolling back to savepoint after: %v", err)
+		}
+	}
+
+	if rerr := c.RawQuery("RELEASE SAVEPOINT " + name).Exec(); rerr != nil {
+		return errors.Wrap(rerr, "releasing savepoint")
+	}
+	return err
 }
 
 // WithContext returns a new connection with an updated context. This is
 // typically used for tracing as the context contains trace span information.
 func (c *Connection) WithContext(ctx context.Context) *Connection {
-	return &Connection{c.Connection.WithContext(ctx)}
+	return &Connection{
+		Connection: c.Connection.WithContext(ctx),
+		replicas:   c.replicas,
+		savepoints: c.savepoints,
+	}
+}
+
+// Close closes the primary connection along with any read replicas.
+func (c *Connection) Close() error {
+	if c.replicas != nil {
+		c.replicas.close()
+	}
+	return c.Connection.Close()
 }
@@ -0,0 +1,316 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gobuffalo/pop/v6/logging"
+	"github.com/trranminhquang/go-boilerplate/internal/conf"
+)
+
+// dialTest connects to the database of TEST_DATABASE_URL and skips the test
+// when it is not set. SQLite databases need the sqlite build tag, e.g.
+//
+//	TEST_DATABASE_URL=sqlite3:///tmp/test.db go test -tags sqlite ./internal/db
+func dialTest(t *testing.T) *Connection {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	conn, err := Dial(&conf.GlobalConfiguration{DB: conf.DBConfiguration{URL: url}})
+	if err != nil {
+		t.Fatalf("dialing %s: %v", url, err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn
+}
+
+// exec runs the statements and fails the test on the first error
+func exec(t *testing.T, c *Connection, stmts ...string) {
+	t.Helper()
+	for _, stmt := range stmts {
+		if err := c.RawQuery(stmt).Exec(); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+}
+
+type savepointRow struct {
+	Name string `db:"name"`
+}
+
+// savepointTable creates an empty table for the savepoint tests
+func savepointTable(t *testing.T, c *Connection) {
+	t.Helper()
+	exec(t, c,
+		"DROP TABLE IF EXISTS savepoint_tests",
+		"CREATE TABLE savepoint_tests (name text NOT NULL)",
+	)
+	t.Cleanup(func() {
+		exec(t, c, "DROP TABLE IF EXISTS savepoint_tests")
+	})
+}
+
+// insertName inserts a row into the savepoint table
+func insertName(c *Connection, name string) error {
+	return c.RawQuery("INSERT INTO savepoint_tests (name) VALUES (?)", name).Exec()
+}
+
+// names returns the names in the savepoint table, in alphabetical order
+func names(t *testing.T, c *Connection) []string {
+	t.Helper()
+
+	rows := []savepointRow{}
+	if err := c.RawQuery("SELECT name FROM savepoint_tests ORDER BY name").All(&rows); err != nil {
+		t.Fatalf("selecting names: %v", err)
+	}
+	names := []string{}
+	for _, row := range rows {
+		names = append(names, row.Name)
+	}
+	return names
+}
+
+// recordSavepoints records the savepoint statements run through pop until the
+// test ends, and returns a function listing them.
+func recordSavepoints(t *testing.T) func() []string {
+	var (
+		mu    sync.Mutex
+		stmts []string
+	)
+	pop.SetTxLogger(func(lvl logging.Level, _ interface{}, s string, _ ...interface{}) {
+		if lvl != logging.SQL {
+			return
+		}
+		if strings.HasPrefix(s, "SAVEPOINT ") || strings.HasPrefix(s, "RELEASE SAVEPOINT ") || strings.HasPrefix(s, "ROLLBACK TO SAVEPOINT ") {
+			mu.Lock()
+			stmts = append(stmts, s)
+			mu.Unlock()
+		}
+	})
+	t.Cleanup(func() {
+		pop.SetTxLogger(func(logging.Level, interface{}, string, ...interface{}) {})
+	})
+
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, stmts...)
+	}
+}
+
+func assertStrings(t *testing.T, what string, got, want []string) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s:\n got %q\nwant %q", what, got, want)
+	}
+}
+
+func TestTransactionSavepointRollback(t *testing.T) {
+	conn := dialTest(t)
+	savepointTable(t, conn)
+	savepoints := recordSavepoints(t)
+
+	errInner := errors.New("inner failed")
+	err := conn.Transaction(func(tx *Connection) error {
+		if err := insertName(tx, "outer"); err != nil {
+			return err
+		}
+		err := tx.Transaction(func(tx *Connection) error {
+			if err := insertName(tx, "inner"); err != nil {
+				return err
+			}
+			return errInner
+		})
+		if !errors.Is(err, errInner) {
+			t.Errorf("inner transaction returned %v, want %v", err, errInner)
+		}
+
+		// The transaction is still usable after rolling back the savepoint
+		return insertName(tx, "after")
+	})
+	if err != nil {
+		t.Fatalf("outer transaction: %v", err)
+	}
+
+	assertStrings(t, "rows", names(t, conn), []string{"after", "outer"})
+	assertStrings(t, "savepoints", savepoints(), []string{
+		"SAVEPOINT sp_1",
+		"ROLLBACK TO SAVEPOINT sp_1",
+		"RELEASE SAVEPOINT sp_1",
+	})
+}
+
+func TestTransactionSavepointRelease(t *testing.T) {
+	conn := dialTest(t)
+	savepointTable(t, conn)
+	savepoints := recordSavepoints(t)
+
+	err := conn.Transaction(func(tx *Connection) error {
+		if err := insertName(tx, "outer"); err != nil {
+			return err
+		}
+		if err := tx.Transaction(func(tx *Connection) error {
+			return insertName(tx, "inner")
+		}); err != nil {
+			t.Errorf("inner transaction: %v", err)
+		}
+
+		// Releasing it again fails since the savepoint no longer exists
+		if err := tx.RawQuery("RELEASE SAVEPOINT sp_1").Exec(); err == nil {
+			t.Error("savepoint sp_1 was not released")
+		}
+		return errors.New("rollback")
+	})
+	if err == nil {
+		t.Fatal("outer transaction did not fail")
+	}
+	assertStrings(t, "rows after rollback", names(t, conn), []string{})
+
+	if err := conn.Transaction(func(tx *Connection) error {
+		if err := insertName(tx, "outer"); err != nil {
+			return err
+		}
+		return tx.Transaction(func(tx *Connection) error {
+			return insertName(tx, "inner")
+		})
+	}); err != nil {
+		t.Fatalf("outer transaction: %v", err)
+	}
+	assertStrings(t, "rows", names(t, conn), []string{"inner", "outer"})
+	assertStrings(t, "savepoints", savepoints(), []string{
+		"SAVEPOINT sp_1",
+		"RELEASE SAVEPOINT sp_1",
+		"RELEASE SAVEPOINT sp_1",
+		"SAVEPOINT sp_1",
+		"RELEASE SAVEPOINT sp_1",
+	})
+}
+
+func TestTransactionSavepointCommitWithError(t *testing.T) {
+	conn := dialTest(t)
+	savepointTable(t, conn)
+	savepoints := recordSavepoints(t)
+
+	// A CommitWithError at depth 2 keeps the work of every level and is
+	// returned by the outermost transaction
+	errCommitted := errors.New("committed anyway")
+	err := conn.Transaction(func(tx *Connection) error {
+		if err := insertName(tx, "outer"); err != nil {
+			return err
+		}
+		return tx.Transaction(func(tx *Connection) error {
+			if err := insertName(tx, "middle"); err != nil {
+				return err
+			}
+			return tx.Transaction(func(tx *Connection) error {
+				if err := insertName(tx, "inner"); err != nil {
+					return err
+				}
+				return NewCommitWithError(errCommitted)
+			})
+		})
+	})
+	var cerr *CommitWithError
+	if !errors.As(err, &cerr) || cerr.Err != errCommitted {
+		t.Fatalf("outer transaction returned %v, want the CommitWithError", err)
+	}
+	assertStrings(t, "rows", names(t, conn), []string{"inner", "middle", "outer"})
+	assertStrings(t, "savepoints", savepoints(), []string{
+		"SAVEPOINT sp_1",
+		"SAVEPOINT sp_2",
+		"RELEASE SAVEPOINT sp_2",
+		"RELEASE SAVEPOINT sp_1",
+	})
+
+	// A failure of an enclosing savepoint still rolls back the work that was
+	// committed with an error inside it
+	exec(t, conn, "DELETE FROM savepoint_tests")
+	errMiddle := errors.New("middle failed")
+	err = conn.Transaction(func(tx *Connection) error {
+		if err := insertName(tx, "outer"); err != nil {
+			return err
+		}
+		err := tx.Transaction(func(tx *Connection) error {
+			err := tx.Transaction(func(tx *Connection) error {
+				if err := insertName(tx, "inner"); err != nil {
+					return err
+				}
+				return NewCommitWithError(errCommitted)
+			})
+			if !errors.As(err, &cerr) {
+				t.Errorf("inner transaction returned %v, want the CommitWithError", err)
+			}
+			return errMiddle
+		})
+		if !errors.Is(err, errMiddle) {
+			t.Errorf("middle transaction returned %v, want %v", err, errMiddle)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("outer transaction: %v", err)
+	}
+	assertStrings(t, "rows", names(t, conn), []string{"outer"})
+}
+
+func TestTransactionSavepointDepth(t *testing.T) {
+	conn := dialTest(t)
+	savepointTable(t, conn)
+	savepoints := recordSavepoints(t)
+
+	errDeep := errors.New("deep failure")
+	err := conn.Transaction(func(tx *Connection) error {
+		return tx.Transaction(func(tx *Connection) error {
+			if err := insertName(tx, "a"); err != nil {
+				return err
+			}
+			// WithContext keeps the depth of the connection
+			return tx.WithContext(context.Background()).Transaction(func(tx *Connection) error {
+				if err := insertName(tx, "b"); err != nil {
+					return err
+				}
+				if err := tx.Transaction(func(tx *Connection) error {
+					if err := insertName(tx, "c"); err != nil {
+						return err
+					}
+					return errDeep
+				}); !errors.Is(err, errDeep) {
+					t.Errorf("third level returned %v, want %v", err, errDeep)
+				}
+				// A sibling reuses the name of the savepoint that was rolled
+				// back and released
+				return tx.Transaction(func(tx *Connection) error {
+					return insertName(tx, "d")
+				})
+			})
+		})
+	})
+	if err != nil {
+		t.Fatalf("outer transaction: %v", err)
+	}
+
+	assertStrings(t, "rows", names(t, conn), []string{"a", "b", "d"})
+	assertStrings(t, "savepoints", savepoints(), []string{
+		"SAVEPOINT sp_1",
+		"SAVEPOINT sp_2",
+		"SAVEPOINT sp_3",
+		"ROLLBACK TO SAVEPOINT sp_3",
+		"RELEASE SAVEPOINT sp_3",
+		"SAVEPOINT sp_3",
+		"RELEASE SAVEPOINT sp_3",
+		"RELEASE SAVEPOINT sp_2",
+		"RELEASE SAVEPOINT sp_1",
+	})
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// JobsChannel is the channel notified with the topic of every job inserted
+// into the jobs table, see the jobs migration
+const JobsChannel = "jobs"
+
+// claimJobsQuery locks up to ? jobs of the topics that are due and not
+// locked by another consumer, or whose lock expired. Only the oldest job of
+// each key is eligible, so jobs sharing a key are handled in order even with
+// several consumers running.
+const claimJobsQuery = `UPDATE jobs SET locked_by = ?, locked_until = now() + make_interval(secs => ?), attempts = attempts + 1
+WHERE id IN (
+	SELECT j.id FROM jobs j
+	WHERE j.topic = ANY(?) AND j.run_at <= now()
+	AND (j.locked_until IS NULL OR j.locked_until < now())
+	AND (j.key = '' OR NOT EXISTS (
+		SELECT 1 FROM jobs p
+		WHERE p.topic = j.topic AND p.key = j.key AND p.id < j.id
+	))
+	ORDER BY j.run_at, j.id
+	LIMIT ?
+	FOR UPDATE SKIP LOCKED
+)
+RETURNING *`
+
+// Job is a message waiting in the jobs table to be handled.
+type Job struct {
+	ID        int64     `db:"id"`
+	MessageID string    `db:"message_id"`
+	Topic     string    `db:"topic"`
+	Key       string    `db:"key"`
+	Payload   []byte    `db:"payload"`
+	Metadata  StringMap `db:"metadata"`
+	// Attempts is the number of times the job was claimed
+	Attempts int `db:"attempts"`
+	// RunAt is when the job is due
+	RunAt time.Time `db:"run_at"`
+	// LockedBy is the consumer handling the job, which is invisible to the
+	// other consumers until LockedUntil
+	LockedBy    NullString `db:"locked_by"`
+	LockedUntil *time.Time `db:"locked_until"`
+	CreatedAt   time.Time  `db:"created_at"`
+}
+
+// TableName overrides the table name used by pop
+func (Job) TableName() string {
+	return "jobs"
+}
+
+// EnqueueJob inserts job into the jobs table. Inside a transaction the job
+// only becomes visible once the transaction commits.
+func (c *Connection) EnqueueJob(job *Job) error {
+	if job.Metadata == nil {
+		job.Metadata = StringMap{}
+	}
+	if job.RunAt.IsZero() {
+		job.RunAt = time.Now()
+	}
+	return errors.Wrap(c.Create(job), "enqueueing job")
+}
+
+// ClaimJobs locks up to limit due jobs of the topics for owner, for the
+// visibility timeout. Jobs that are not completed or released in time are
+// claimed again by any consumer.
+func (c *Connection) ClaimJobs(owner string, topics []string, limit int, visibility time.Duration) ([]Job, error) {
+	jobs := []Job{}
+	if err := c.RawQuery(claimJobsQuery, owner, visibility.Seconds(), topics, limit).All(&jobs); err != nil {
+		return nil, errors.Wrap(err, "claiming jobs")
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].RunAt.Equal(jobs[j].RunAt) {
+			return jobs[i].RunAt.Before(jobs[j].RunAt)
+		}
+		return jobs[i].ID < jobs[j].ID
+	})
+	return jobs, nil
+}
+
+// BrowseJobs returns up to limit jobs of the topics with an ID greater than
+// after, in ID order, without claiming them.
+func (c *Connection) BrowseJobs(topics []string, after int64, limit int) ([]Job, error) {
+	jobs := []Job{}
+	if err := c.RawQuery(
+		"SELECT * FROM jobs WHERE topic = ANY(?) AND id > ? ORDER BY id LIMIT ?",
+		topics, after, limit,
+	).All(&jobs); err != nil {
+		return nil, errors.Wrap(err, "browsing jobs")
+	}
+	return jobs, nil
+}
+
+// CompleteJob removes a job claimed by owner from the jobs table.
+func (c *Connection) CompleteJob(owner string, id int64) error {
+	return c.RawQuery("DELETE FROM jobs WHERE id = ? AND locked_by = ?", id, owner).Exec()
+}
+
+// RetryJob releases a job claimed by owner, to be claimed again at runAt.
+func (c *Connection) RetryJob(owner string, id int64, runAt time.Time) error {
+	return c.RawQuery(
+		"UPDATE jobs SET locked_by = NULL, locked_until = NULL, run_at = ? WHERE id = ? AND locked_by = ?",
+		runAt, id, owner,
+	).Exec()
+}
+
+// ExtendJobs extends the visibility timeout of the jobs claimed by owner.
+func (c *Connection) ExtendJobs(owner string, ids []int64, visibility time.Duration) error {
+	return c.RawQuery(
+		"UPDATE jobs SET locked_until = now() + make_interval(secs => ?) WHERE locked_by = ? AND id = ANY(?)",
+		visibility.Seconds(), owner, ids,
+	).Exec()
+}
+
+// ReleaseJobs releases every job claimed by owner, so other consumers can
+// claim them right away.
+func (c *Connection) ReleaseJobs(owner string) error {
+	return c.RawQuery(
+		"UPDATE jobs SET locked_by = NULL, locked_until = NULL WHERE locked_by = ?",
+		owner,
+	).Exec()
+}
@@ -0,0 +1,284 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+const jobsTopic = "jobs-test"
+
+// jobsTable creates the jobs table with its migration, and skips the test
+// unless the database is PostgreSQL, which the claim queries need
+func jobsTable(t *testing.T, c *Connection) {
+	t.Helper()
+
+	if c.Dialect.Name() != "postgres" {
+		t.Skipf("the jobs table needs PostgreSQL, not %s", c.Dialect.Name())
+	}
+
+	migration := func(name string) string {
+		b, err := os.ReadFile("../../migrations/20261018000001_create_jobs." + name + ".sql")
+		if err != nil {
+			t.Fatalf("reading the jobs migration: %v", err)
+		}
+		return string(b)
+	}
+	exec(t, c, migration("down"), migration("up"))
+	t.Cleanup(func() {
+		exec(t, c, migration("down"))
+	})
+}
+
+// enqueue inserts a job of the test topic with the specified key, due at
+// runAt or right away when it is zero
+func enqueue(t *testing.T, c *Connection, messageID, key string, runAt time.Time) *Job {
+	t.Helper()
+
+	job := &Job{MessageID: messageID, Topic: jobsTopic, Key: key, Payload: []byte(messageID), RunAt: runAt}
+	if err := c.EnqueueJob(job); err != nil {
+		t.Fatalf("EnqueueJob(%s): %v", messageID, err)
+	}
+	return job
+}
+
+// claim claims up to limit jobs of the test topic for owner, and returns
+// their message IDs in claim order
+func claim(t *testing.T, c *Connection, owner string, limit int, visibility time.Duration) []string {
+	t.Helper()
+
+	jobs, err := c.ClaimJobs(owner, []string{jobsTopic}, limit, visibility)
+	if err != nil {
+		t.Fatalf("ClaimJobs(%s): %v", owner, err)
+	}
+	ids := []string{}
+	for _, job := range jobs {
+		if job.LockedBy.String() != owner {
+			t.Errorf("job %s is locked by %v, want %s", job.MessageID, job.LockedBy, owner)
+		}
+		ids = append(ids, job.MessageID)
+	}
+	return ids
+}
+
+// attempts returns the number of times the job was claimed
+func attempts(t *testing.T, c *Connection, id int64) int {
+	t.Helper()
+
+	job := &Job{}
+	if err := c.Find(job, id); err != nil {
+		t.Fatalf("finding job %d: %v", id, err)
+	}
+	return job.Attempts
+}
+
+func TestClaimJobs(t *testing.T) {
+	conn := dialTest(t)
+	jobsTable(t, conn)
+
+	first := enqueue(t, conn, "a", "", time.Time{})
+	enqueue(t, conn, "b", "", time.Time{})
+	enqueue(t, conn, "c", "", time.Time{})
+	other := &Job{MessageID: "other", Topic: "other-topic", Payload: []byte("other")}
+	if err := conn.EnqueueJob(other); err != nil {
+		t.Fatalf("EnqueueJob: %v", err)
+	}
+
+	// Jobs are claimed in order, up to the limit, and only by one owner
+	assertStrings(t, "claimed by c1", claim(t, conn, "c1", 2, time.Minute), []string{"a", "b"})
+	assertStrings(t, "claimed by c2", claim(t, conn, "c2", 10, time.Minute), []string{"c"})
+	assertStrings(t, "claimed by c3", claim(t, conn, "c3", 10, time.Minute), []string{})
+	if n := attempts(t, conn, first.ID); n != 1 {
+		t.Errorf("job a was claimed %d times, want 1", n)
+	}
+
+	// Only the owner completes a job
+	if err := conn.CompleteJob("c2", first.ID); err != nil {
+		t.Fatalf("CompleteJob: %v", err)
+	}
+	if n := attempts(t, conn, first.ID); n != 1 {
+		t.Errorf("job a was claimed %d times after another owner completed it, want 1", n)
+	}
+	if err := conn.CompleteJob("c1", first.ID); err != nil {
+		t.Fatalf("CompleteJob: %v", err)
+	}
+	if err := conn.Find(&Job{}, first.ID); err == nil {
+		t.Error("job a was not removed once completed")
+	}
+
+	// Released jobs are claimed again right away
+	if err := conn.ReleaseJobs("c1"); err != nil {
+		t.Fatalf("ReleaseJobs: %v", err)
+	}
+	assertStrings(t, "claimed after release", claim(t, conn, "c3", 10, time.Minute), []string{"b"})
+}
+
+func TestClaimJobsVisibilityTimeout(t *testing.T) {
+	conn := dialTest(t)
+	jobsTable(t, conn)
+
+	a := enqueue(t, conn, "a", "", time.Time{})
+	b := enqueue(t, conn, "b", "", time.Time{})
+
+	assertStrings(t, "claimed by c1", claim(t, conn, "c1", 10, time.Second), []string{"a", "b"})
+
+	// The lock of b is extended, the one of a expires and a is claimed by
+	// another consumer, which the stale owner can no longer complete
+	if err := conn.ExtendJobs("c1", []int64{b.ID}, time.Minute); err != nil {
+		t.Fatalf("ExtendJobs: %v", err)
+	}
+	assertStrings(t, "claimed before the timeout", claim(t, conn, "c2", 10, time.Minute), []string{})
+	time.Sleep(1200 * time.Millisecond)
+	assertStrings(t, "claimed after the timeout", claim(t, conn, "c2", 10, time.Minute), []string{"a"})
+	if n := attempts(t, conn, a.ID); n != 2 {
+		t.Errorf("job a was claimed %d times, want 2", n)
+	}
+
+	if err := conn.CompleteJob("c1", a.ID); err != nil {
+		t.Fatalf("CompleteJob: %v", err)
+	}
+	if err := conn.Find(&Job{}, a.ID); err != nil {
+		t.Errorf("job a was completed by its stale owner: %v", err)
+	}
+}
+
+func TestClaimJobsRunAt(t *testing.T) {
+	conn := dialTest(t)
+	jobsTable(t, conn)
+
+	enqueue(t, conn, "later", "", time.Now().Add(time.Second))
+	enqueue(t, conn, "now", "", time.Time{})
+	enqueue(t, conn, "past", "", time.Now().Add(-time.Minute))
+
+	// Due jobs are claimed by run_at, the others once they are due
+	assertStrings(t, "claimed", claim(t, conn, "c1", 10, time.Minute), []string{"past", "now"})
+	time.Sleep(1200 * time.Millisecond)
+	assertStrings(t, "claimed once due", claim(t, conn, "c1", 10, time.Minute), []string{"later"})
+}
+
+func TestRetryJob(t *testing.T) {
+	conn := dialTest(t)
+	jobsTable(t, conn)
+
+	job := enqueue(t, conn, "a", "", time.Time{})
+	assertStrings(t, "claimed", claim(t, conn, "c1", 10, time.Minute), []string{"a"})
+
+	// Only the owner releases the job, which is claimed again once the
+	// backoff elapsed
+	if err := conn.RetryJob("c2", job.ID, time.Now()); err != nil {
+		t.Fatalf("RetryJob: %v", err)
+	}
+	assertStrings(t, "claimed after another owner retried it", claim(t, conn, "c2", 10, time.Minute), []string{})
+
+	if err := conn.RetryJob("c1", job.ID, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("RetryJob: %v", err)
+	}
+	assertStrings(t, "claimed during the backoff", claim(t, conn, "c2", 10, time.Minute), []string{})
+	time.Sleep(1200 * time.Millisecond)
+	assertStrings(t, "claimed after the backoff", claim(t, conn, "c2", 10, time.Minute), []string{"a"})
+	if n := attempts(t, conn, job.ID); n != 2 {
+		t.Errorf("job a was claimed %d times, want 2", n)
+	}
+}
+
+func TestClaimJobsKeyOrder(t *testing.T) {
+	conn := dialTest(t)
+	jobsTable(t, conn)
+
+	a1 := enqueue(t, conn, "a1", "a", time.Time{})
+	enqueue(t, conn, "a2", "a", time.Time{})
+	b1 := enqueue(t, conn, "b1", "b", time.Time{})
+	enqueue(t, conn, "n1", "", time.Time{})
+	enqueue(t, conn, "n2", "", time.Time{})
+
+	// Only the oldest job of a key is claimed, while jobs without a key are
+	// claimed regardless of each other
+	assertStrings(t, "claimed", claim(t, conn, "c1", 10, time.Minute), []string{"a1", "b1", "n1", "n2"})
+	assertStrings(t, "claimed while a1 is in flight", claim(t, conn, "c2", 10, time.Minute), []string{})
+
+	// Retrying a1 keeps a2 behind it, even once a2 is due before it
+	if err := conn.RetryJob("c1", a1.ID, time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("RetryJob: %v", err)
+	}
+	assertStrings(t, "claimed while a1 is retried", claim(t, conn, "c2", 10, time.Minute), []string{})
+
+	if err := conn.CompleteJob("c1", b1.ID); err != nil {
+		t.Fatalf("CompleteJob: %v", err)
+	}
+	if err := conn.RawQuery("DELETE FROM jobs WHERE id = ?", a1.ID).Exec(); err != nil {
+		t.Fatalf("deleting a1: %v", err)
+	}
+	assertStrings(t, "claimed once a1 is done", claim(t, conn, "c2", 10, time.Minute), []string{"a2"})
+}
+
+func TestClaimJobsSkipLocked(t *testing.T) {
+	conn := dialTest(t)
+	jobsTable(t, conn)
+
+	a := enqueue(t, conn, "a", "", time.Time{})
+	enqueue(t, conn, "b", "", time.Time{})
+
+	// A job locked by a concurrent transaction is skipped rather than waited
+	// for
+	err := conn.Transaction(func(tx *Connection) error {
+		if err := tx.RawQuery("SELECT id FROM jobs WHERE id = ? FOR UPDATE", a.ID).Exec(); err != nil {
+			return err
+		}
+		assertStrings(t, "claimed while a is locked", claim(t, conn, "c1", 10, time.Minute), []string{"b"})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("locking transaction: %v", err)
+	}
+	assertStrings(t, "claimed once a is unlocked", claim(t, conn, "c1", 10, time.Minute), []string{"a"})
+}
+
+func TestClaimJobsConcurrently(t *testing.T) {
+	conn := dialTest(t)
+	jobsTable(t, conn)
+
+	const jobs = 50
+	for i := 0; i < jobs; i++ {
+		enqueue(t, conn, fmt.Sprintf("job-%02d", i), "", time.Time{})
+	}
+
+	// Consumers claiming at the same time never get the same job
+	var (
+		mu      sync.Mutex
+		claimed []string
+		wg      sync.WaitGroup
+	)
+	for c := 0; c < 5; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			owner := fmt.Sprintf("c%d", c)
+			for {
+				batch, err := conn.ClaimJobs(owner, []string{jobsTopic}, 3, time.Minute)
+				if err != nil {
+					t.Errorf("ClaimJobs(%s): %v", owner, err)
+					return
+				}
+				if len(batch) == 0 {
+					return
+				}
+				mu.Lock()
+				for _, job := range batch {
+					claimed = append(claimed, job.MessageID)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	sort.Strings(claimed)
+	want := []string{}
+	for i := 0; i < jobs; i++ {
+		want = append(want, fmt.Sprintf("job-%02d", i))
+	}
+	assertStrings(t, "claimed jobs", claimed, want)
+}
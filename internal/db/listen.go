@@ -0,0 +1,34 @@
+package db
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/pkg/errors"
+)
+
+// Listen passes the payload of the notifications sent to channel with NOTIFY
+// to fn, until ctx is done. It holds a dedicated connection to the primary
+// database, outside of the connection pool.
+func (c *Connection) Listen(ctx context.Context, channel string, fn func(payload string)) error {
+	conn, err := pgx.Connect(ctx, c.URL())
+	if err != nil {
+		return errors.Wrap(err, "connecting listener")
+	}
+	defer conn.Close(context.Background())
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+		return errors.Wrapf(err, "listening to %s", channel)
+	}
+
+	for {
+		notification, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "waiting for notification")
+		}
+		fn(notification.Payload)
+	}
+}
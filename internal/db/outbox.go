@@ -0,0 +1,160 @@
+package db
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/trranminhquang/go-boilerplate/pkg/messaging"
+)
+
+// Outbox message statuses.
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+	OutboxFailed  = "failed"
+)
+
+// ErrNoTransaction is returned by operations that must run inside a
+// transaction when called on a connection without one.
+var ErrNoTransaction = errors.New("db: operation requires a transaction")
+
+// claimOutboxQuery selects up to ? publishable messages and locks them. Only
+// the oldest pending message of each aggregate key is eligible, so messages
+// sharing a key are published in order even with several relays running.
+const claimOutboxQuery = `SELECT * FROM outbox o
+WHERE o.status = 'pending' AND o.available_at <= now()
+AND (o.aggregate_key = '' OR NOT EXISTS (
+	SELECT 1 FROM outbox p
+	WHERE p.status = 'pending' AND p.aggregate_key = o.aggregate_key AND p.id < o.id
+))
+ORDER BY o.id
+LIMIT ?
+FOR UPDATE SKIP LOCKED`
+
+// StringMap is a map[string]string stored as a JSON object.
+type StringMap map[string]string
+
+func (m StringMap) Value() (driver.Value, error) {
+	if m == nil {
+		return "{}", nil
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (m *StringMap) Scan(src interface{}) error {
+	var source []byte
+	switch v := src.(type) {
+	case string:
+		source = []byte(v)
+	case []byte:
+		source = v
+	case nil:
+		*m = StringMap{}
+		return nil
+	default:
+		return errors.New("invalid data type for StringMap")
+	}
+	return json.Unmarshal(source, m)
+}
+
+// OutboxMessage is a message waiting in the outbox to be published.
+type OutboxMessage struct {
+	ID           int64      `db:"id"`
+	MessageID    string     `db:"message_id"`
+	Topic        string     `db:"topic"`
+	AggregateKey string     `db:"aggregate_key"`
+	Payload      []byte     `db:"payload"`
+	Metadata     StringMap  `db:"metadata"`
+	Status       string     `db:"status"`
+	Attempts     int        `db:"attempts"`
+	LastError    NullString `db:"last_error"`
+	AvailableAt  time.Time  `db:"available_at"`
+	CreatedAt    time.Time  `db:"created_at"`
+	SentAt       *time.Time `db:"sent_at"`
+}
+
+// TableName overrides the table name used by pop
+func (OutboxMessage) TableName() string {
+	return "outbox"
+}
+
+// Message converts the outbox row back into the message that was enqueued.
+func (m *OutboxMessage) Message() *messaging.Message {
+	return &messaging.Message{
+		ID:       m.MessageID,
+		Payload:  m.Payload,
+		Metadata: m.Metadata,
+		Source:   m.Topic,
+	}
+}
+
+// Enqueue stores msg in the outbox so that it is published to topic if and
+// only if the surrounding transaction commits. Messages with the same
+// non-empty key are published in the order they were enqueued.
+func (c *Connection) Enqueue(topic, key string, msg *messaging.Message) error {
+	if c.TX == nil {
+		return ErrNoTransaction
+	}
+
+	metadata := StringMap{messaging.MetadataMessageID: msg.ID}
+	for k, v := range msg.Metadata {
+		metadata[k] = v
+	}
+	if key != "" {
+		metadata[messaging.MetadataKey] = key
+	}
+
+	return errors.Wrap(c.Create(&OutboxMessage{
+		MessageID:    msg.ID,
+		Topic:        topic,
+		AggregateKey: key,
+		Payload:      msg.Payload,
+		Metadata:     metadata,
+		Status:       OutboxPending,
+		AvailableAt:  time.Now(),
+	}), "enqueueing outbox message")
+}
+
+// ClaimOutbox locks up to limit messages that are ready to be published. The
+// locks are held until the transaction ends, and rows locked by other
+// transactions are skipped.
+func (c *Connection) ClaimOutbox(limit int) ([]OutboxMessage, error) {
+	if c.TX == nil {
+		return nil, ErrNoTransaction
+	}
+
+	messages := []OutboxMessage{}
+	if err := c.RawQuery(claimOutboxQuery, limit).All(&messages); err != nil {
+		return nil, errors.Wrap(err, "claiming outbox messages")
+	}
+	return messages, nil
+}
+
+// MarkOutboxSent records that the message was published.
+func (c *Connection) MarkOutboxSent(m *OutboxMessage) error {
+	return c.RawQuery(
+		"UPDATE outbox SET status = ?, sent_at = now(), attempts = attempts + 1 WHERE id = ?",
+		OutboxSent, m.ID,
+	).Exec()
+}
+
+// MarkOutboxFailed records a failed publish attempt. The message is retried
+// at retryAt, or marked as failed for good when retryAt is nil.
+func (c *Connection) MarkOutboxFailed(m *OutboxMessage, cause error, retryAt *time.Time) error {
+	if retryAt == nil {
+		return c.RawQuery(
+			"UPDATE outbox SET status = ?, last_error = ?, attempts = attempts + 1 WHERE id = ?",
+			OutboxFailed, cause.Error(), m.ID,
+		).Exec()
+	}
+	return c.RawQuery(
+		"UPDATE outbox SET last_error = ?, attempts = attempts + 1, available_at = ? WHERE id = ?",
+		cause.Error(), *retryAt, m.ID,
+	).Exec()
+}
@@ -0,0 +1,209 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/trranminhquang/go-boilerplate/internal/conf"
+)
+
+// postgresLagQuery reports how far a standby is behind its primary. A standby
+// that has replayed everything it received is considered caught up even if
+// the primary has been idle for a while.
+const postgresLagQuery = `SELECT CASE
+	WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+END`
+
+type replica struct {
+	index   int
+	conn    *pop.Connection
+	healthy atomic.Bool
+}
+
+// lag returns the replication lag of the replica. Dialects without a way to
+// measure lag are only pinged and always report zero.
+func (r *replica) lag(ctx context.Context) (time.Duration, error) {
+	if r.conn.Dialect.Name() != "postgres" {
+		var one int
+		return 0, r.conn.Store.GetContext(ctx, &one, "SELECT 1")
+	}
+
+	var seconds float64
+	if err := r.conn.Store.GetContext(ctx, &seconds, postgresLagQuery); err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// replicaSet load balances reads across replicas in round-robin order,
+// skipping replicas that failed their last health check.
+type replicaSet struct {
+	replicas []*replica
+	next     atomic.Uint64
+	maxLag   time.Duration
+	period   time.Duration
+	logger   *logrus.Entry
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func dialReplicas(config *conf.DBConfiguration, driver string, options map[string]string) (*replicaSet, error) {
+	s := &replicaSet{
+		maxLag: config.ReplicaMaxLag,
+		period: config.ReplicaCheckPeriod,
+		logger: logrus.WithField("component", "db-replicas"),
+	}
+	if s.period <= 0 {
+		s.period = 5 * time.Second
+	}
+
+	for i, dsn := range config.ReplicaURLs {
+		conn, err := openConnection(config, driver, dsn, options)
+		if err != nil {
+			s.closeConnections()
+			return nil, errors.Wrapf(err, "replica %d", i)
+		}
+		r := &replica{index: i, conn: conn}
+		r.healthy.Store(true)
+		s.replicas = append(s.replicas, r)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.run(ctx)
+	}()
+
+	return s, nil
+}
+
+// run periodically checks every replica until ctx is canceled.
+func (s *replicaSet) run(ctx context.Context) {
+	ticker := time.NewTicker(s.period)
+	defer ticker.Stop()
+
+	for {
+		for _, r := range s.replicas {
+			s.check(ctx, r)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *replicaSet) check(ctx context.Context, r *replica) {
+	checkCtx, cancel := context.WithTimeout(ctx, s.period)
+	defer cancel()
+
+	lag, err := r.lag(checkCtx)
+	if ctx.Err() != nil {
+		return
+	}
+
+	healthy := err == nil && (s.maxLag <= 0 || lag <= s.maxLag)
+	if r.healthy.Swap(healthy) == healthy {
+		return
+	}
+
+	logger := s.logger.WithFields(logrus.Fields{
+		"replica": r.index,
+		"lag":     lag.String(),
+	})
+	if healthy {
+		logger.Info("Replica restored to read rotation")
+	} else {
+		logger.WithError(err).Warn("Replica ejected from read rotation")
+	}
+}
+
+// pick returns the next healthy replica or nil when none is available.
+func (s *replicaSet) pick() *pop.Connection {
+	n := uint64(len(s.replicas))
+	start := s.next.Add(1)
+	for i := uint64(0); i < n; i++ {
+		r := s.replicas[(start+i)%n]
+		if r.healthy.Load() {
+			return r.conn
+		}
+	}
+	return nil
+}
+
+func (s *replicaSet) close() {
+	s.cancel()
+	s.wg.Wait()
+	s.closeConnections()
+}
+
+func (s *replicaSet) closeConnections() {
+	for _, r := range s.replicas {
+		if err := r.conn.Close(); err != nil {
+			s.logger.WithError(err).WithField("replica", r.index).Warn("Failed to close replica")
+		}
+	}
+}
+
+// Primary returns a connection whose reads always go to the primary. Use it
+// when a read must observe writes that replicas may not have replayed yet.
+func (c *Connection) Primary() *Connection {
+	return &Connection{Connection: c.Connection, savepoints: c.savepoints}
+}
+
+// Replica returns a connection to a healthy read replica. Inside a
+// transaction, or when no replica is configured or healthy, it returns c.
+//
+// Only Find, First, Last, All and Count are routed automatically. Query
+// builders such as Where, Q and RawQuery stay on the primary since the
+// resulting query may write, e.g. Where(...).UpdateQuery or
+// RawQuery("UPDATE ...").Exec(). Use c.Replica().Where(...).All(...) or
+// c.Replica().RawQuery(...) for reads that can tolerate replication lag.
+func (c *Connection) Replica() *Connection {
+	if c.TX != nil || c.replicas == nil {
+		return c
+	}
+
+	conn := c.replicas.pick()
+	if conn == nil {
+		return c
+	}
+	return &Connection{Connection: conn.WithContext(c.Context())}
+}
+
+// Find is routed to a replica when used outside of a transaction.
+func (c *Connection) Find(model interface{}, id interface{}) error {
+	return c.Replica().Connection.Find(model, id)
+}
+
+// First is routed to a replica when used outside of a transaction.
+func (c *Connection) First(model interface{}) error {
+	return c.Replica().Connection.First(model)
+}
+
+// Last is routed to a replica when used outside of a transaction.
+func (c *Connection) Last(model interface{}) error {
+	return c.Replica().Connection.Last(model)
+}
+
+// All is routed to a replica when used outside of a transaction.
+func (c *Connection) All(models interface{}) error {
+	return c.Replica().Connection.All(models)
+}
+
+// Count is routed to a replica when used outside of a transaction.
+func (c *Connection) Count(model interface{}) (int, error) {
+	return c.Replica().Connection.Count(model)
+}
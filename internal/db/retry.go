@@ -0,0 +1,144 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"math/rand/v2"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Postgres error codes that indicate a transaction can safely be retried.
+const (
+	sqlStateSerializationFailure = "40001"
+	sqlStateDeadlockDetected     = "40P01"
+)
+
+// RetryOptions configures RetryTransaction.
+type RetryOptions struct {
+	// Isolation is the isolation level every attempt is started with.
+	Isolation sql.IsolationLevel
+
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int
+
+	// BaseDelay and MaxDelay bound the jittered exponential backoff between
+	// attempts.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// MinTimeLeft is the minimum time that must remain before the context
+	// deadline, after backing off, for another attempt to be made.
+	MinTimeLeft time.Duration
+}
+
+// DefaultRetryOptions returns options suited for short serializable
+// transactions.
+func DefaultRetryOptions() RetryOptions {
+	return RetryOptions{
+		Isolation:   sql.LevelSerializable,
+		MaxAttempts: 5,
+		BaseDelay:   10 * time.Millisecond,
+		MaxDelay:    time.Second,
+		MinTimeLeft: 100 * time.Millisecond,
+	}
+}
+
+// IsRetryable reports whether err is a serialization failure or a deadlock,
+// both of which are safe to retry from the start of the transaction.
+func IsRetryable(err error) bool {
+	var state interface{ SQLState() string }
+	if !errors.As(err, &state) {
+		return false
+	}
+	switch state.SQLState() {
+	case sqlStateSerializationFailure, sqlStateDeadlockDetected:
+		return true
+	}
+	return false
+}
+
+// RetryTransaction runs fn in a transaction at the configured isolation level
+// and retries it when it fails with a retryable error. fn must be safe to run
+// more than once. Returning a *CommitWithError commits the transaction and
+// returns the error, just like Transaction.
+//
+// When called on a connection that already has a transaction, fn is run in a
+// savepoint without retrying since only the outermost transaction can be
+// restarted.
+func (c *Connection) RetryTransaction(opts RetryOptions, fn func(*Connection) error) error {
+	if c.TX != nil {
+		return c.Transaction(fn)
+	}
+
+	ctx := c.Context()
+	txOpts := &sql.TxOptions{Isolation: opts.Isolation}
+
+	for attempt := 1; ; attempt++ {
+		err := c.transactionWithOptions(ctx, txOpts, fn)
+		if err == nil || !IsRetryable(err) || attempt >= opts.MaxAttempts {
+			return err
+		}
+
+		delay := opts.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay+opts.MinTimeLeft {
+			return err
+		}
+
+		logrus.WithError(err).WithField("attempt", attempt).Debug("Retrying transaction")
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// backoff returns a random delay in [0, min(MaxDelay, BaseDelay*2^(attempt-1))].
+func (o RetryOptions) backoff(attempt int) time.Duration {
+	if o.BaseDelay <= 0 {
+		return 0
+	}
+
+	delay := o.BaseDelay << (attempt - 1)
+	if delay <= 0 || (o.MaxDelay > 0 && delay > o.MaxDelay) {
+		delay = o.MaxDelay
+	}
+	return time.Duration(rand.Int64N(int64(delay) + 1)) // #nosec G404
+}
+
+// transactionWithOptions runs fn in a new transaction started with txOpts.
+// Commit errors are returned as-is so that serialization failures detected at
+// commit time can be retried.
+func (c *Connection) transactionWithOptions(ctx context.Context, txOpts *sql.TxOptions, fn func(*Connection) error) error {
+	tx, err := c.Connection.NewTransactionContextOptions(ctx, txOpts)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if rvr := recover(); rvr != nil {
+			_ = tx.TX.Rollback()
+			panic(rvr)
+		}
+	}()
+
+	var returnErr error
+	if err := fn(&Connection{Connection: tx}); err != nil {
+		if _, ok := err.(*CommitWithError); !ok {
+			if rerr := tx.TX.Rollback(); rerr != nil && !errors.Is(rerr, sql.ErrTxDone) {
+				logrus.WithError(rerr).Warn("Failed to roll back transaction")
+			}
+			return err
+		}
+		returnErr = err
+	}
+
+	if err := tx.TX.Commit(); err != nil {
+		return err
+	}
+	return returnErr
+}
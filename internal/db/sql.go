@@ -1,5 +1,16 @@
 package db
 
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gobuffalo/validate/v3"
+	"github.com/pkg/errors"
+)
+
 func (conn *Connection) UpdateOnly(model interface{}, includeColumns ...string) error {
 	xcols, err := getExcludedColumns(model, includeColumns...)
 	if err != nil {
@@ -7,3 +18,160 @@ func (conn *Connection) UpdateOnly(model interface{}, includeColumns ...string)
 	}
 	return conn.Update(model, xcols...)
 }
+
+// Versioned is implemented by models with a "version" column used for
+// optimistic concurrency control.
+type Versioned interface {
+	GetVersion() int64
+	SetVersion(int64)
+}
+
+// ConflictError is returned when a conditional update finds that the row was
+// modified since the model was read.
+type ConflictError struct {
+	Table string
+	ID    interface{}
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s %v was modified concurrently", e.Table, e.ID)
+}
+
+// UpdateOnlyIfUnchanged works like UpdateOnly but only writes the row if it
+// still matches the version held by model. Models implementing Versioned are
+// matched on their version column, which is incremented. Other models are
+// matched on their UpdatedAt field. A *ConflictError is returned when the
+// row was modified in the meantime, and sql.ErrNoRows when it is gone.
+//
+// Like ValidateAndUpdate, the model is validated and its save and update
+// callbacks are run, in the same transaction as the update. Validation
+// errors are returned as *validate.Errors.
+func (conn *Connection) UpdateOnlyIfUnchanged(model interface{}, includeColumns ...string) error {
+	// validate the column names the same way UpdateOnly does
+	if _, err := getExcludedColumns(model, includeColumns...); err != nil {
+		return err
+	}
+
+	sm := &pop.Model{Value: model}
+	cols := append([]string{}, includeColumns...)
+
+	var (
+		where   = sm.WhereID()
+		args    = []interface{}{sm.ID()}
+		restore func()
+	)
+	if v, ok := model.(Versioned); ok {
+		version := v.GetVersion()
+		where += " AND version = ?"
+		args = append(args, version)
+		cols = append(cols, "version")
+		v.SetVersion(version + 1)
+		restore = func() { v.SetVersion(version) }
+	} else {
+		field, err := updatedAtField(model)
+		if err != nil {
+			return err
+		}
+		updatedAt := field.Interface().(time.Time)
+		where += " AND updated_at = ?"
+		args = append(args, updatedAt)
+		restore = func() { field.Set(reflect.ValueOf(updatedAt)) }
+	}
+
+	err := conn.Transaction(func(tx *Connection) error {
+		if err := validateUpdate(tx, model); err != nil {
+			return err
+		}
+		if x, ok := model.(pop.BeforeSaveable); ok {
+			if err := x.BeforeSave(tx.Connection); err != nil {
+				return err
+			}
+		}
+		if x, ok := model.(pop.BeforeUpdateable); ok {
+			if err := x.BeforeUpdate(tx.Connection); err != nil {
+				return err
+			}
+		}
+
+		n, err := tx.Where(where, args...).UpdateQuery(model, cols...)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			exists, err := tx.Where(sm.WhereID(), sm.ID()).Exists(model)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return errors.Wrapf(sql.ErrNoRows, "%s %v", sm.TableName(), sm.ID())
+			}
+			return &ConflictError{Table: sm.TableName(), ID: sm.ID()}
+		}
+
+		if x, ok := model.(pop.AfterUpdateable); ok {
+			if err := x.AfterUpdate(tx.Connection); err != nil {
+				return err
+			}
+		}
+		if x, ok := model.(pop.AfterSaveable); ok {
+			return x.AfterSave(tx.Connection)
+		}
+		return nil
+	})
+	if err != nil {
+		restore()
+	}
+	return err
+}
+
+// validateUpdate runs the validations of ValidateAndUpdate on model
+func validateUpdate(conn *Connection, model interface{}) error {
+	if x, ok := model.(pop.BeforeValidateable); ok {
+		if err := x.BeforeValidate(conn.Connection); err != nil {
+			return err
+		}
+	}
+
+	verrs := validate.NewErrors()
+	if x, ok := model.(interface {
+		BeforeValidations(*pop.Connection) error
+	}); ok {
+		if err := x.BeforeValidations(conn.Connection); err != nil {
+			return err
+		}
+	}
+	if x, ok := model.(interface {
+		Validate(*pop.Connection) (*validate.Errors, error)
+	}); ok {
+		vs, err := x.Validate(conn.Connection)
+		if err != nil {
+			return err
+		}
+		verrs.Append(vs)
+	}
+	if x, ok := model.(interface {
+		ValidateUpdate(*pop.Connection) (*validate.Errors, error)
+	}); ok {
+		vs, err := x.ValidateUpdate(conn.Connection)
+		if err != nil {
+			return err
+		}
+		verrs.Append(vs)
+	}
+
+	if verrs.HasAny() {
+		return verrs
+	}
+	return nil
+}
+
+func updatedAtField(model interface{}) (reflect.Value, error) {
+	v := reflect.Indirect(reflect.ValueOf(model))
+	if v.Kind() == reflect.Struct {
+		field := v.FieldByName("UpdatedAt")
+		if field.IsValid() && field.Type() == reflect.TypeOf(time.Time{}) {
+			return field, nil
+		}
+	}
+	return reflect.Value{}, errors.Errorf("model %T is neither Versioned nor has an UpdatedAt field", model)
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gobuffalo/validate/v3"
+	"github.com/gofrs/uuid"
+)
+
+var errAfterUpdate = errors.New("after update failed")
+
+// versionedRow is a Versioned model recording the callbacks run on it
+type versionedRow struct {
+	ID      uuid.UUID `db:"id"`
+	Name    string    `db:"name"`
+	Version int64     `db:"version"`
+
+	calls     []string `db:"-"`
+	failAfter bool     `db:"-"`
+}
+
+func (versionedRow) TableName() string {
+	return "versioned_tests"
+}
+
+func (r *versionedRow) GetVersion() int64 {
+	return r.Version
+}
+
+func (r *versionedRow) SetVersion(version int64) {
+	r.Version = version
+}
+
+func (r *versionedRow) Validate(*pop.Connection) (*validate.Errors, error) {
+	r.calls = append(r.calls, "Validate")
+	verrs := validate.NewErrors()
+	if r.Name == "" {
+		verrs.Add("name", "name must not be blank")
+	}
+	return verrs, nil
+}
+
+func (r *versionedRow) BeforeSave(*pop.Connection) error {
+	r.calls = append(r.calls, "BeforeSave")
+	return nil
+}
+
+func (r *versionedRow) BeforeUpdate(*pop.Connection) error {
+	r.calls = append(r.calls, "BeforeUpdate")
+	return nil
+}
+
+func (r *versionedRow) AfterUpdate(*pop.Connection) error {
+	r.calls = append(r.calls, "AfterUpdate")
+	if r.failAfter {
+		return errAfterUpdate
+	}
+	return nil
+}
+
+func (r *versionedRow) AfterSave(*pop.Connection) error {
+	r.calls = append(r.calls, "AfterSave")
+	return nil
+}
+
+// versionedTable creates the table of versionedRow with a row named name
+func versionedTable(t *testing.T, c *Connection, name string) *versionedRow {
+	t.Helper()
+	exec(t, c,
+		"DROP TABLE IF EXISTS versioned_tests",
+		"CREATE TABLE versioned_tests (id varchar(36) PRIMARY KEY, name text NOT NULL, version bigint NOT NULL)",
+	)
+	t.Cleanup(func() {
+		exec(t, c, "DROP TABLE IF EXISTS versioned_tests")
+	})
+
+	row := &versionedRow{Name: name}
+	if err := c.Create(row); err != nil {
+		t.Fatalf("creating row: %v", err)
+	}
+	row.calls = nil
+	return row
+}
+
+// stored returns the row as stored in the database
+func stored(t *testing.T, c *Connection, id uuid.UUID) *versionedRow {
+	t.Helper()
+
+	row := &versionedRow{}
+	if err := c.Find(row, id); err != nil {
+		t.Fatalf("finding row: %v", err)
+	}
+	return row
+}
+
+func TestUpdateOnlyIfUnchangedCallbacks(t *testing.T) {
+	conn := dialTest(t)
+	row := versionedTable(t, conn, "before")
+	stale := *row
+
+	row.Name = "after"
+	if err := conn.UpdateOnlyIfUnchanged(row, "name"); err != nil {
+		t.Fatalf("UpdateOnlyIfUnchanged: %v", err)
+	}
+	assertStrings(t, "callbacks", row.calls, []string{"Validate", "BeforeSave", "BeforeUpdate", "AfterUpdate", "AfterSave"})
+	if got := stored(t, conn, row.ID); got.Name != "after" || got.Version != 1 {
+		t.Errorf("stored %q at version %d, want after at version 1", got.Name, got.Version)
+	}
+
+	// A stale copy runs the callbacks preceding the update, which is
+	// refused
+	stale.Name = "stale"
+	var conflict *ConflictError
+	if err := conn.UpdateOnlyIfUnchanged(&stale, "name"); !errors.As(err, &conflict) {
+		t.Fatalf("UpdateOnlyIfUnchanged returned %v, want a *ConflictError", err)
+	}
+	assertStrings(t, "callbacks of the stale copy", stale.calls, []string{"Validate", "BeforeSave", "BeforeUpdate"})
+	if stale.Version != 0 {
+		t.Errorf("stale copy is at version %d, want 0", stale.Version)
+	}
+}
+
+func TestUpdateOnlyIfUnchangedValidation(t *testing.T) {
+	conn := dialTest(t)
+	row := versionedTable(t, conn, "before")
+
+	row.Name = ""
+	err := conn.UpdateOnlyIfUnchanged(row, "name")
+	var verrs *validate.Errors
+	if !errors.As(err, &verrs) || verrs.Get("name") == nil {
+		t.Fatalf("UpdateOnlyIfUnchanged returned %v, want a validation error of name", err)
+	}
+	assertStrings(t, "callbacks", row.calls, []string{"Validate"})
+	if got := stored(t, conn, row.ID); got.Name != "before" || got.Version != 0 {
+		t.Errorf("stored %q at version %d, want before at version 0", got.Name, got.Version)
+	}
+	if row.Version != 0 {
+		t.Errorf("row is at version %d, want 0", row.Version)
+	}
+}
+
+func TestUpdateOnlyIfUnchangedCallbackRollback(t *testing.T) {
+	conn := dialTest(t)
+	row := versionedTable(t, conn, "before")
+
+	// A failing callback after the update rolls it back
+	row.Name = "after"
+	row.failAfter = true
+	if err := conn.UpdateOnlyIfUnchanged(row, "name"); !errors.Is(err, errAfterUpdate) {
+		t.Fatalf("UpdateOnlyIfUnchanged returned %v, want %v", err, errAfterUpdate)
+	}
+	if got := stored(t, conn, row.ID); got.Name != "before" || got.Version != 0 {
+		t.Errorf("stored %q at version %d, want before at version 0", got.Name, got.Version)
+	}
+	if row.Version != 0 {
+		t.Errorf("row is at version %d, want 0", row.Version)
+	}
+}
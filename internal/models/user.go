@@ -2,12 +2,16 @@ package models
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
 	"strings"
 	"time"
 
 	"github.com/gofrs/uuid"
+	"github.com/pkg/errors"
 	"github.com/trranminhquang/go-boilerplate/internal/db"
 	"github.com/trranminhquang/go-boilerplate/pkg/crypto"
+	"github.com/trranminhquang/go-boilerplate/pkg/messaging"
 )
 
 type User struct {
@@ -63,3 +67,46 @@ func NewUser(phone, email, password string, userData map[string]interface{}) (*U
 
 	return user, nil
 }
+
+// FindUserByID finds a user matching the provided ID.
+func FindUserByID(tx *db.Connection, id uuid.UUID) (*User, error) {
+	user := &User{}
+	if err := tx.Find(user, id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, UserNotFoundError{}
+		}
+		return nil, errors.Wrap(err, "error finding user")
+	}
+	return user, nil
+}
+
+// UserEventsTopic is the topic user lifecycle events are published to.
+const UserEventsTopic = "users"
+
+// CreateUser inserts user and enqueues a user_created event that is published
+// once the surrounding transaction commits. tx must be a transaction, see
+// db.Connection.Enqueue.
+func CreateUser(tx *db.Connection, user *User) error {
+	if err := tx.Create(user); err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(messaging.UserEvent{
+		EventType: messaging.UserCreated,
+		UserID:    user.ID.String(),
+		Email:     string(user.Email),
+		Phone:     string(user.Phone),
+		CreatedAt: user.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	return tx.Enqueue(UserEventsTopic, user.ID.String(), &messaging.Message{
+		ID:      uuid.Must(uuid.NewV4()).String(),
+		Payload: payload,
+		Metadata: map[string]string{
+			"event_type": messaging.UserCreated.String(),
+		},
+	})
+}
@@ -0,0 +1,48 @@
+package observability
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trranminhquang/go-boilerplate/internal/conf"
+)
+
+var (
+	loggingMu sync.Mutex
+	logFile   *os.File
+)
+
+// ConfigureLogging sets the level and output of the standard logger. A
+// configured log file is (re)opened in append mode, so calling it again after
+// the file was rotated makes the logger write to the new file.
+func ConfigureLogging(config *conf.LoggingConfig) error {
+	loggingMu.Lock()
+	defer loggingMu.Unlock()
+
+	level, err := logrus.ParseLevel(config.Level)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stderr
+	var f *os.File
+	if config.File != "" {
+		f, err = os.OpenFile(config.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644) // #nosec G302 G304
+		if err != nil {
+			return err
+		}
+		out = f
+	}
+
+	logrus.SetLevel(level)
+	logrus.SetOutput(out)
+
+	if logFile != nil {
+		_ = logFile.Close()
+	}
+	logFile = f
+
+	return nil
+}
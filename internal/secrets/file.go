@@ -0,0 +1,78 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/trranminhquang/go-boilerplate/internal/conf"
+	"github.com/trranminhquang/go-boilerplate/pkg/crypto"
+)
+
+// FileProvider resolves secrets from a local JSON file mapping secret names
+// to crypto.EncryptedString values. Each value is encrypted with the secret
+// name as its ID, so values can't be swapped between names. The file is read
+// on every lookup so rotated secrets are picked up by a configuration reload.
+type FileProvider struct {
+	path string
+	keys map[string]string
+}
+
+// NewFileProvider creates a FileProvider for config.File decrypting with
+// config.DecryptionKeys.
+func NewFileProvider(config *conf.SecretsConfiguration) (conf.SecretProvider, error) {
+	if config.File == "" {
+		return nil, fmt.Errorf("secrets: SECRETS_FILE is required by the file provider")
+	}
+	if len(config.DecryptionKeys) == 0 {
+		return nil, fmt.Errorf("secrets: SECRETS_DECRYPTION_KEYS is required by the file provider")
+	}
+
+	return &FileProvider{
+		path: config.File,
+		keys: config.DecryptionKeys,
+	}, nil
+}
+
+// GetSecret decrypts the secret stored under name.
+func (p *FileProvider) GetSecret(name string) (string, error) {
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return "", err
+	}
+
+	var entries map[string]json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return "", fmt.Errorf("secrets: parsing %s: %w", p.path, err)
+	}
+
+	raw, ok := entries[name]
+	if !ok {
+		return "", fmt.Errorf("secrets: secret %q not found", name)
+	}
+
+	es := crypto.ParseEncryptedString(string(raw))
+	if es == nil {
+		return "", fmt.Errorf("secrets: secret %q is not a valid encrypted string", name)
+	}
+
+	value, err := es.Decrypt(name, p.keys)
+	if err != nil {
+		return "", fmt.Errorf("secrets: decrypting %q: %w", name, err)
+	}
+	return string(value), nil
+}
+
+// Encrypt encrypts value for storage under name in a secrets file.
+func Encrypt(name, value, keyID string, keys map[string]string) (*crypto.EncryptedString, error) {
+	key, ok := keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("secrets: key %q not found", keyID)
+	}
+	return crypto.NewEncryptedString(name, []byte(value), keyID, key)
+}
+
+// Register registers the secret providers of this package.
+func Register() {
+	conf.RegisterSecretProvider("file", NewFileProvider)
+}
@@ -0,0 +1,225 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trranminhquang/go-boilerplate/pkg/messaging"
+)
+
+// Metadata keys describing why a message was dead-lettered. The original
+// metadata of the message is kept next to them.
+const (
+	deadLetterPrefix = "dlq_"
+
+	MetadataDeadLetterError      = deadLetterPrefix + "error"
+	MetadataDeadLetterAttempts   = deadLetterPrefix + "attempts"
+	MetadataDeadLetterHandler    = deadLetterPrefix + "handler"
+	MetadataDeadLetterMessageID  = deadLetterPrefix + "message_id"
+	MetadataDeadLetterTopic      = deadLetterPrefix + "topic"
+	MetadataDeadLetterSource     = deadLetterPrefix + "source"
+	MetadataDeadLetterReceivedAt = deadLetterPrefix + "received_at"
+	MetadataDeadLetterFailedAt   = deadLetterPrefix + "failed_at"
+)
+
+// DeadLetter is a message that could not be handled.
+type DeadLetter struct {
+	// Message is the original message, without the dead letter metadata.
+	Message *messaging.Message
+
+	Error    string
+	Attempts int
+	Handler  string
+	// Topic is the topic the message was originally consumed from.
+	Topic      string
+	ReceivedAt time.Time
+	FailedAt   time.Time
+}
+
+// ParseDeadLetter extracts the original message and the failure details from
+// a message consumed from the dead-letter topic.
+func ParseDeadLetter(msg *messaging.Message) *DeadLetter {
+	metadata := make(map[string]string, len(msg.Metadata))
+	for k, v := range msg.Metadata {
+		if !strings.HasPrefix(k, deadLetterPrefix) {
+			metadata[k] = v
+		}
+	}
+	delete(metadata, messaging.MetadataAttempt)
+
+	dl := &DeadLetter{
+		Message: &messaging.Message{
+			ID:       msg.Metadata[MetadataDeadLetterMessageID],
+			Payload:  msg.Payload,
+			Metadata: metadata,
+			Source:   msg.Metadata[MetadataDeadLetterSource],
+		},
+		Error:   msg.Metadata[MetadataDeadLetterError],
+		Handler: msg.Metadata[MetadataDeadLetterHandler],
+		Topic:   msg.Metadata[MetadataDeadLetterTopic],
+	}
+	if dl.Message.ID == "" {
+		dl.Message.ID = msg.ID
+	}
+	// Dead letters published in structured mode are shown and replayed with
+	// the original payload. A malformed envelope is left as is.
+	_, _, _ = messaging.ReadEnvelope(dl.Message)
+	dl.Attempts, _ = strconv.Atoi(msg.Metadata[MetadataDeadLetterAttempts])
+	dl.ReceivedAt, _ = time.Parse(time.RFC3339Nano, msg.Metadata[MetadataDeadLetterReceivedAt])
+	dl.FailedAt, _ = time.Parse(time.RFC3339Nano, msg.Metadata[MetadataDeadLetterFailedAt])
+	return dl
+}
+
+// DeadLetterQueue publishes messages that exhausted their retries or failed
+// permanently to a dead-letter topic, so they can be inspected and replayed.
+type DeadLetterQueue struct {
+	producer messaging.Producer
+	topic    string
+	logger   *logrus.Logger
+}
+
+// NewDeadLetterQueue creates a dead-letter queue publishing to topic
+func NewDeadLetterQueue(producer messaging.Producer, topic string) *DeadLetterQueue {
+	return &DeadLetterQueue{
+		producer: producer,
+		topic:    topic,
+		logger:   logrus.StandardLogger(),
+	}
+}
+
+// Topic returns the dead-letter topic
+func (q *DeadLetterQueue) Topic() string {
+	return q.topic
+}
+
+// Publish publishes the original payload of msg along with the failure
+// details to the dead-letter topic.
+func (q *DeadLetterQueue) Publish(ctx context.Context, msg *messaging.Message, cause error, handler string, received time.Time) error {
+	metadata := make(map[string]string, len(msg.Metadata)+8)
+	for k, v := range msg.Metadata {
+		metadata[k] = v
+	}
+
+	topic := msg.Metadata[messaging.MetadataTopic]
+	if topic == "" {
+		topic = msg.Source
+	}
+
+	metadata[MetadataDeadLetterError] = cause.Error()
+	metadata[MetadataDeadLetterAttempts] = msg.Metadata[messaging.MetadataAttempt]
+	metadata[MetadataDeadLetterHandler] = handler
+	metadata[MetadataDeadLetterMessageID] = msg.ID
+	metadata[MetadataDeadLetterTopic] = topic
+	metadata[MetadataDeadLetterSource] = msg.Source
+	metadata[MetadataDeadLetterReceivedAt] = received.UTC().Format(time.RFC3339Nano)
+	metadata[MetadataDeadLetterFailedAt] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	if err := q.producer.Publish(ctx, q.topic, msg.Payload, metadata); err != nil {
+		return err
+	}
+
+	q.logger.WithFields(logrus.Fields{
+		"message_id": msg.ID,
+		"topic":      q.topic,
+		"handler":    handler,
+	}).Warn("Message moved to dead-letter topic")
+	return nil
+}
+
+// Replay publishes the original message of dl back to the topic it was
+// consumed from.
+func (q *DeadLetterQueue) Replay(ctx context.Context, dl *DeadLetter) error {
+	if dl.Topic == "" {
+		return errors.New("dead letter has no original topic")
+	}
+	return q.producer.Publish(ctx, dl.Topic, dl.Message.Payload, dl.Message.Metadata)
+}
+
+// Close closes the producer of the queue
+func (q *DeadLetterQueue) Close() error {
+	return q.producer.Close()
+}
+
+// ReadDeadLetters consumes the dead-letter topic with consumer and calls fn
+// for every dead letter, until limit dead letters were read, no message
+// arrived for idle, fn returns an error or ctx is canceled. A limit of 0
+// reads until the topic is idle. It returns the number of dead letters read.
+func ReadDeadLetters(ctx context.Context, consumer messaging.Consumer, limit int, idle time.Duration, fn func(*DeadLetter) error) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu      sync.Mutex
+		count   int
+		readErr error
+	)
+	activity := make(chan struct{}, 1)
+
+	err := consumer.Subscribe(func(_ context.Context, msg *messaging.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if err := fn(ParseDeadLetter(msg)); err != nil {
+			readErr = err
+			cancel()
+			return err
+		}
+
+		if err := consumer.Ack(msg); err != nil {
+			readErr = err
+			cancel()
+			return err
+		}
+
+		count++
+		if limit > 0 && count >= limit {
+			cancel()
+		}
+
+		select {
+		case activity <- struct{}{}:
+		default:
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := consumer.Start(ctx); err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err := consumer.Stop(); err != nil {
+			logrus.WithError(err).Error("Failed to stop dead-letter consumer")
+		}
+	}()
+
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+wait:
+	for {
+		select {
+		case <-activity:
+			timer.Reset(idle)
+		case <-timer.C:
+			break wait
+		case <-ctx.Done():
+			break wait
+		}
+	}
+	cancel()
+
+	mu.Lock()
+	defer mu.Unlock()
+	return count, readErr
+}
@@ -0,0 +1,113 @@
+package worker
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultDrainTimeout is the default drain timeout of a Pool, see
+// Pool.SetDrainTimeout
+const DefaultDrainTimeout = 30 * time.Second
+
+// DrainError is returned by Stop when jobs could not be finished. They were
+// handed back, see Pool.Stop.
+type DrainError struct {
+	// Abandoned lists the IDs of the jobs that were handed back
+	Abandoned []string
+}
+
+func (e *DrainError) Error() string {
+	return fmt.Sprintf("%d job(s) abandoned while stopping the worker pool", len(e.Abandoned))
+}
+
+// Stop gracefully shuts down the worker pool. It stops accepting jobs and
+// lets the workers finish the queued ones. Jobs still running after the
+// drain timeout are interrupted by canceling their context.
+//
+// Jobs that were not finished, because they were interrupted, still queued
+// or waiting for a retry, are handed back: jobs implementing CompletableJob
+// are completed with ErrPoolStopped, e.g. to negatively acknowledge their
+// message. They are reported by the returned *DrainError. Stop is safe to
+// call concurrently with Submit and more than once.
+func (p *Pool) Stop() error {
+	p.stopOnce.Do(func() {
+		p.stopErr = p.drain()
+	})
+	return p.stopErr
+}
+
+func (p *Pool) drain() error {
+	p.logger.Info("Stopping worker pool")
+
+	// Refuse new jobs and wait for the submissions in progress, after which
+	// the queue only shrinks
+	close(p.draining)
+	p.intake.Lock()
+	close(p.sealed)
+	p.intake.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	drainTimeout := time.Duration(p.drainTimeout.Load())
+	timer := time.NewTimer(drainTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+	case <-timer.C:
+		p.logger.Warnf("Worker pool did not drain within %s, interrupting running jobs", drainTimeout)
+		p.cancel()
+		<-done
+	}
+	p.cancel()
+
+	// Workers may schedule retries until they return
+	p.retries.Wait()
+
+	// Hand back the jobs left in the queue and behind busy keys
+sweep:
+	for {
+		select {
+		case job := <-p.jobQueue:
+			p.abandon(job, "still queued")
+		default:
+			break sweep
+		}
+	}
+	p.keysMu.Lock()
+	for key, ks := range p.keys {
+		for _, job := range ks.backlog {
+			p.abandon(job, "still queued")
+		}
+		delete(p.keys, key)
+	}
+	p.keysMu.Unlock()
+
+	p.abandonedMu.Lock()
+	defer p.abandonedMu.Unlock()
+
+	if len(p.abandoned) > 0 {
+		err := &DrainError{Abandoned: p.abandoned}
+		p.logger.WithField("jobs", p.abandoned).Warn(err.Error())
+		return err
+	}
+
+	p.logger.Info("Worker pool stopped")
+	return nil
+}
+
+// abandon hands job back because the pool stopped before finishing it
+func (p *Pool) abandon(job Job, reason string) {
+	p.abandonedMu.Lock()
+	p.abandoned = append(p.abandoned, job.ID())
+	p.abandonedMu.Unlock()
+
+	p.logger.Warnf("Handing back job %s: %s", job.ID(), reason)
+	if cj, ok := job.(CompletableJob); ok {
+		cj.Complete(ErrPoolStopped)
+	}
+}
@@ -0,0 +1,212 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testJob is a CompletableJob recording how the pool completed it
+type testJob struct {
+	id      string
+	execute func(ctx context.Context) error
+	results *completions
+}
+
+func (j *testJob) ID() string {
+	return j.id
+}
+
+func (j *testJob) Execute(ctx context.Context) error {
+	return j.execute(ctx)
+}
+
+func (j *testJob) Complete(err error) {
+	j.results.add(j.id, err)
+}
+
+// completions records the errors jobs were completed with, by job ID
+type completions struct {
+	mu     sync.Mutex
+	errors map[string][]error
+}
+
+func newCompletions() *completions {
+	return &completions{errors: make(map[string][]error)}
+}
+
+func (c *completions) add(id string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errors[id] = append(c.errors[id], err)
+}
+
+func (c *completions) get(id string) []error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.errors[id]
+}
+
+// newTestPool starts a pool that does not log
+func newTestPool(t *testing.T, workers, queueSize int, drainTimeout time.Duration) *Pool {
+	t.Helper()
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+
+	p := NewPool(workers, queueSize)
+	p.logger = logger
+	p.SetDrainTimeout(drainTimeout)
+	p.Start()
+	return p
+}
+
+// blockUntilStopped is a job that only returns once the pool interrupts it
+func blockUntilStopped(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestPoolStopDuringSubmit(t *testing.T) {
+	const (
+		submitters = 8
+		jobs       = 20
+	)
+
+	results := newCompletions()
+	p := newTestPool(t, 2, 4, 50*time.Millisecond)
+
+	var (
+		mu       sync.Mutex
+		accepted []string
+		rejected []string
+		wg       sync.WaitGroup
+	)
+	start := make(chan struct{})
+	for s := 0; s < submitters; s++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for i := 0; i < jobs; i++ {
+				job := &testJob{id: fmt.Sprintf("job-%d-%d", s, i), execute: blockUntilStopped, results: results}
+				err := p.Submit(job)
+
+				mu.Lock()
+				switch {
+				case err == nil:
+					accepted = append(accepted, job.id)
+				case errors.Is(err, ErrPoolStopped):
+					rejected = append(rejected, job.id)
+				default:
+					t.Errorf("Submit(%s) returned %v, want nil or ErrPoolStopped", job.id, err)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// Stop, from several goroutines at once, while the submitters are
+	// blocked on the full queue
+	close(start)
+	time.Sleep(10 * time.Millisecond)
+
+	stopErrs := make([]error, 3)
+	var stops sync.WaitGroup
+	for i := range stopErrs {
+		stops.Add(1)
+		go func() {
+			defer stops.Done()
+			stopErrs[i] = p.Stop()
+		}()
+	}
+	stops.Wait()
+	wg.Wait()
+
+	var derr *DrainError
+	if !errors.As(stopErrs[0], &derr) {
+		t.Fatalf("Stop returned %v, want a *DrainError", stopErrs[0])
+	}
+	for _, err := range stopErrs[1:] {
+		if err != stopErrs[0] {
+			t.Errorf("concurrent Stop returned %v, want %v", err, stopErrs[0])
+		}
+	}
+
+	if len(accepted) == 0 || len(rejected) == 0 {
+		t.Fatalf("accepted %d and rejected %d jobs, want both to be non-zero", len(accepted), len(rejected))
+	}
+
+	// Every accepted job was interrupted or still queued, so it was handed
+	// back exactly once, and the rejected ones were left to the caller
+	abandoned := append([]string{}, derr.Abandoned...)
+	sort.Strings(abandoned)
+	sort.Strings(accepted)
+	if fmt.Sprint(abandoned) != fmt.Sprint(accepted) {
+		t.Errorf("abandoned jobs:\n got %v\nwant %v", abandoned, accepted)
+	}
+	for _, id := range accepted {
+		if errs := results.get(id); len(errs) != 1 || !errors.Is(errs[0], ErrPoolStopped) {
+			t.Errorf("job %s was completed with %v, want ErrPoolStopped once", id, errs)
+		}
+	}
+	for _, id := range rejected {
+		if errs := results.get(id); len(errs) != 0 {
+			t.Errorf("rejected job %s was completed with %v", id, errs)
+		}
+	}
+
+	job := &testJob{id: "late", execute: blockUntilStopped, results: results}
+	if err := p.Submit(job); !errors.Is(err, ErrPoolStopped) {
+		t.Errorf("Submit after Stop returned %v, want ErrPoolStopped", err)
+	}
+	if err := p.Stop(); err != stopErrs[0] {
+		t.Errorf("second Stop returned %v, want %v", err, stopErrs[0])
+	}
+}
+
+func TestPoolStopFinishesQueuedJobs(t *testing.T) {
+	results := newCompletions()
+	p := newTestPool(t, 2, 10, time.Second)
+
+	release := make(chan struct{})
+	var ids []string
+	for i := 0; i < 10; i++ {
+		job := &testJob{
+			id: fmt.Sprintf("job-%d", i),
+			execute: func(ctx context.Context) error {
+				select {
+				case <-release:
+					return nil
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			},
+			results: results,
+		}
+		if err := p.Submit(job); err != nil {
+			t.Fatalf("Submit(%s): %v", job.id, err)
+		}
+		ids = append(ids, job.id)
+	}
+
+	time.AfterFunc(20*time.Millisecond, func() {
+		close(release)
+	})
+	if err := p.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+
+	for _, id := range ids {
+		if errs := results.get(id); len(errs) != 1 || errs[0] != nil {
+			t.Errorf("job %s was completed with %v, want nil once", id, errs)
+		}
+	}
+}
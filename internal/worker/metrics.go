@@ -0,0 +1,54 @@
+package worker
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/trranminhquang/go-boilerplate/pkg/messaging"
+)
+
+// MetricsRecorder receives the outcome of every handled message, see Metrics
+type MetricsRecorder interface {
+	ObserveMessage(msgType messaging.MessageType, duration time.Duration, err error)
+}
+
+// ExpvarMetrics is a MetricsRecorder publishing per message type counters
+// with expvar, which expvar.Handler serves as JSON.
+type ExpvarMetrics struct {
+	processed *expvar.Map
+	failed    *expvar.Map
+	// durations holds the total handling time in seconds
+	durations *expvar.Map
+}
+
+// NewExpvarMetrics creates the recorder, publishing its maps under name. It
+// must be called once per name, like expvar.NewMap.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	m := expvar.NewMap(name)
+
+	processed, failed, durations := new(expvar.Map), new(expvar.Map), new(expvar.Map)
+	m.Set("processed", processed)
+	m.Set("failed", failed)
+	m.Set("duration_seconds", durations)
+
+	return &ExpvarMetrics{
+		processed: processed,
+		failed:    failed,
+		durations: durations,
+	}
+}
+
+// ObserveMessage implements MetricsRecorder
+func (m *ExpvarMetrics) ObserveMessage(msgType messaging.MessageType, duration time.Duration, err error) {
+	key := msgType.String()
+	if key == "" {
+		key = "unknown"
+	}
+
+	if err != nil {
+		m.failed.Add(key, 1)
+	} else {
+		m.processed.Add(key, 1)
+	}
+	m.durations.AddFloat(key, duration.Seconds())
+}
@@ -0,0 +1,221 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trranminhquang/go-boilerplate/pkg/messaging"
+)
+
+// Middleware wraps a message handler, e.g. to add behavior before and after
+// it runs
+type Middleware func(messaging.MessageHandler) messaging.MessageHandler
+
+// chain wraps handler with middlewares, the first one being the outermost
+func chain(handler messaging.MessageHandler, middlewares []Middleware) messaging.MessageHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+type messageTypeKey struct{}
+
+// withMessageType returns a copy of ctx carrying the type of the message
+// being handled
+func withMessageType(ctx context.Context, msgType messaging.MessageType) context.Context {
+	return context.WithValue(ctx, messageTypeKey{}, msgType)
+}
+
+// MessageTypeFromContext returns the type of the message being handled, as
+// determined by the QueueWorker
+func MessageTypeFromContext(ctx context.Context) messaging.MessageType {
+	msgType, _ := ctx.Value(messageTypeKey{}).(messaging.MessageType)
+	return msgType
+}
+
+// Logging logs every message with its ID, type and attempt, and the outcome
+// of handling it
+func Logging(logger *logrus.Logger) Middleware {
+	return func(next messaging.MessageHandler) messaging.MessageHandler {
+		return func(ctx context.Context, msg *messaging.Message) error {
+			entry := logger.WithFields(logrus.Fields{
+				"message_id":   msg.ID,
+				"message_type": MessageTypeFromContext(ctx),
+				"source":       msg.Source,
+				"attempt":      msg.Metadata[messaging.MetadataAttempt],
+			})
+			if tc, ok := messaging.TraceFromContext(ctx); ok {
+				entry = entry.WithField("trace_id", tc.TraceID)
+			}
+
+			entry.Info("Processing message")
+			start := time.Now()
+
+			err := next(ctx, msg)
+
+			entry = entry.WithField("duration", time.Since(start))
+			if err != nil {
+				entry.WithError(err).Warn("Failed to process message")
+			} else {
+				entry.Info("Processed message")
+			}
+			return err
+		}
+	}
+}
+
+// PanicError is the error of a job or handler that panicked, see Recover. Like
+// other errors it is retried unless the retry policy of the job says
+// otherwise.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Recover converts a panic of the handler into a *PanicError, so it goes
+// through the retry policy like any other error. Add it first with Use, so
+// that it also covers the middlewares added after it. The worker pool
+// recovers the panics of jobs as a last resort.
+func Recover() Middleware {
+	return func(next messaging.MessageHandler) messaging.MessageHandler {
+		return func(ctx context.Context, msg *messaging.Message) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					perr := &PanicError{Value: r, Stack: debug.Stack()}
+					logrus.WithField("stack", string(perr.Stack)).Errorf("Handler of message %s panicked: %v", msg.ID, r)
+					err = perr
+				}
+			}()
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Tracing extracts the W3C trace context from the message metadata into the
+// handler context, see messaging.TraceFromContext
+func Tracing() Middleware {
+	return func(next messaging.MessageHandler) messaging.MessageHandler {
+		return func(ctx context.Context, msg *messaging.Message) error {
+			if tc, ok := messaging.TraceFromMetadata(msg.Metadata); ok {
+				ctx = messaging.ContextWithTrace(ctx, tc)
+			}
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Timeout bounds the execution of the handler. It complements the job
+// timeouts of the QueueWorker, e.g. for a single step of a chain.
+func Timeout(timeout time.Duration) Middleware {
+	return func(next messaging.MessageHandler) messaging.MessageHandler {
+		return func(ctx context.Context, msg *messaging.Message) error {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			return next(ctx, msg)
+		}
+	}
+}
+
+// Metrics records the outcome and duration of every message
+func Metrics(recorder MetricsRecorder) Middleware {
+	return func(next messaging.MessageHandler) messaging.MessageHandler {
+		return func(ctx context.Context, msg *messaging.Message) error {
+			start := time.Now()
+			err := next(ctx, msg)
+			recorder.ObserveMessage(MessageTypeFromContext(ctx), time.Since(start), err)
+			return err
+		}
+	}
+}
+
+// DedupStore remembers the IDs of the messages that were processed
+type DedupStore interface {
+	// Processed reports whether the message with id was processed
+	Processed(ctx context.Context, id string) (bool, error)
+
+	// MarkProcessed records that the message with id was processed
+	MarkProcessed(ctx context.Context, id string) error
+}
+
+// Deduplicate skips messages whose ID was already processed successfully,
+// e.g. when the broker redelivers a message. Messages without an ID are
+// always handled.
+func Deduplicate(store DedupStore) Middleware {
+	return func(next messaging.MessageHandler) messaging.MessageHandler {
+		return func(ctx context.Context, msg *messaging.Message) error {
+			if msg.ID == "" {
+				return next(ctx, msg)
+			}
+
+			processed, err := store.Processed(ctx, msg.ID)
+			if err != nil {
+				return err
+			}
+			if processed {
+				logrus.WithField("message_id", msg.ID).Info("Skipping duplicate message")
+				return nil
+			}
+
+			if err := next(ctx, msg); err != nil {
+				return err
+			}
+			return store.MarkProcessed(ctx, msg.ID)
+		}
+	}
+}
+
+// MemoryDedupStore is a DedupStore keeping the IDs in memory for a limited
+// time. It only deduplicates within a single process.
+type MemoryDedupStore struct {
+	ttl time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+	// sweep is when expired IDs are removed next
+	sweep time.Time
+}
+
+// NewMemoryDedupStore creates a store remembering IDs for ttl
+func NewMemoryDedupStore(ttl time.Duration) *MemoryDedupStore {
+	return &MemoryDedupStore{
+		ttl:  ttl,
+		seen: make(map[string]time.Time),
+	}
+}
+
+// Processed implements DedupStore
+func (s *MemoryDedupStore) Processed(ctx context.Context, id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires, ok := s.seen[id]
+	return ok && time.Now().Before(expires), nil
+}
+
+// MarkProcessed implements DedupStore
+func (s *MemoryDedupStore) MarkProcessed(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.After(s.sweep) {
+		for k, expires := range s.seen {
+			if now.After(expires) {
+				delete(s.seen, k)
+			}
+		}
+		s.sweep = now.Add(s.ttl)
+	}
+
+	s.seen[id] = now.Add(s.ttl)
+	return nil
+}
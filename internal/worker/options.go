@@ -1,30 +1,34 @@
 package worker
 
-// Config represents configuration options for the worker pool
-type Config struct {
-	// WorkerCount is the number of concurrent workers to run
-	WorkerCount int
+import "github.com/trranminhquang/go-boilerplate/internal/conf"
 
-	// QueueSize is the maximum number of jobs that can be queued
-	QueueSize int
+// QueueConfig converts the messaging configuration into the configuration
+// map expected by the messaging.Registry factories
+func QueueConfig(config *conf.MessagingConfiguration) map[string]interface{} {
+	return map[string]interface{}{
+		"brokers":  config.Brokers,
+		"topics":   config.Topics,
+		"group_id": config.GroupID,
 
-	// QueueType specifies the type of message queue to use (e.g., "kafka")
-	QueueType string
+		"event_source":   config.EventSource,
+		"event_mode":     config.EventMode,
+		"initial_offset": config.InitialOffset,
 
-	// QueueConfig contains configuration for the specific queue type
-	QueueConfig map[string]interface{}
-}
+		"client_id":       config.Kafka.ClientID,
+		"acks":            config.Kafka.Acks,
+		"idempotent":      config.Kafka.Idempotent,
+		"compression":     config.Kafka.Compression,
+		"linger":          config.Kafka.Linger,
+		"batch_max_bytes": config.Kafka.BatchMaxBytes,
+		"commit_interval": config.Kafka.CommitInterval,
+
+		"redelivery_delay":     config.Kafka.RedeliveryDelay,
+		"max_redelivery_delay": config.Kafka.MaxRedeliveryDelay,
 
-// DefaultOptions returns default worker configuration
-func DefaultOptions() Config {
-	return Config{
-		WorkerCount: 4,
-		QueueSize:   100,
-		QueueType:   "kafka",
-		QueueConfig: map[string]interface{}{
-			"brokers":  "localhost:9092",
-			"topics":   "default-topic",
-			"group_id": "go-worker-group",
-		},
+		"poll_interval":      config.Postgres.PollInterval,
+		"visibility_timeout": config.Postgres.VisibilityTimeout,
+		"batch_size":         config.Postgres.BatchSize,
+		"retry_delay":        config.Postgres.RetryDelay,
+		"max_retry_delay":    config.Postgres.MaxRetryDelay,
 	}
 }
@@ -0,0 +1,88 @@
+package worker
+
+// KeyedJob is a Job that an ordered pool processes sequentially with the
+// other jobs of the same key. Jobs with an empty key are not ordered.
+type KeyedJob interface {
+	Job
+	Key() string
+}
+
+// keyState tracks the job holding a key and the jobs queued behind it
+type keyState struct {
+	// owner is the ID of the job holding the key, either running or waiting
+	// for a retry
+	owner   string
+	backlog []Job
+}
+
+// NewOrderedPool creates a worker pool processing jobs with the same key in
+// submission order. Jobs with different keys still run in parallel. Jobs
+// waiting for their key do not occupy a worker, so a slow key only holds up
+// its own jobs.
+func NewOrderedPool(workerCount int, queueSize int) *Pool {
+	p := NewPool(workerCount, queueSize)
+	p.keys = make(map[string]*keyState)
+	return p
+}
+
+// jobKey returns the ordering key of job, or an empty string when the pool
+// is not ordered or the job has no key
+func (p *Pool) jobKey(job Job) string {
+	if p.keys == nil {
+		return ""
+	}
+	if kj, ok := job.(KeyedJob); ok {
+		return kj.Key()
+	}
+	return ""
+}
+
+// acquire reports whether job may run now. Otherwise it was queued behind
+// the job holding its key and runs once that job is done.
+func (p *Pool) acquire(job Job) bool {
+	key := p.jobKey(job)
+	if key == "" {
+		return true
+	}
+
+	p.keysMu.Lock()
+	defer p.keysMu.Unlock()
+
+	ks, ok := p.keys[key]
+	if !ok {
+		p.keys[key] = &keyState{owner: job.ID()}
+		return true
+	}
+	if ks.owner == job.ID() {
+		// a retry of the job holding the key
+		return true
+	}
+	ks.backlog = append(ks.backlog, job)
+	return false
+}
+
+// release hands the key of job over to the next job queued behind it and
+// returns that job, or nil when there is none.
+func (p *Pool) release(job Job) Job {
+	key := p.jobKey(job)
+	if key == "" {
+		return nil
+	}
+
+	p.keysMu.Lock()
+	defer p.keysMu.Unlock()
+
+	ks, ok := p.keys[key]
+	if !ok || ks.owner != job.ID() {
+		return nil
+	}
+	if len(ks.backlog) == 0 {
+		delete(p.keys, key)
+		return nil
+	}
+
+	next := ks.backlog[0]
+	ks.backlog = ks.backlog[1:]
+	ks.owner = next.ID()
+	return next
+}
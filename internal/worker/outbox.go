@@ -0,0 +1,163 @@
+package worker
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trranminhquang/go-boilerplate/internal/conf"
+	"github.com/trranminhquang/go-boilerplate/internal/db"
+	"github.com/trranminhquang/go-boilerplate/pkg/messaging"
+)
+
+// OutboxRelay publishes messages enqueued with db.Connection.Enqueue. Several
+// relays may run against the same database; each message is claimed by one
+// of them at a time.
+type OutboxRelay struct {
+	conn     atomic.Pointer[db.Connection]
+	producer messaging.Producer
+	config   atomic.Pointer[conf.OutboxConfiguration]
+	logger   *logrus.Logger
+	wg       sync.WaitGroup
+	ctx      context.Context
+	cancel   context.CancelFunc
+}
+
+// NewOutboxRelay creates a relay publishing outbox messages with producer
+func NewOutboxRelay(conn *db.Connection, producer messaging.Producer, config *conf.OutboxConfiguration) *OutboxRelay {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	r := &OutboxRelay{
+		producer: producer,
+		logger:   logrus.StandardLogger(),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	r.conn.Store(conn)
+	r.SetConfig(config)
+	return r
+}
+
+// SetDB replaces the database connection of the relay and returns the
+// previous one, which the batch in progress may still be using.
+func (r *OutboxRelay) SetDB(conn *db.Connection) *db.Connection {
+	return r.conn.Swap(conn)
+}
+
+// SetConfig replaces the configuration of the relay. It is safe to call while
+// the relay runs, the next batch uses the new configuration. Enabled is
+// ignored.
+func (r *OutboxRelay) SetConfig(config *conf.OutboxConfiguration) {
+	r.config.Store(config)
+}
+
+// Start starts relaying messages in the background
+func (r *OutboxRelay) Start() {
+	r.logger.Info("Starting outbox relay")
+
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.run()
+	}()
+}
+
+// run relays batches until the relay is stopped. It only sleeps when the
+// previous batch did not fill up, so a backlog is drained as fast as possible.
+func (r *OutboxRelay) run() {
+	for {
+		config := r.config.Load()
+		n, err := r.relayBatch(r.ctx, config)
+		if err != nil && r.ctx.Err() == nil {
+			r.logger.WithError(err).Error("Failed to relay outbox messages")
+		}
+
+		if n < config.BatchSize || err != nil {
+			select {
+			case <-r.ctx.Done():
+				return
+			case <-time.After(config.PollInterval):
+			}
+		} else if r.ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// relayBatch claims one batch of messages, publishes them and records the
+// outcome, all in a single transaction. It returns the number of claimed
+// messages.
+func (r *OutboxRelay) relayBatch(ctx context.Context, config *conf.OutboxConfiguration) (int, error) {
+	var claimed int
+
+	err := r.conn.Load().WithContext(ctx).Transaction(func(tx *db.Connection) error {
+		messages, err := tx.ClaimOutbox(config.BatchSize)
+		if err != nil {
+			return err
+		}
+		claimed = len(messages)
+
+		for i := range messages {
+			if err := r.publish(ctx, tx, config, &messages[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return claimed, err
+}
+
+// publish sends a single message and records the result.
+func (r *OutboxRelay) publish(ctx context.Context, tx *db.Connection, config *conf.OutboxConfiguration, m *db.OutboxMessage) error {
+	logger := r.logger.WithFields(logrus.Fields{
+		"message_id": m.MessageID,
+		"topic":      m.Topic,
+		"key":        m.AggregateKey,
+		"attempt":    m.Attempts + 1,
+	})
+
+	perr := r.producer.Publish(ctx, m.Topic, m.Payload, m.Metadata)
+	if perr == nil {
+		logger.Debug("Published outbox message")
+		return tx.MarkOutboxSent(m)
+	}
+
+	if m.Attempts+1 >= config.MaxAttempts {
+		logger.WithError(perr).Error("Giving up on outbox message")
+		return tx.MarkOutboxFailed(m, perr, nil)
+	}
+
+	retryAt := time.Now().Add(outboxBackoff(config, m.Attempts+1))
+	logger.WithError(perr).WithField("retry_at", retryAt).Warn("Failed to publish outbox message")
+	return tx.MarkOutboxFailed(m, perr, &retryAt)
+}
+
+// outboxBackoff returns an exponential delay with jitter for the given attempt.
+func outboxBackoff(config *conf.OutboxConfiguration, attempt int) time.Duration {
+	delay := config.RetryDelay << (attempt - 1)
+	if delay <= 0 || delay > config.MaxRetryDelay {
+		delay = config.MaxRetryDelay
+	}
+	// Jitter between 50% and 100% of the delay
+	return delay/2 + time.Duration(rand.Int64N(int64(delay/2)+1)) // #nosec G404
+}
+
+// Stop stops the relay and waits for it to exit. A batch interrupted by Stop
+// is rolled back, so its messages are published again by the next relay;
+// consumers must tolerate duplicates.
+func (r *OutboxRelay) Stop() error {
+	r.logger.Info("Stopping outbox relay")
+	r.cancel()
+	r.wg.Wait()
+
+	if err := r.producer.Close(); err != nil {
+		return err
+	}
+
+	r.logger.Info("Outbox relay stopped")
+	return nil
+}
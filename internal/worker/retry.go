@@ -0,0 +1,46 @@
+package worker
+
+import (
+	"math/rand/v2"
+	"time"
+
+	"github.com/trranminhquang/go-boilerplate/internal/conf"
+)
+
+// RetryPolicy controls how often and when a failed message is handled again.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	// Values below 2 disable retries.
+	MaxAttempts int
+
+	// BaseDelay is the delay before the second attempt. It doubles with
+	// every attempt up to MaxDelay.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// NoRetry is a policy that never retries.
+var NoRetry = RetryPolicy{MaxAttempts: 1}
+
+// NewRetryPolicy creates a retry policy from the configuration.
+func NewRetryPolicy(config *conf.RetryConfiguration) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: config.MaxAttempts,
+		BaseDelay:   config.BaseDelay,
+		MaxDelay:    config.MaxDelay,
+	}
+}
+
+// Backoff returns an exponential delay with jitter to wait after the given
+// failed attempt.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	if p.BaseDelay <= 0 {
+		return 0
+	}
+	delay := p.BaseDelay << (attempt - 1)
+	if delay <= 0 || (p.MaxDelay > 0 && delay > p.MaxDelay) {
+		delay = p.MaxDelay
+	}
+	// Jitter between 50% and 100% of the delay
+	return delay/2 + time.Duration(rand.Int64N(int64(delay/2)+1)) // #nosec G404
+}
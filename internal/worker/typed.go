@@ -0,0 +1,25 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/trranminhquang/go-boilerplate/pkg/messaging"
+)
+
+// TypedHandler processes a message whose payload was decoded into T
+type TypedHandler[T any] func(ctx context.Context, msg *messaging.Message, payload T) error
+
+// RegisterTyped registers a handler for messages of the specified type whose
+// payload is decoded into T and validated with messaging.DecodePayload
+// before the handler runs. Payloads that cannot be decoded or are invalid
+// fail permanently: they are dead-lettered without being retried.
+func RegisterTyped[T any](w *QueueWorker, msgType messaging.MessageType, handler TypedHandler[T]) {
+	w.RegisterHandler(msgType, func(ctx context.Context, msg *messaging.Message) error {
+		var payload T
+		if err := messaging.DecodePayload(msg.Payload, &payload); err != nil {
+			return messaging.Permanent(fmt.Errorf("invalid %s payload: %w", msgType, err))
+		}
+		return handler(ctx, msg, payload)
+	})
+}
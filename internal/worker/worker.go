@@ -3,42 +3,106 @@ package worker
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"runtime/debug"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
+	"github.com/trranminhquang/go-boilerplate/internal/conf"
 	"github.com/trranminhquang/go-boilerplate/pkg/messaging"
 )
 
 // Job represents a task to be executed by a worker
 type Job interface {
-	Execute() error
+	// Execute runs the job. ctx is canceled when the pool stops. A panic
+	// is recovered by the pool and handled as a *PanicError.
+	Execute(ctx context.Context) error
 	ID() string
 }
 
+// ErrPoolStopped is returned when submitting a job to a pool shutting down.
+// Jobs handed back by Stop are completed with it.
+var ErrPoolStopped = errors.New("worker pool is shutting down")
+
+// RetryableJob is a Job that can be executed again after it failed.
+type RetryableJob interface {
+	Job
+
+	// RetryDelay reports whether the job should be retried after failing
+	// with err, and how long to wait before the next attempt.
+	RetryDelay(err error) (time.Duration, bool)
+}
+
+// CompletableJob is a Job that is notified once the pool is done with it,
+// either because it succeeded or because it failed for good.
+type CompletableJob interface {
+	Job
+
+	// Complete is called with nil after a successful execution, or with the
+	// error of the last attempt.
+	Complete(err error)
+}
+
 // Pool represents a worker pool that manages concurrent execution of jobs
 type Pool struct {
+	// drainTimeout is how long Stop waits for the queued jobs to finish
+	// before interrupting them, see SetDrainTimeout
+	drainTimeout atomic.Int64
+
 	jobQueue    chan Job
 	workerCount int
 	wg          sync.WaitGroup
-	ctx         context.Context
-	cancel      context.CancelFunc
-	logger      *logrus.Logger
+	// retries tracks the jobs waiting for their next attempt
+	retries sync.WaitGroup
+	ctx     context.Context
+	cancel  context.CancelFunc
+	logger  *logrus.Logger
+
+	// intake is held for reading by Submit, so that Stop can wait for the
+	// submissions in progress. draining is closed when Stop refuses new
+	// jobs, sealed once no more job can enter the queue.
+	intake   sync.RWMutex
+	draining chan struct{}
+	sealed   chan struct{}
+	stopOnce sync.Once
+	stopErr  error
+
+	// abandoned lists the IDs of the jobs handed back by Stop
+	abandonedMu sync.Mutex
+	abandoned   []string
+
+	// keys holds the state of the keys in use, it is nil when the pool is
+	// not ordered
+	keysMu sync.Mutex
+	keys   map[string]*keyState
 }
 
 // NewPool creates a new worker pool with the specified number of workers
 func NewPool(workerCount int, queueSize int) *Pool {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	return &Pool{
+	p := &Pool{
 		jobQueue:    make(chan Job, queueSize),
 		workerCount: workerCount,
 		ctx:         ctx,
 		cancel:      cancel,
 		logger:      logrus.StandardLogger(),
+		draining:    make(chan struct{}),
+		sealed:      make(chan struct{}),
 	}
+	p.SetDrainTimeout(DefaultDrainTimeout)
+	return p
+}
+
+// SetDrainTimeout sets how long Stop waits for the queued jobs to finish
+// before interrupting them. It is safe to call while the pool runs.
+func (p *Pool) SetDrainTimeout(timeout time.Duration) {
+	p.drainTimeout.Store(int64(timeout))
 }
 
 // Start initializes and starts the worker pool
@@ -65,63 +129,232 @@ func (p *Pool) worker(id int) {
 		case <-p.ctx.Done():
 			p.logger.Infof("Worker %d shutting down", id)
 			return
-		case job, ok := <-p.jobQueue:
-			if !ok {
-				p.logger.Infof("Worker %d shutting down, job queue closed", id)
-				return
+		case <-p.sealed:
+			// Finish the queued jobs before exiting
+			for p.ctx.Err() == nil {
+				select {
+				case job := <-p.jobQueue:
+					p.handle(id, job)
+				default:
+					p.logger.Infof("Worker %d shutting down, job queue drained", id)
+					return
+				}
 			}
+			p.logger.Infof("Worker %d shutting down", id)
+			return
+		case job := <-p.jobQueue:
+			p.handle(id, job)
+		}
+	}
+}
+
+// handle processes job, followed by the jobs that queued up behind its key
+func (p *Pool) handle(id int, job Job) {
+	if !p.acquire(job) {
+		return
+	}
 
-			p.logger.Infof("Worker %d processing job %s", id, job.ID())
-			err := job.Execute()
-			if err != nil {
-				p.logger.Errorf("Worker %d failed to process job %s: %v", id, job.ID(), err)
-			} else {
-				p.logger.Infof("Worker %d completed job %s successfully", id, job.ID())
+	for job != nil && p.ctx.Err() == nil {
+		job = p.process(id, job)
+	}
+	if job != nil {
+		p.abandon(job, "worker pool stopped before the job ran")
+	}
+}
+
+// process executes job and returns the next job to process on the same
+// worker
+func (p *Pool) process(id int, job Job) Job {
+	p.logger.Infof("Worker %d processing job %s", id, job.ID())
+	err := p.execute(job)
+	if err != nil && p.ctx.Err() != nil {
+		// The job was interrupted by Stop, it is neither retried nor
+		// reported as failed
+		p.abandon(job, fmt.Sprintf("interrupted by worker %d: %v", id, err))
+		return nil
+	}
+	if err != nil {
+		if rj, ok := job.(RetryableJob); ok {
+			if delay, retry := rj.RetryDelay(err); retry {
+				p.logger.Warnf("Worker %d failed to process job %s, retrying in %s: %v", id, job.ID(), delay, err)
+				// The job keeps its key until the retry is done
+				p.retry(rj, delay)
+				return nil
 			}
 		}
+		p.logger.Errorf("Worker %d failed to process job %s: %v", id, job.ID(), err)
+	} else {
+		p.logger.Infof("Worker %d completed job %s successfully", id, job.ID())
+	}
+
+	if cj, ok := job.(CompletableJob); ok {
+		cj.Complete(err)
 	}
+	return p.release(job)
 }
 
-// Submit adds a job to the queue
-func (p *Pool) Submit(job Job) {
+// execute runs job with the pool context, converting a panic into a
+// *PanicError.
+func (p *Pool) execute(job Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			perr := &PanicError{Value: r, Stack: debug.Stack()}
+			p.logger.WithField("stack", string(perr.Stack)).Errorf("Job %s panicked: %v", job.ID(), r)
+			err = perr
+		}
+	}()
+
+	return job.Execute(p.ctx)
+}
+
+// retry resubmits job after delay. Waiting does not occupy a worker, so other
+// jobs keep being processed in the meantime.
+func (p *Pool) retry(job Job, delay time.Duration) {
+	p.retries.Add(1)
+	go func() {
+		defer p.retries.Done()
+
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+
+		select {
+		case <-p.draining:
+			p.abandon(job, "retry pending")
+		case <-timer.C:
+			if err := p.Submit(job); err != nil {
+				p.abandon(job, "retry pending")
+			}
+		}
+	}()
+}
+
+// Submit adds a job to the queue. It blocks while the queue is full and
+// returns ErrPoolStopped when the pool is stopping. It is safe to call
+// concurrently with Stop.
+func (p *Pool) Submit(job Job) error {
+	p.intake.RLock()
+	defer p.intake.RUnlock()
+
+	select {
+	case <-p.draining:
+		p.logger.Warnf("Could not submit job %s: worker pool is shutting down", job.ID())
+		return ErrPoolStopped
+	default:
+	}
+
 	select {
 	case p.jobQueue <- job:
 		p.logger.Infof("Job %s submitted to queue", job.ID())
-	case <-p.ctx.Done():
+		return nil
+	case <-p.draining:
 		p.logger.Warnf("Could not submit job %s: worker pool is shutting down", job.ID())
+		return ErrPoolStopped
 	}
 }
 
-// Stop gracefully shuts down the worker pool
-func (p *Pool) Stop() {
-	p.logger.Info("Stopping worker pool")
-	p.cancel()
-	close(p.jobQueue)
-	p.wg.Wait()
-	p.logger.Info("Worker pool stopped")
-}
-
 // MessageJob is a wrapper that converts a Message to a Job
 type MessageJob struct {
 	message  *messaging.Message
 	handler  messaging.MessageHandler
+	policy   RetryPolicy
+	attempt  int
 	id       string
 	received time.Time
+
+	// timeout bounds each execution, 0 means no limit
+	timeout time.Duration
+
+	// handlerName and deadLetters are set by the QueueWorker to dead-letter
+	// messages that failed for good, consumer to acknowledge the message
+	handlerName string
+	deadLetters *DeadLetterQueue
+	consumer    messaging.Consumer
 }
 
-// NewMessageJob creates a new job from a message
-func NewMessageJob(message *messaging.Message, handler messaging.MessageHandler) *MessageJob {
+// NewMessageJob creates a new job from a message, retried according to policy
+func NewMessageJob(message *messaging.Message, handler messaging.MessageHandler, policy RetryPolicy) *MessageJob {
 	return &MessageJob{
 		message:  message,
 		handler:  handler,
+		policy:   policy,
 		id:       uuid.New().String(),
 		received: time.Now(),
 	}
 }
 
-// Execute processes the message
-func (j *MessageJob) Execute() error {
-	return j.handler(context.Background(), j.message)
+// Execute processes the message. The attempt number is recorded in the
+// message metadata under messaging.MetadataAttempt.
+func (j *MessageJob) Execute(ctx context.Context) error {
+	j.attempt++
+	if j.message.Metadata == nil {
+		j.message.Metadata = make(map[string]string)
+	}
+	j.message.Metadata[messaging.MetadataAttempt] = strconv.Itoa(j.attempt)
+
+	if j.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, j.timeout)
+		defer cancel()
+	}
+
+	return j.handler(ctx, j.message)
+}
+
+// RetryDelay implements RetryableJob. Permanent errors are never retried.
+func (j *MessageJob) RetryDelay(err error) (time.Duration, bool) {
+	if messaging.IsPermanent(err) || j.attempt >= j.policy.MaxAttempts {
+		return 0, false
+	}
+	return j.policy.Backoff(j.attempt), true
+}
+
+// Complete implements CompletableJob. Failed messages are published to the
+// dead-letter queue, if any. The message is acknowledged once it was handled
+// or dead-lettered, and negatively acknowledged when dead-lettering failed so
+// that it is not lost.
+func (j *MessageJob) Complete(err error) {
+	if errors.Is(err, ErrPoolStopped) {
+		j.nack()
+		return
+	}
+	if err != nil && j.deadLetters != nil {
+		if dlqErr := j.deadLetters.Publish(context.Background(), j.message, err, j.handlerName, j.received); dlqErr != nil {
+			logrus.WithError(dlqErr).WithField("message_id", j.message.ID).Error("Failed to publish message to dead-letter topic")
+			j.nack()
+			return
+		}
+	}
+	j.ack()
+}
+
+func (j *MessageJob) ack() {
+	if j.consumer == nil {
+		return
+	}
+	if err := j.consumer.Ack(j.message); err != nil {
+		logrus.WithError(err).WithField("message_id", j.message.ID).Error("Failed to acknowledge message")
+	}
+}
+
+func (j *MessageJob) nack() {
+	if j.consumer == nil {
+		return
+	}
+	if err := j.consumer.Nack(j.message); err != nil {
+		logrus.WithError(err).WithField("message_id", j.message.ID).Error("Failed to negatively acknowledge message")
+	}
+}
+
+// Key implements KeyedJob. Messages are ordered by the "key" metadata, or by
+// partition when they have no key.
+func (j *MessageJob) Key() string {
+	if key := j.message.Metadata[messaging.MetadataKey]; key != "" {
+		return key
+	}
+	if partition, ok := j.message.Metadata[messaging.MetadataPartition]; ok {
+		return j.message.Metadata[messaging.MetadataTopic] + "-" + partition
+	}
+	return ""
 }
 
 // ID returns the job's unique identifier
@@ -135,41 +368,90 @@ type QueueWorker struct {
 	consumer messaging.Consumer
 	logger   *logrus.Logger
 	handlers messaging.HandlerRegistry
-	wg       sync.WaitGroup
-	ctx      context.Context
-	cancel   context.CancelFunc
-}
-
-// WorkerOptions contains options for creating a queue worker
-type WorkerOptions struct {
-	ConsumerType   string
-	ConsumerConfig map[string]interface{}
-	WorkerCount    int
-	QueueSize      int
+	// middlewares wrap every message, typeMiddlewares the messages of a type
+	middlewares     []Middleware
+	typeMiddlewares map[messaging.MessageType][]Middleware
+	// retryPolicies and timeouts override the configured settings per
+	// message type
+	retryPolicies map[messaging.MessageType]RetryPolicy
+	timeouts      map[messaging.MessageType]time.Duration
+	// settings holds the configured settings, see SetConfig
+	settings atomic.Pointer[workerSettings]
+	// deadLetters is nil when no dead-letter topic is configured
+	deadLetters *DeadLetterQueue
+	wg          sync.WaitGroup
+	ctx         context.Context
+	cancel      context.CancelFunc
 }
 
 // NewQueueWorker creates a new queue worker
-func NewQueueWorker(options WorkerOptions, registry *messaging.Registry) (*QueueWorker, error) {
+func NewQueueWorker(config *conf.GlobalConfiguration, registry *messaging.Registry) (*QueueWorker, error) {
 	// Create consumer
-	consumer, err := registry.CreateConsumer(options.ConsumerType, options.ConsumerConfig)
+	consumer, err := registry.CreateConsumer(config.Messaging.Type, QueueConfig(&config.Messaging))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create consumer: %w", err)
 	}
 
+	// Create dead-letter queue
+	var deadLetters *DeadLetterQueue
+	if config.Messaging.DeadLetterTopic != "" {
+		producer, err := registry.CreateProducer(config.Messaging.Type, QueueConfig(&config.Messaging))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create dead-letter producer: %w", err)
+		}
+		deadLetters = NewDeadLetterQueue(producer, config.Messaging.DeadLetterTopic)
+	}
+
 	// Create worker pool
-	pool := NewPool(options.WorkerCount, options.QueueSize)
+	pool := NewPool(config.Worker.Count, config.Worker.QueueSize)
+	if config.Worker.Ordered {
+		pool = NewOrderedPool(config.Worker.Count, config.Worker.QueueSize)
+	}
 
 	// Create context
 	ctx, cancel := context.WithCancel(context.Background())
 
-	return &QueueWorker{
-		pool:     pool,
-		consumer: consumer,
-		logger:   logrus.StandardLogger(),
-		handlers: make(messaging.HandlerRegistry),
-		ctx:      ctx,
-		cancel:   cancel,
-	}, nil
+	w := &QueueWorker{
+		pool:            pool,
+		consumer:        consumer,
+		logger:          logrus.StandardLogger(),
+		handlers:        make(messaging.HandlerRegistry),
+		typeMiddlewares: make(map[messaging.MessageType][]Middleware),
+		retryPolicies:   make(map[messaging.MessageType]RetryPolicy),
+		timeouts:        make(map[messaging.MessageType]time.Duration),
+		deadLetters:     deadLetters,
+		ctx:             ctx,
+		cancel:          cancel,
+	}
+	w.SetConfig(config)
+	return w, nil
+}
+
+// workerSettings holds the settings of a QueueWorker that can change while it
+// runs
+type workerSettings struct {
+	retry    RetryPolicy
+	timeout  time.Duration
+	timeouts map[messaging.MessageType]time.Duration
+}
+
+// SetConfig applies the worker settings of config that can change while the
+// worker runs: the default retry policy, the job timeouts and the drain
+// timeout. Messages already received keep the settings they were received
+// with. The other settings, such as the number of workers or the messaging
+// settings, require creating a new QueueWorker.
+func (w *QueueWorker) SetConfig(config *conf.GlobalConfiguration) {
+	settings := &workerSettings{
+		retry:    NewRetryPolicy(&config.Worker.Retry),
+		timeout:  config.Worker.JobTimeout,
+		timeouts: make(map[messaging.MessageType]time.Duration, len(config.Worker.JobTimeouts)),
+	}
+	for msgType, timeout := range config.Worker.JobTimeouts {
+		settings.timeouts[messaging.MessageType(msgType)] = timeout
+	}
+
+	w.settings.Store(settings)
+	w.pool.SetDrainTimeout(config.Worker.DrainTimeout)
 }
 
 // RegisterHandler registers a handler for messages of the specified type
@@ -177,36 +459,116 @@ func (w *QueueWorker) RegisterHandler(msgType messaging.MessageType, handler mes
 	w.handlers[msgType] = handler
 }
 
-// handleMessage is the default message handler
-func (w *QueueWorker) handleMessage(ctx context.Context, msg *messaging.Message) error {
-	w.logger.WithFields(logrus.Fields{
-		"message_id": msg.ID,
-		"source":     msg.Source,
-	}).Info("Processing message")
+// SetRetryPolicy sets the retry policy for messages of the specified type,
+// overriding the policy from the worker configuration
+func (w *QueueWorker) SetRetryPolicy(msgType messaging.MessageType, policy RetryPolicy) {
+	w.retryPolicies[msgType] = policy
+}
+
+// retryPolicy returns the retry policy for messages of the specified type
+func (w *QueueWorker) retryPolicy(msgType messaging.MessageType) RetryPolicy {
+	if policy, ok := w.retryPolicies[msgType]; ok {
+		return policy
+	}
+	return w.settings.Load().retry
+}
+
+// SetTimeout sets the execution deadline of messages of the specified type,
+// overriding the timeout from the worker configuration. A timeout of 0
+// disables the deadline.
+func (w *QueueWorker) SetTimeout(msgType messaging.MessageType, timeout time.Duration) {
+	w.timeouts[msgType] = timeout
+}
+
+// timeout returns the execution deadline of messages of the specified type
+func (w *QueueWorker) timeout(msgType messaging.MessageType) time.Duration {
+	if timeout, ok := w.timeouts[msgType]; ok {
+		return timeout
+	}
+
+	settings := w.settings.Load()
+	if timeout, ok := settings.timeouts[msgType]; ok {
+		return timeout
+	}
+	return settings.timeout
+}
 
-	// Try to parse the message payload
-	var data map[string]interface{}
+// handlerName returns the name of the handler processing messages of the
+// specified type
+func (w *QueueWorker) handlerName(msgType messaging.MessageType) string {
+	if _, ok := w.handlers[msgType]; ok && msgType != "" {
+		return msgType.String()
+	}
+	return "default"
+}
+
+// messageType determines the type of a message from its envelope, without
+// parsing the payload of binary mode messages. Structured mode messages are
+// converted to binary mode, see messaging.ReadEnvelope. Messages without an
+// envelope fall back to the "event_type" or "type" field of their payload.
+func (w *QueueWorker) messageType(msg *messaging.Message) (messaging.MessageType, error) {
+	envelope, ok, err := messaging.ReadEnvelope(msg)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return envelope.Type, nil
+	}
+
+	var data struct {
+		EventType messaging.MessageType `json:"event_type"`
+		Type      messaging.MessageType `json:"type"`
+	}
 	if err := json.Unmarshal(msg.Payload, &data); err != nil {
-		w.logger.WithError(err).Warn("Failed to parse message payload")
-	} else {
-		// Try to determine message type
-		var typeStr string
-		if eventType, ok := data["event_type"].(string); ok {
-			typeStr = eventType
-		} else if msgType, ok := data["type"].(string); ok {
-			typeStr = msgType
-		}
+		return "", err
+	}
 
-		// Find a handler for the message type
-		if typeStr != "" {
-			msgType := messaging.MessageType(typeStr)
-			if handler, ok := w.handlers[msgType]; ok {
-				return handler(ctx, msg)
-			}
+	if data.EventType != "" {
+		return data.EventType, nil
+	}
+	return data.Type, nil
+}
+
+// Use adds middlewares wrapping the handling of every message, including
+// messages without a registered handler. Middlewares run in the order they
+// were added, the first one being the outermost.
+func (w *QueueWorker) Use(middlewares ...Middleware) {
+	w.middlewares = append(w.middlewares, middlewares...)
+}
+
+// UseFor adds middlewares wrapping the handler of messages of the specified
+// type. They run inside the middlewares added with Use.
+func (w *QueueWorker) UseFor(msgType messaging.MessageType, middlewares ...Middleware) {
+	w.typeMiddlewares[msgType] = append(w.typeMiddlewares[msgType], middlewares...)
+}
+
+// handleMessage dispatches a message to the handler of its type, wrapped by
+// the middlewares. The type is available to the middlewares and handlers
+// with MessageTypeFromContext.
+func (w *QueueWorker) handleMessage(ctx context.Context, msg *messaging.Message) error {
+	msgType, err := w.messageType(msg)
+	handler := w.route(msgType, err)
+	return chain(handler, w.middlewares)(withMessageType(ctx, msgType), msg)
+}
+
+// route returns the handler of messages of the specified type, wrapped by
+// the middlewares of the type
+func (w *QueueWorker) route(msgType messaging.MessageType, parseErr error) messaging.MessageHandler {
+	if parseErr != nil {
+		err := messaging.Permanent(fmt.Errorf("failed to parse message payload: %w", parseErr))
+		return func(context.Context, *messaging.Message) error {
+			return err
 		}
 	}
 
-	// Use default processing
+	if handler, ok := w.handlers[msgType]; ok && msgType != "" {
+		return chain(handler, w.typeMiddlewares[msgType])
+	}
+	return w.defaultHandler
+}
+
+// defaultHandler processes the messages without a registered handler
+func (w *QueueWorker) defaultHandler(ctx context.Context, msg *messaging.Message) error {
 	w.logger.WithFields(logrus.Fields{
 		"message_id": msg.ID,
 		"payload":    string(msg.Payload),
@@ -222,13 +584,18 @@ func (w *QueueWorker) Start() error {
 
 	// Subscribe to consumer
 	err := w.consumer.Subscribe(func(ctx context.Context, msg *messaging.Message) error {
-		// Create a job from the message
-		job := NewMessageJob(msg, w.handleMessage)
-
-		// Submit the job to the worker pool
-		w.pool.Submit(job)
-
-		return nil
+		// Create a job from the message, retried according to its type
+		msgType, _ := w.messageType(msg)
+		job := NewMessageJob(msg, w.handleMessage, w.retryPolicy(msgType))
+		job.timeout = w.timeout(msgType)
+		job.handlerName = w.handlerName(msgType)
+		job.deadLetters = w.deadLetters
+		job.consumer = w.consumer
+
+		// Submit the job to the worker pool. The message is acknowledged by
+		// the job once it completes, the consumer redelivers it when it is
+		// not accepted.
+		return w.pool.Submit(job)
 	})
 
 	if err != nil {
@@ -249,23 +616,32 @@ func (w *QueueWorker) Start() error {
 	return nil
 }
 
-// Stop stops the queue worker
+// Stop stops the queue worker. The messages that are already queued are
+// drained as described by Pool.Stop, unfinished messages are negatively
+// acknowledged and reported by the returned *DrainError.
 func (w *QueueWorker) Stop() error {
 	w.logger.Info("Stopping queue worker")
+
+	// Stop consuming new messages
 	w.cancel()
 
+	// Drain the worker pool while the consumer can still acknowledge
+	drainErr := w.pool.Stop()
+
 	// Stop the consumer
-	err := w.consumer.Stop()
-	if err != nil {
+	if err := w.consumer.Stop(); err != nil {
 		w.logger.WithError(err).Error("Failed to stop consumer")
 	}
 
-	// Stop the worker pool
-	w.pool.Stop()
-
 	// Wait for everything to finish
 	w.wg.Wait()
 
+	if w.deadLetters != nil {
+		if err := w.deadLetters.Close(); err != nil {
+			w.logger.WithError(err).Error("Failed to close dead-letter producer")
+		}
+	}
+
 	w.logger.Info("Queue worker stopped")
-	return nil
+	return drainErr
 }
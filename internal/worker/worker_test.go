@@ -0,0 +1,86 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// retryingJob is a testJob retried up to retries times
+type retryingJob struct {
+	*testJob
+	retries int32
+	retried atomic.Int32
+}
+
+func (j *retryingJob) RetryDelay(err error) (time.Duration, bool) {
+	return time.Millisecond, j.retried.Add(1) <= j.retries
+}
+
+// waitCompleted waits for the job to be completed and returns the errors it
+// was completed with
+func waitCompleted(t *testing.T, results *completions, id string) []error {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if errs := results.get(id); len(errs) > 0 {
+			return errs
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("job %s was not completed", id)
+	return nil
+}
+
+func TestPoolRecoversJobPanic(t *testing.T) {
+	results := newCompletions()
+	p := newTestPool(t, 1, 10, time.Second)
+	defer func() {
+		if err := p.Stop(); err != nil {
+			t.Errorf("Stop: %v", err)
+		}
+	}()
+
+	// A job that keeps panicking is completed with a *PanicError holding
+	// the stack of the panic
+	panicking := &testJob{id: "panicking", results: results, execute: func(context.Context) error {
+		panic("job failed")
+	}}
+	if err := p.Submit(panicking); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	errs := waitCompleted(t, results, panicking.id)
+	var perr *PanicError
+	if len(errs) != 1 || !errors.As(errs[0], &perr) {
+		t.Fatalf("job was completed with %v, want a *PanicError once", errs)
+	}
+	if perr.Value != "job failed" {
+		t.Errorf("panic value is %v, want job failed", perr.Value)
+	}
+	if !strings.Contains(string(perr.Stack), "TestPoolRecoversJobPanic") {
+		t.Errorf("panic stack does not hold the panicking function:\n%s", perr.Stack)
+	}
+
+	// A panic is retried like any other error, by the same worker which
+	// survived the panic
+	var attempts atomic.Int32
+	retried := &retryingJob{retries: 1, testJob: &testJob{id: "retried", results: results, execute: func(context.Context) error {
+		if attempts.Add(1) == 1 {
+			panic("first attempt failed")
+		}
+		return nil
+	}}}
+	if err := p.Submit(retried); err != nil {
+		t.Fatalf("Submit: %v", err)
+	}
+	if errs := waitCompleted(t, results, retried.id); len(errs) != 1 || errs[0] != nil {
+		t.Errorf("retried job was completed with %v, want nil once", errs)
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("retried job was executed %d times, want 2", n)
+	}
+}
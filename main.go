@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"os"
 	"os/signal"
 	"sync"
 	"syscall"
@@ -16,7 +17,7 @@ func init() {
 }
 
 func main() {
-	execCtx, execCancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGHUP, syscall.SIGINT)
+	execCtx, execCancel := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
 	defer execCancel()
 
 	go func() {
@@ -24,6 +25,23 @@ func main() {
 		logrus.Info("received graceful shutdown signal")
 	}()
 
+	// SIGHUP reloads the configuration instead of shutting down
+	reloadCh := make(chan os.Signal, 1)
+	signal.Notify(reloadCh, syscall.SIGHUP)
+	defer signal.Stop(reloadCh)
+
+	go func() {
+		for {
+			select {
+			case <-execCtx.Done():
+				return
+			case <-reloadCh:
+				logrus.Info("received configuration reload signal")
+				cmd.Reload()
+			}
+		}
+	}()
+
 	// command is expected to obey the cancellation signal on execCtx and
 	// block while it is running
 	if err := cmd.RootCommand().ExecuteContext(execCtx); err != nil {
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS outbox (
+	id bigserial PRIMARY KEY,
+	message_id text NOT NULL UNIQUE,
+	topic text NOT NULL,
+	aggregate_key text NOT NULL DEFAULT '',
+	payload bytea NOT NULL,
+	metadata jsonb NOT NULL DEFAULT '{}',
+	status text NOT NULL DEFAULT 'pending',
+	attempts integer NOT NULL DEFAULT 0,
+	last_error text NULL,
+	available_at timestamptz NOT NULL DEFAULT now(),
+	created_at timestamptz NOT NULL DEFAULT now(),
+	sent_at timestamptz NULL
+);
+
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (aggregate_key, id) WHERE status = 'pending';
@@ -0,0 +1,27 @@
+CREATE TABLE IF NOT EXISTS jobs (
+	id bigserial PRIMARY KEY,
+	message_id text NOT NULL,
+	topic text NOT NULL,
+	key text NOT NULL DEFAULT '',
+	payload bytea NOT NULL,
+	metadata jsonb NOT NULL DEFAULT '{}',
+	attempts integer NOT NULL DEFAULT 0,
+	run_at timestamptz NOT NULL DEFAULT now(),
+	locked_by text NULL,
+	locked_until timestamptz NULL,
+	created_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS jobs_due_idx ON jobs (topic, run_at, id);
+CREATE INDEX IF NOT EXISTS jobs_key_idx ON jobs (topic, key, id) WHERE key <> '';
+
+CREATE OR REPLACE FUNCTION notify_jobs() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_notify('jobs', NEW.topic);
+	RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS jobs_notify ON jobs;
+CREATE TRIGGER jobs_notify AFTER INSERT ON jobs
+	FOR EACH ROW EXECUTE FUNCTION notify_jobs();
@@ -0,0 +1,184 @@
+package kafka
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/trranminhquang/go-boilerplate/pkg/messaging"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// Default settings of the configuration keys that are optional
+const (
+	DefaultClientID           = "go-boilerplate"
+	DefaultCommitInterval     = time.Second
+	DefaultRedeliveryDelay    = time.Second
+	DefaultMaxRedeliveryDelay = time.Minute
+)
+
+// ConsumerConfig defines configuration for Kafka consumer
+type ConsumerConfig struct {
+	Brokers       []string
+	Topics        []string
+	GroupID       string
+	InitialOffset string // "earliest" or "latest"
+	ClientID      string
+	// CommitInterval is how often the offsets of the acknowledged messages
+	// are committed
+	CommitInterval time.Duration
+	// RedeliveryDelay and MaxRedeliveryDelay bound the backoff before a
+	// partition is consumed again from a message that was not acknowledged
+	RedeliveryDelay    time.Duration
+	MaxRedeliveryDelay time.Duration
+	// Browse consumers read every partition of the topics directly, without
+	// joining a consumer group, e.g. to list the messages of a topic. They
+	// need no GroupID, and Ack and Nack have no effect.
+	Browse bool
+}
+
+// ProducerConfig defines configuration for Kafka producer
+type ProducerConfig struct {
+	Brokers  []string
+	ClientID string
+	// Acks is "all", "leader" or "none"
+	Acks       string
+	Idempotent bool
+	// Compression is "none", "gzip", "snappy", "lz4" or "zstd"
+	Compression   string
+	Linger        time.Duration
+	BatchMaxBytes int
+}
+
+// parseConsumerConfig extracts the consumer configuration from the map
+// passed to the factory
+func parseConsumerConfig(config map[string]interface{}) (ConsumerConfig, error) {
+	cfg := ConsumerConfig{
+		InitialOffset:      "latest",
+		ClientID:           DefaultClientID,
+		CommitInterval:     DefaultCommitInterval,
+		RedeliveryDelay:    DefaultRedeliveryDelay,
+		MaxRedeliveryDelay: DefaultMaxRedeliveryDelay,
+	}
+
+	var err error
+	if cfg.Brokers, err = messaging.StringsOption(config, "brokers"); err != nil {
+		return cfg, err
+	}
+	if cfg.Topics, err = messaging.StringsOption(config, "topics"); err != nil {
+		return cfg, err
+	}
+
+	if err := messaging.BoolOption(config, "browse", &cfg.Browse); err != nil {
+		return cfg, err
+	}
+
+	// Extract group ID, which browse consumers don't need
+	if groupID, ok := config["group_id"].(string); ok && groupID != "" {
+		cfg.GroupID = groupID
+	} else if !cfg.Browse {
+		return cfg, fmt.Errorf("%w: group_id must be a string", messaging.ErrInvalidConfig)
+	}
+
+	if err := messaging.StringOption(config, "initial_offset", &cfg.InitialOffset, "earliest", "latest"); err != nil {
+		return cfg, err
+	}
+	if err := messaging.StringOption(config, "client_id", &cfg.ClientID); err != nil {
+		return cfg, err
+	}
+	if err := messaging.DurationOption(config, "commit_interval", &cfg.CommitInterval); err != nil {
+		return cfg, err
+	}
+	if cfg.CommitInterval <= 0 {
+		return cfg, fmt.Errorf("%w: commit_interval must be positive", messaging.ErrInvalidConfig)
+	}
+	if err := messaging.DurationOption(config, "redelivery_delay", &cfg.RedeliveryDelay); err != nil {
+		return cfg, err
+	}
+	if err := messaging.DurationOption(config, "max_redelivery_delay", &cfg.MaxRedeliveryDelay); err != nil {
+		return cfg, err
+	}
+	if cfg.RedeliveryDelay <= 0 || cfg.MaxRedeliveryDelay < cfg.RedeliveryDelay {
+		return cfg, fmt.Errorf("%w: redelivery_delay must be positive and at most max_redelivery_delay", messaging.ErrInvalidConfig)
+	}
+	return cfg, nil
+}
+
+// parseProducerConfig extracts the producer configuration from the map
+// passed to the factory
+func parseProducerConfig(config map[string]interface{}) (ProducerConfig, error) {
+	cfg := ProducerConfig{
+		ClientID:    DefaultClientID,
+		Acks:        "all",
+		Idempotent:  true,
+		Compression: "snappy",
+	}
+
+	var err error
+	if cfg.Brokers, err = messaging.StringsOption(config, "brokers"); err != nil {
+		return cfg, err
+	}
+
+	if err := messaging.StringOption(config, "client_id", &cfg.ClientID); err != nil {
+		return cfg, err
+	}
+	if err := messaging.StringOption(config, "acks", &cfg.Acks, "all", "leader", "none"); err != nil {
+		return cfg, err
+	}
+	if err := messaging.BoolOption(config, "idempotent", &cfg.Idempotent); err != nil {
+		return cfg, err
+	}
+	if cfg.Idempotent && cfg.Acks != "all" {
+		return cfg, fmt.Errorf("%w: idempotent requires acks to be all", messaging.ErrInvalidConfig)
+	}
+	if err := messaging.StringOption(config, "compression", &cfg.Compression, "none", "gzip", "snappy", "lz4", "zstd"); err != nil {
+		return cfg, err
+	}
+	if err := messaging.DurationOption(config, "linger", &cfg.Linger); err != nil {
+		return cfg, err
+	}
+	if err := messaging.IntOption(config, "batch_max_bytes", &cfg.BatchMaxBytes); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// options returns the client options of the producer
+func (cfg ProducerConfig) options() []kgo.Opt {
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.Brokers...),
+		kgo.ClientID(cfg.ClientID),
+		kgo.ProducerBatchCompression(compressionCodec(cfg.Compression)),
+		kgo.ProducerLinger(cfg.Linger),
+	}
+
+	switch cfg.Acks {
+	case "leader":
+		opts = append(opts, kgo.RequiredAcks(kgo.LeaderAck()))
+	case "none":
+		opts = append(opts, kgo.RequiredAcks(kgo.NoAck()))
+	default:
+		opts = append(opts, kgo.RequiredAcks(kgo.AllISRAcks()))
+	}
+	if !cfg.Idempotent {
+		opts = append(opts, kgo.DisableIdempotentWrite())
+	}
+	if cfg.BatchMaxBytes > 0 {
+		opts = append(opts, kgo.ProducerBatchMaxBytes(int32(cfg.BatchMaxBytes)))
+	}
+	return opts
+}
+
+func compressionCodec(name string) kgo.CompressionCodec {
+	switch name {
+	case "gzip":
+		return kgo.GzipCompression()
+	case "snappy":
+		return kgo.SnappyCompression()
+	case "lz4":
+		return kgo.Lz4Compression()
+	case "zstd":
+		return kgo.ZstdCompression()
+	default:
+		return kgo.NoCompression()
+	}
+}
@@ -2,156 +2,548 @@ package kafka
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"strings"
+	"sort"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/trranminhquang/go-boilerplate/pkg/messaging"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
 )
 
-// Consumer implements the messaging.Consumer interface for Kafka
+// closeTimeout bounds the final offset commit of a consumer and the flush of
+// the buffered messages of a producer
+const closeTimeout = 10 * time.Second
+
+// Consumer implements the messaging.Consumer interface for Kafka. It joins
+// the consumer group of its configuration, and commits the offset of a
+// partition once every message up to it was acknowledged.
+//
+// A message that is not acknowledged pauses its partition, which is consumed
+// again from that message once a backoff elapsed. Messages are therefore
+// delivered in order per partition, and those following a negatively
+// acknowledged message are delivered again.
 type Consumer struct {
-	topics        []string
-	brokers       []string
-	groupID       string
-	handler       messaging.MessageHandler
-	ctx           context.Context
-	cancel        context.CancelFunc
-	wg            sync.WaitGroup
-	logger        *logrus.Logger
-	consumerReady chan bool
-}
-
-// ConsumerConfig defines configuration for Kafka consumer
-type ConsumerConfig struct {
-	Brokers       []string
-	Topics        []string
-	GroupID       string
-	InitialOffset string // "earliest" or "latest"
-}
-
-// NewConsumer creates a new Kafka consumer
-// Note: In a real implementation, you would use an actual Kafka client library
-// like github.com/Shopify/sarama or github.com/confluentinc/confluent-kafka-go
-func NewConsumer(config map[string]interface{}) (messaging.Consumer, error) {
-	// Parse configuration
-	cfg := ConsumerConfig{}
-
-	// Extract brokers
-	if brokers, ok := config["brokers"].([]string); ok {
-		cfg.Brokers = brokers
-	} else if brokersStr, ok := config["brokers"].(string); ok {
-		cfg.Brokers = strings.Split(brokersStr, ",")
-	} else {
-		return nil, fmt.Errorf("%w: brokers must be a string or []string", messaging.ErrInvalidConfig)
-	}
+	config  ConsumerConfig
+	client  *kgo.Client
+	handler messaging.MessageHandler
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	logger  *logrus.Logger
 
-	// Extract topics
-	if topics, ok := config["topics"].([]string); ok {
-		cfg.Topics = topics
-	} else if topicsStr, ok := config["topics"].(string); ok {
-		cfg.Topics = strings.Split(topicsStr, ",")
-	} else {
-		return nil, fmt.Errorf("%w: topics must be a string or []string", messaging.ErrInvalidConfig)
-	}
+	// offsets tracks the messages in flight
+	offsets *messaging.OffsetTracker
+
+	// commits holds the offsets to commit with the next commit, assigned
+	// the partitions currently assigned to the consumer, rewinds the
+	// partitions to consume again from a message that was not acknowledged
+	mu       sync.Mutex
+	commits  map[messaging.TopicPartition]int64
+	assigned map[messaging.TopicPartition]bool
+	rewinds  map[messaging.TopicPartition]*rewind
+	// interrupt ends the poll in progress, so that a new rewind is
+	// scheduled
+	interrupt context.CancelFunc
+
+	// commitMu serializes commits and seeks, which the client does not
+	// support concurrently
+	commitMu sync.Mutex
+}
 
-	// Extract group ID
-	if groupID, ok := config["group_id"].(string); ok {
-		cfg.GroupID = groupID
-	} else {
-		return nil, fmt.Errorf("%w: group_id must be a string", messaging.ErrInvalidConfig)
+// rewind is a partition to consume again from a message that was not
+// acknowledged
+type rewind struct {
+	offset int64
+	// attempts counts the rewinds to offset, for the backoff
+	attempts int
+	// due is when to seek back to offset, it is zero once the partition
+	// was sought
+	due time.Time
+}
+
+// NewConsumer creates a new Kafka consumer. The configuration holds the
+// brokers, topics and group_id of the consumer, and optionally its
+// initial_offset ("earliest" or "latest", the default), client_id,
+// commit_interval, redelivery_delay, max_redelivery_delay and browse mode.
+func NewConsumer(config map[string]interface{}) (messaging.Consumer, error) {
+	cfg, err := parseConsumerConfig(config)
+	if err != nil {
+		return nil, err
 	}
 
 	// Create context
 	ctx, cancel := context.WithCancel(context.Background())
 
 	return &Consumer{
-		topics:        cfg.Topics,
-		brokers:       cfg.Brokers,
-		groupID:       cfg.GroupID,
-		ctx:           ctx,
-		cancel:        cancel,
-		logger:        logrus.StandardLogger(),
-		consumerReady: make(chan bool),
+		config:   cfg,
+		ctx:      ctx,
+		cancel:   cancel,
+		logger:   logrus.StandardLogger(),
+		offsets:  messaging.NewOffsetTracker(),
+		commits:  make(map[messaging.TopicPartition]int64),
+		assigned: make(map[messaging.TopicPartition]bool),
+		rewinds:  make(map[messaging.TopicPartition]*rewind),
 	}, nil
 }
 
-// Start begins consuming messages from Kafka
+// Start joins the consumer group and begins consuming messages from the
+// partitions assigned to the consumer. Browse consumers consume every
+// partition of their topics from the initial offset instead.
 func (c *Consumer) Start(ctx context.Context) error {
 	if c.handler == nil {
 		return messaging.ErrHandlerNotSet
 	}
 
 	c.logger.WithFields(logrus.Fields{
-		"brokers": c.brokers,
-		"topics":  c.topics,
-		"groupID": c.groupID,
+		"brokers": c.config.Brokers,
+		"topics":  c.config.Topics,
+		"groupID": c.config.GroupID,
 	}).Info("Starting Kafka consumer")
 
-	// In a real implementation, you would configure a Kafka client here
+	resetOffset := kgo.NewOffset().AtEnd()
+	if c.config.InitialOffset == "earliest" {
+		resetOffset = kgo.NewOffset().AtStart()
+	}
+
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(c.config.Brokers...),
+		kgo.ClientID(c.config.ClientID),
+		kgo.ConsumeTopics(c.config.Topics...),
+		kgo.ConsumeResetOffset(resetOffset),
+	}
+	if !c.config.Browse {
+		opts = append(opts,
+			kgo.ConsumerGroup(c.config.GroupID),
+			kgo.DisableAutoCommit(),
+			// Rebalances wait while a poll seeks partitions back
+			kgo.BlockRebalanceOnPoll(),
+			kgo.OnPartitionsAssigned(c.onAssigned),
+			kgo.OnPartitionsRevoked(c.onRevoked),
+			kgo.OnPartitionsLost(c.onLost),
+		)
+	}
+
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create Kafka client: %w", err)
+	}
+	c.client = client
+
+	// Stop consuming when either the context or the consumer is done
+	ctx, cancel := context.WithCancel(ctx)
+	context.AfterFunc(c.ctx, cancel)
 
-	// Start a goroutine to handle message consumption
 	c.wg.Add(1)
 	go func() {
 		defer c.wg.Done()
+		c.poll(ctx)
+	}()
 
-		// Signal that the consumer is ready
-		close(c.consumerReady)
-
+	if c.config.Browse {
 		c.logger.Info("Kafka consumer is ready")
+		return nil
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.commitLoop(ctx)
+	}()
 
-		// Simulated message processing loop
-		ticker := time.NewTicker(5 * time.Second)
-		defer ticker.Stop()
+	c.logger.Info("Kafka consumer is ready")
+	return nil
+}
 
-		for {
-			select {
-			case <-ctx.Done():
-				c.logger.Info("Context canceled, stopping Kafka consumer")
+// poll fetches messages and passes them to the handler, in order per
+// partition. Between polls it seeks the partitions whose rewind is due.
+func (c *Consumer) poll(ctx context.Context) {
+	for {
+		pollCtx, cancel := c.pollContext(ctx)
+		fetches := c.client.PollFetches(pollCtx)
+		cancel()
+		if fetches.IsClientClosed() || ctx.Err() != nil {
+			c.client.AllowRebalance()
+			c.logger.Info("Context canceled, stopping Kafka consumer")
+			return
+		}
+
+		sought := c.seek()
+		c.client.AllowRebalance()
+
+		fetches.EachError(func(topic string, partition int32, err error) {
+			if pollCtx.Err() != nil && errors.Is(err, pollCtx.Err()) {
 				return
-			case <-ticker.C:
-				// Simulate receiving a message
-				msg := &messaging.Message{
-					ID:      fmt.Sprintf("msg-%d", time.Now().Unix()),
-					Payload: []byte(`{"event_type": "test_event", "data": {"key": "value"}}`),
-					Source:  fmt.Sprintf("%s-%d", c.topics[0], 0),
-					Metadata: map[string]string{
-						"topic":     c.topics[0],
-						"partition": "0",
-						"offset":    fmt.Sprintf("%d", time.Now().Unix()),
-					},
-				}
+			}
+			c.logger.WithError(err).WithFields(logrus.Fields{
+				"topic":     topic,
+				"partition": partition,
+			}).Error("Failed to fetch messages")
+		})
+
+		fetches.EachRecord(func(r *kgo.Record) {
+			tp := messaging.TopicPartition{Topic: r.Topic, Partition: r.Partition}
+			if ctx.Err() != nil || sought[tp] || c.rewinding(tp, r.Offset) {
+				return
+			}
+			if !c.config.Browse {
+				c.offsets.Track(tp, r.Offset)
+			}
+			c.deliver(ctx, message(r))
+		})
+	}
+}
 
-				// Process the message
-				err := c.handler(ctx, msg)
-				if err != nil {
-					c.logger.WithError(err).WithFields(logrus.Fields{
-						"messageID": msg.ID,
-						"source":    msg.Source,
-					}).Error("Failed to process message")
-				} else {
-					c.logger.WithFields(logrus.Fields{
-						"messageID": msg.ID,
-						"source":    msg.Source,
-					}).Info("Successfully processed message")
+// pollContext returns the context of the next poll, which ends when the
+// next rewind is due or a new one is scheduled
+func (c *Consumer) pollContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var next time.Time
+	for _, rw := range c.rewinds {
+		if !rw.due.IsZero() && (next.IsZero() || rw.due.Before(next)) {
+			next = rw.due
+		}
+	}
+
+	var cancel context.CancelFunc
+	if next.IsZero() {
+		ctx, cancel = context.WithCancel(ctx)
+	} else {
+		ctx, cancel = context.WithDeadline(ctx, next)
+	}
+	c.interrupt = cancel
+	return ctx, cancel
+}
+
+// seek moves the partitions whose rewind is due back to the message that was
+// not acknowledged and resumes fetching them. It returns the partitions that
+// were sought, whose messages fetched so far must be dropped.
+func (c *Consumer) seek() map[messaging.TopicPartition]bool {
+	now := time.Now()
+	sought := make(map[messaging.TopicPartition]bool)
+	offsets := make(map[string]map[int32]kgo.EpochOffset)
+	resume := make(map[string][]int32)
+
+	c.mu.Lock()
+	for tp, rw := range c.rewinds {
+		if rw.due.IsZero() || rw.due.After(now) {
+			continue
+		}
+		rw.due = time.Time{}
+
+		sought[tp] = true
+		if offsets[tp.Topic] == nil {
+			offsets[tp.Topic] = make(map[int32]kgo.EpochOffset)
+		}
+		offsets[tp.Topic][tp.Partition] = kgo.EpochOffset{Epoch: -1, Offset: rw.offset}
+		resume[tp.Topic] = append(resume[tp.Topic], tp.Partition)
+
+		c.logger.WithFields(logrus.Fields{
+			"partition": tp.String(),
+			"offset":    rw.offset,
+			"attempt":   rw.attempts,
+		}).Info("Consuming partition again from unacknowledged message")
+	}
+	c.mu.Unlock()
+
+	if len(sought) == 0 {
+		return nil
+	}
+
+	c.commitMu.Lock()
+	c.client.SetOffsets(offsets)
+	c.commitMu.Unlock()
+	c.client.ResumeFetchPartitions(resume)
+	return sought
+}
+
+// rewinding reports whether the message at offset of a partition waits for
+// the partition to be consumed again from an earlier message
+func (c *Consumer) rewinding(tp messaging.TopicPartition, offset int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	rw, ok := c.rewinds[tp]
+	return ok && !rw.due.IsZero() && offset >= rw.offset
+}
+
+// redeliveryDelay returns the backoff before the attempt-th rewind to the
+// same message
+func (c *Consumer) redeliveryDelay(attempt int) time.Duration {
+	delay := c.config.RedeliveryDelay
+	for i := 1; i < attempt && delay < c.config.MaxRedeliveryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, c.config.MaxRedeliveryDelay)
+}
+
+// deliver passes msg to the handler. Messages the handler does not accept are
+// delivered again.
+func (c *Consumer) deliver(ctx context.Context, msg *messaging.Message) {
+	if err := c.handler(ctx, msg); err != nil {
+		c.logger.WithError(err).WithFields(logrus.Fields{
+			"messageID": msg.ID,
+			"source":    msg.Source,
+		}).Error("Failed to process message")
+
+		if err := c.Nack(msg); err != nil {
+			c.logger.WithError(err).Error("Failed to nack message")
+		}
+		return
+	}
+
+	c.logger.WithFields(logrus.Fields{
+		"messageID": msg.ID,
+		"source":    msg.Source,
+	}).Debug("Message accepted by handler")
+}
+
+// message converts a Kafka record to a message. The record headers become
+// the metadata of the message, along with its key and position.
+func message(r *kgo.Record) *messaging.Message {
+	metadata := make(map[string]string, len(r.Headers)+4)
+	for _, h := range r.Headers {
+		metadata[h.Key] = string(h.Value)
+	}
+	if len(r.Key) > 0 {
+		metadata[messaging.MetadataKey] = string(r.Key)
+	}
+	metadata[messaging.MetadataTopic] = r.Topic
+	metadata[messaging.MetadataPartition] = strconv.FormatInt(int64(r.Partition), 10)
+	metadata[messaging.MetadataOffset] = strconv.FormatInt(r.Offset, 10)
+
+	tp := messaging.TopicPartition{Topic: r.Topic, Partition: r.Partition}
+	return &messaging.Message{
+		ID:       messaging.PositionMessageID(metadata, tp, r.Offset),
+		Payload:  r.Value,
+		Metadata: metadata,
+		Source:   tp.String(),
+	}
+}
+
+// commitLoop commits the offsets of the acknowledged messages periodically
+func (c *Consumer) commitLoop(ctx context.Context) {
+	ticker := time.NewTicker(c.config.CommitInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.commit(ctx)
+		}
+	}
+}
+
+// commit commits the pending offsets. Offsets that could not be committed
+// are retried with the next commit.
+func (c *Consumer) commit(ctx context.Context) {
+	c.mu.Lock()
+	pending := c.commits
+	c.commits = make(map[messaging.TopicPartition]int64)
+	c.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	offsets := make(map[string]map[int32]kgo.EpochOffset)
+	for tp, offset := range pending {
+		if offsets[tp.Topic] == nil {
+			offsets[tp.Topic] = make(map[int32]kgo.EpochOffset)
+		}
+		offsets[tp.Topic][tp.Partition] = kgo.EpochOffset{Epoch: -1, Offset: offset}
+	}
+
+	var commitErr error
+	c.commitMu.Lock()
+	defer c.commitMu.Unlock()
+	c.client.CommitOffsetsSync(ctx, offsets, func(_ *kgo.Client, _ *kmsg.OffsetCommitRequest, resp *kmsg.OffsetCommitResponse, err error) {
+		if err != nil {
+			commitErr = err
+			return
+		}
+		for _, topic := range resp.Topics {
+			for _, partition := range topic.Partitions {
+				if err := kerr.ErrorForCode(partition.ErrorCode); err != nil {
+					commitErr = err
 				}
 			}
 		}
-	}()
+	})
+
+	if commitErr != nil {
+		c.logger.WithError(commitErr).WithField("groupID", c.config.GroupID).Error("Failed to commit offsets")
+
+		c.mu.Lock()
+		for tp, offset := range pending {
+			if _, ok := c.commits[tp]; !ok && c.assigned[tp] {
+				c.commits[tp] = offset
+			}
+		}
+		c.mu.Unlock()
+		return
+	}
+
+	for tp, offset := range pending {
+		c.logger.WithFields(logrus.Fields{
+			"partition": tp.String(),
+			"offset":    offset,
+			"groupID":   c.config.GroupID,
+		}).Debug("Committed offset")
+	}
+}
+
+// onAssigned records the partitions assigned to the consumer by a rebalance
+func (c *Consumer) onAssigned(_ context.Context, _ *kgo.Client, assigned map[string][]int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for topic, partitions := range assigned {
+		for _, partition := range partitions {
+			c.assigned[messaging.TopicPartition{Topic: topic, Partition: partition}] = true
+		}
+	}
+	c.logger.WithField("partitions", assigned).Info("Kafka partitions assigned")
+}
+
+// onRevoked commits the offsets of the acknowledged messages before the
+// partitions are assigned to another consumer, which delivers the messages
+// still in flight again
+func (c *Consumer) onRevoked(ctx context.Context, _ *kgo.Client, revoked map[string][]int32) {
+	c.commit(ctx)
+	c.unassign(revoked)
+	c.logger.WithField("partitions", revoked).Info("Kafka partitions revoked")
+}
+
+// onLost forgets partitions that were lost, e.g. because the consumer was
+// evicted from the group. Their offsets can no longer be committed.
+func (c *Consumer) onLost(_ context.Context, _ *kgo.Client, lost map[string][]int32) {
+	c.unassign(lost)
+	c.logger.WithField("partitions", lost).Warn("Kafka partitions lost")
+}
+
+// unassign forgets the messages in flight, the pending offsets and the
+// rewinds of the partitions. Partitions paused for a rewind are resumed, in
+// case they are assigned to the consumer again.
+func (c *Consumer) unassign(partitions map[string][]int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	resume := make(map[string][]int32)
+	for topic, ps := range partitions {
+		for _, partition := range ps {
+			tp := messaging.TopicPartition{Topic: topic, Partition: partition}
+			if rw, ok := c.rewinds[tp]; ok && !rw.due.IsZero() {
+				resume[topic] = append(resume[topic], partition)
+			}
+			delete(c.assigned, tp)
+			delete(c.commits, tp)
+			delete(c.rewinds, tp)
+			c.offsets.Revoke(tp)
+		}
+	}
+	if len(resume) > 0 {
+		c.client.ResumeFetchPartitions(resume)
+	}
+}
+
+// Ack marks a message as handled. The offset of its partition is committed
+// with the next commit once all earlier messages were acknowledged.
+func (c *Consumer) Ack(msg *messaging.Message) error {
+	if c.config.Browse {
+		return nil
+	}
+
+	tp, offset, err := messaging.MessagePosition(msg)
+	if err != nil {
+		return err
+	}
+
+	if commit, ok := c.offsets.Done(tp, offset); ok {
+		c.mu.Lock()
+		if c.assigned[tp] && commit > c.commits[tp] {
+			c.commits[tp] = commit
+		}
+		// The backoff restarts once the message was handled
+		if rw, ok := c.rewinds[tp]; ok && rw.due.IsZero() && commit > rw.offset {
+			delete(c.rewinds, tp)
+		}
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// Nack marks a message as not handled. Its offset is not committed, and its
+// partition is paused and consumed again from the message once the backoff
+// elapsed. The backoff doubles every time the same message is not
+// acknowledged. Messages of partitions that were assigned to another
+// consumer are delivered again by that consumer.
+func (c *Consumer) Nack(msg *messaging.Message) error {
+	if c.config.Browse {
+		return nil
+	}
+
+	tp, offset, err := messaging.MessagePosition(msg)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	// Wait for the consumer to be ready
-	<-c.consumerReady
+	if !c.assigned[tp] {
+		return nil
+	}
+
+	rw, ok := c.rewinds[tp]
+	if ok && !rw.due.IsZero() {
+		// A rewind is already scheduled, it redelivers the message
+		// unless it is earlier than the rewind offset
+		if offset < rw.offset {
+			c.offsets.Rewind(tp, offset)
+			rw.offset = offset
+		}
+		return nil
+	}
+	if !ok || rw.offset != offset {
+		rw = &rewind{offset: offset}
+		c.rewinds[tp] = rw
+	}
+	rw.attempts++
+	rw.due = time.Now().Add(c.redeliveryDelay(rw.attempts))
+
+	c.offsets.Rewind(tp, offset)
+	c.client.PauseFetchPartitions(map[string][]int32{tp.Topic: {tp.Partition}})
+	if c.interrupt != nil {
+		c.interrupt()
+	}
 	return nil
 }
 
-// Stop gracefully stops consuming messages
+// Stop stops consuming messages, commits the offsets of the acknowledged
+// messages and leaves the consumer group
 func (c *Consumer) Stop() error {
 	c.logger.Info("Stopping Kafka consumer")
 	c.cancel()
 	c.wg.Wait()
+
+	if c.client != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+		defer cancel()
+
+		c.commit(ctx)
+		c.client.Close()
+	}
+
 	c.logger.Info("Kafka consumer stopped")
 	return nil
 }
@@ -167,72 +559,82 @@ func (c *Consumer) Name() string {
 	return "kafka"
 }
 
-// Producer implements the messaging.Producer interface for Kafka
+// Producer implements the messaging.Producer interface for Kafka. Messages
+// are batched per partition and compressed according to the configuration.
 type Producer struct {
-	brokers []string
-	logger  *logrus.Logger
-	mu      sync.Mutex
-}
-
-// ProducerConfig defines configuration for Kafka producer
-type ProducerConfig struct {
-	Brokers []string
+	client *kgo.Client
+	logger *logrus.Logger
 }
 
-// NewProducer creates a new Kafka producer
-// Note: In a real implementation, you would use an actual Kafka client library
+// NewProducer creates a new Kafka producer. The configuration holds the
+// brokers, and optionally the client_id, acks ("all", the default, "leader"
+// or "none"), idempotent (true by default), compression ("snappy" by
+// default), linger and batch_max_bytes of the producer.
 func NewProducer(config map[string]interface{}) (messaging.Producer, error) {
-	// Parse configuration
-	cfg := ProducerConfig{}
-
-	// Extract brokers
-	if brokers, ok := config["brokers"].([]string); ok {
-		cfg.Brokers = brokers
-	} else if brokersStr, ok := config["brokers"].(string); ok {
-		cfg.Brokers = strings.Split(brokersStr, ",")
-	} else {
-		return nil, fmt.Errorf("%w: brokers must be a string or []string", messaging.ErrInvalidConfig)
+	cfg, err := parseProducerConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := kgo.NewClient(cfg.options()...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Kafka client: %w", err)
 	}
 
 	return &Producer{
-		brokers: cfg.Brokers,
-		logger:  logrus.StandardLogger(),
+		client: client,
+		logger: logrus.StandardLogger(),
 	}, nil
 }
 
-// Publish sends a message to Kafka
+// Publish sends a message to Kafka and waits for the brokers to acknowledge
+// it, as required by messaging.Producer. The "key" metadata is the key of the
+// message, which selects its partition, and the rest of the metadata is sent
+// as headers.
+//
+// Since every call waits for its acknowledgement, linger and batching only
+// combine the messages published concurrently, e.g. by several workers. A
+// single caller publishing in a loop sends one message per request.
 func (p *Producer) Publish(ctx context.Context, topic string, message []byte, metadata map[string]string) error {
-	p.mu.Lock()
-	defer p.mu.Unlock()
-
-	p.logger.WithFields(logrus.Fields{
-		"topic":     topic,
-		"messageID": metadata["messageID"],
-		"brokers":   p.brokers,
-	}).Info("Publishing message to Kafka")
+	record := &kgo.Record{Topic: topic, Value: message}
 
-	// In a real implementation, you would send the message to Kafka here
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if k == messaging.MetadataKey {
+			record.Key = []byte(metadata[k])
+			continue
+		}
+		record.Headers = append(record.Headers, kgo.RecordHeader{Key: k, Value: []byte(metadata[k])})
+	}
 
-	// Log the message for demonstration purposes
-	var payload interface{}
-	if err := json.Unmarshal(message, &payload); err != nil {
-		p.logger.WithError(err).Warn("Failed to parse message payload")
-		payload = string(message)
+	if err := p.client.ProduceSync(ctx, record).FirstErr(); err != nil {
+		return fmt.Errorf("failed to publish message to %s: %w", topic, err)
 	}
 
 	p.logger.WithFields(logrus.Fields{
-		"topic":   topic,
-		"payload": payload,
+		"topic":     topic,
+		"partition": record.Partition,
+		"offset":    record.Offset,
+		"messageID": metadata[messaging.MetadataMessageID],
 	}).Debug("Message published")
 
 	return nil
 }
 
-// Close gracefully closes the producer
+// Close sends the buffered messages and closes the producer
 func (p *Producer) Close() error {
 	p.logger.Info("Closing Kafka producer")
-	// In a real implementation, you would close the Kafka producer here
-	return nil
+
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+
+	err := p.client.Flush(ctx)
+	p.client.Close()
+	return err
 }
 
 // Name returns the name of the producer implementation
@@ -0,0 +1,426 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trranminhquang/go-boilerplate/pkg/messaging"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+const (
+	testTopic   = "events"
+	waitTimeout = 15 * time.Second
+)
+
+var (
+	errHandler = errors.New("handler failed")
+	// errHeld makes the test handler leave a message in flight without
+	// acknowledging it
+	errHeld = errors.New("held")
+)
+
+// newCluster starts an in-process Kafka cluster with the test topic and
+// returns its addresses
+func newCluster(t *testing.T, partitions int) []string {
+	t.Helper()
+
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(int32(partitions), testTopic))
+	if err != nil {
+		t.Fatalf("starting cluster: %v", err)
+	}
+	t.Cleanup(cluster.Close)
+	return cluster.ListenAddrs()
+}
+
+func quietLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+func newTestProducer(t *testing.T, brokers []string) *Producer {
+	t.Helper()
+
+	producer, err := NewProducer(map[string]interface{}{"brokers": brokers})
+	if err != nil {
+		t.Fatalf("NewProducer: %v", err)
+	}
+	p := producer.(*Producer)
+	p.logger = quietLogger()
+	t.Cleanup(func() {
+		_ = p.Close()
+	})
+	return p
+}
+
+// publish publishes a message with the specified key, if any, to the test
+// topic
+func publish(t *testing.T, p *Producer, payload, key string) {
+	t.Helper()
+
+	metadata := map[string]string{"source": "test"}
+	if key != "" {
+		metadata[messaging.MetadataKey] = key
+	}
+	if err := p.Publish(context.Background(), testTopic, []byte(payload), metadata); err != nil {
+		t.Fatalf("Publish(%s): %v", payload, err)
+	}
+}
+
+// deliveries records the messages delivered to a consumer, in order
+type deliveries struct {
+	mu   sync.Mutex
+	msgs []*messaging.Message
+	at   []time.Time
+}
+
+func (d *deliveries) add(msg *messaging.Message) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.msgs = append(d.msgs, msg)
+	d.at = append(d.at, time.Now())
+}
+
+func (d *deliveries) messages() []*messaging.Message {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*messaging.Message{}, d.msgs...)
+}
+
+func (d *deliveries) payloads() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var ps []string
+	for _, msg := range d.msgs {
+		ps = append(ps, string(msg.Payload))
+	}
+	return ps
+}
+
+// startConsumer starts a consumer of the test topic. Messages for which
+// handler returns nil are acknowledged, those for which it returns errHeld
+// are left in flight, and the others negatively acknowledged.
+func startConsumer(t *testing.T, config map[string]interface{}, handler func(*Consumer, *messaging.Message) error) *Consumer {
+	t.Helper()
+
+	config["topics"] = testTopic
+	if _, ok := config["commit_interval"]; !ok {
+		config["commit_interval"] = 20 * time.Millisecond
+	}
+	consumer, err := NewConsumer(config)
+	if err != nil {
+		t.Fatalf("NewConsumer: %v", err)
+	}
+	c := consumer.(*Consumer)
+	c.logger = quietLogger()
+
+	if err := c.Subscribe(func(_ context.Context, msg *messaging.Message) error {
+		err := handler(c, msg)
+		if errors.Is(err, errHeld) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return c.Ack(msg)
+	}); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = c.Stop()
+	})
+	return c
+}
+
+// record returns a handler recording every message in d
+func record(d *deliveries) func(*Consumer, *messaging.Message) error {
+	return func(_ *Consumer, msg *messaging.Message) error {
+		d.add(msg)
+		return nil
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after waitTimeout
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(waitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// assignedCount returns the number of partitions assigned to c
+func assignedCount(c *Consumer) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.assigned)
+}
+
+// committed returns the offsets the group committed for the test topic, by
+// partition
+func committed(t *testing.T, brokers []string, group string) map[int32]int64 {
+	t.Helper()
+
+	client, err := kgo.NewClient(kgo.SeedBrokers(brokers...))
+	if err != nil {
+		t.Fatalf("creating client: %v", err)
+	}
+	defer client.Close()
+
+	req := kmsg.NewPtrOffsetFetchRequest()
+	req.Group = group
+	resp, err := req.RequestWith(context.Background(), client)
+	if err != nil {
+		t.Fatalf("fetching offsets: %v", err)
+	}
+	offsets := make(map[int32]int64)
+	if err := kerr.ErrorForCode(resp.ErrorCode); errors.Is(err, kerr.GroupIDNotFound) {
+		// The group did not join yet
+		return offsets
+	} else if err != nil {
+		t.Fatalf("fetching offsets: %v", err)
+	}
+
+	for _, topic := range resp.Topics {
+		for _, p := range topic.Partitions {
+			if topic.Topic == testTopic && p.Offset >= 0 {
+				offsets[p.Partition] = p.Offset
+			}
+		}
+	}
+	return offsets
+}
+
+func TestProducerKeyedMessages(t *testing.T) {
+	brokers := newCluster(t, 4)
+	producer := newTestProducer(t, brokers)
+
+	for i := 0; i < 20; i++ {
+		publish(t, producer, fmt.Sprintf("m%d", i), fmt.Sprintf("key-%d", i%4))
+	}
+
+	var got deliveries
+	startConsumer(t, map[string]interface{}{
+		"brokers":        brokers,
+		"browse":         true,
+		"initial_offset": "earliest",
+	}, record(&got))
+	waitFor(t, "20 messages", func() bool { return len(got.payloads()) == 20 })
+
+	// Every key goes to a single partition, and is delivered as the key of
+	// the message rather than as a header
+	partitions := make(map[string]string)
+	for _, msg := range got.messages() {
+		key := msg.Metadata[messaging.MetadataKey]
+		if key == "" {
+			t.Fatalf("message %s has no key, metadata %v", msg.Payload, msg.Metadata)
+		}
+		if p, ok := partitions[key]; ok && p != msg.Source {
+			t.Errorf("key %s was published to %s and %s", key, p, msg.Source)
+		}
+		partitions[key] = msg.Source
+
+		if msg.Metadata["source"] != "test" {
+			t.Errorf("message %s lost its headers, metadata %v", msg.Payload, msg.Metadata)
+		}
+	}
+}
+
+func TestConsumerInitialOffset(t *testing.T) {
+	brokers := newCluster(t, 1)
+	producer := newTestProducer(t, brokers)
+
+	publish(t, producer, "old-0", "")
+	publish(t, producer, "old-1", "")
+
+	var earliest deliveries
+	startConsumer(t, map[string]interface{}{
+		"brokers":        brokers,
+		"group_id":       "earliest",
+		"initial_offset": "earliest",
+	}, record(&earliest))
+	waitFor(t, "the earliest group to read the topic", func() bool { return len(earliest.payloads()) == 2 })
+
+	// A latest consumer skips the messages published before it joined. New
+	// messages are published until it receives one, since it may take a
+	// while to start fetching.
+	var latest deliveries
+	startConsumer(t, map[string]interface{}{
+		"brokers":        brokers,
+		"group_id":       "latest",
+		"initial_offset": "latest",
+	}, record(&latest))
+	i := 0
+	waitFor(t, "the latest group to receive a new message", func() bool {
+		publish(t, producer, fmt.Sprintf("new-%d", i), "")
+		i++
+		time.Sleep(50 * time.Millisecond)
+		return len(latest.payloads()) > 0
+	})
+
+	for _, p := range latest.payloads() {
+		if p == "old-0" || p == "old-1" {
+			t.Errorf("latest group received %s, published before it joined", p)
+		}
+	}
+	if ps := earliest.payloads(); fmt.Sprint(ps[:2]) != "[old-0 old-1]" {
+		t.Errorf("earliest group received %v first, want [old-0 old-1]", ps)
+	}
+}
+
+func TestConsumerCommitsAcknowledgedOffsets(t *testing.T) {
+	brokers := newCluster(t, 1)
+	producer := newTestProducer(t, brokers)
+
+	for i := 0; i < 5; i++ {
+		publish(t, producer, fmt.Sprintf("m%d", i), "")
+	}
+
+	// m2 is acknowledged last, which holds back the commit of the later
+	// messages
+	held := make(chan *messaging.Message, 1)
+	var got deliveries
+	c := startConsumer(t, map[string]interface{}{
+		"brokers":        brokers,
+		"group_id":       "group",
+		"initial_offset": "earliest",
+	}, func(_ *Consumer, msg *messaging.Message) error {
+		got.add(msg)
+		if string(msg.Payload) == "m2" {
+			held <- msg
+			return errHeld
+		}
+		return nil
+	})
+
+	waitFor(t, "the offset of m2 to be committed", func() bool { return committed(t, brokers, "group")[0] == 2 })
+	waitFor(t, "every message", func() bool { return len(got.payloads()) == 5 })
+	time.Sleep(100 * time.Millisecond)
+	if offset := committed(t, brokers, "group")[0]; offset != 2 {
+		t.Fatalf("committed offset %d while m2 is in flight, want 2", offset)
+	}
+
+	if err := c.Ack(<-held); err != nil {
+		t.Fatalf("Ack: %v", err)
+	}
+	waitFor(t, "every offset to be committed", func() bool { return committed(t, brokers, "group")[0] == 5 })
+}
+
+func TestConsumerRebalance(t *testing.T) {
+	brokers := newCluster(t, 4)
+	producer := newTestProducer(t, brokers)
+
+	config := func() map[string]interface{} {
+		return map[string]interface{}{
+			"brokers":        brokers,
+			"group_id":       "group",
+			"initial_offset": "earliest",
+		}
+	}
+	var first, second deliveries
+	c1 := startConsumer(t, config(), record(&first))
+	waitFor(t, "the first member to be assigned every partition", func() bool { return assignedCount(c1) == 4 })
+	c2 := startConsumer(t, config(), record(&second))
+	waitFor(t, "the partitions to be shared", func() bool { return assignedCount(c1) == 2 && assignedCount(c2) == 2 })
+
+	for i := 0; i < 16; i++ {
+		publish(t, producer, fmt.Sprintf("m%d", i), fmt.Sprintf("key-%d", i))
+	}
+	waitFor(t, "every message", func() bool { return len(first.payloads())+len(second.payloads()) == 16 })
+
+	sources := func(d *deliveries) map[string]bool {
+		s := make(map[string]bool)
+		for _, msg := range d.messages() {
+			s[msg.Source] = true
+		}
+		return s
+	}
+	for p := range sources(&first) {
+		if sources(&second)[p] {
+			t.Errorf("partition %s was consumed by both members", p)
+		}
+	}
+
+	// The first member takes over the partitions of the second one from the
+	// offsets it committed when leaving
+	if err := c2.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	waitFor(t, "the first member to be assigned every partition", func() bool { return assignedCount(c1) == 4 })
+	for i := 16; i < 24; i++ {
+		publish(t, producer, fmt.Sprintf("m%d", i), fmt.Sprintf("key-%d", i))
+	}
+	waitFor(t, "every message", func() bool { return len(first.payloads())+len(second.payloads()) >= 24 })
+	time.Sleep(100 * time.Millisecond)
+
+	seen := make(map[string]int)
+	for _, p := range append(first.payloads(), second.payloads()...) {
+		seen[p]++
+	}
+	for i := 0; i < 24; i++ {
+		if n := seen[fmt.Sprintf("m%d", i)]; n != 1 {
+			t.Errorf("m%d was consumed %d times, want once", i, n)
+		}
+	}
+}
+
+func TestConsumerNackRedeliversInOrder(t *testing.T) {
+	brokers := newCluster(t, 1)
+	producer := newTestProducer(t, brokers)
+
+	for i := 0; i < 4; i++ {
+		publish(t, producer, fmt.Sprintf("m%d", i), "")
+	}
+
+	// m1 fails twice, so the partition is consumed again from m1 after the
+	// redelivery delay and then twice the delay
+	const delay = 100 * time.Millisecond
+	failures := 0
+	var got deliveries
+	startConsumer(t, map[string]interface{}{
+		"brokers":              brokers,
+		"group_id":             "group",
+		"initial_offset":       "earliest",
+		"redelivery_delay":     delay,
+		"max_redelivery_delay": time.Second,
+	}, func(_ *Consumer, msg *messaging.Message) error {
+		got.add(msg)
+		if string(msg.Payload) == "m1" && failures < 2 {
+			failures++
+			return errHandler
+		}
+		return nil
+	})
+
+	waitFor(t, "every message to be handled", func() bool { return len(got.payloads()) >= 6 })
+	waitFor(t, "every offset to be committed", func() bool { return committed(t, brokers, "group")[0] == 4 })
+
+	if ps := fmt.Sprint(got.payloads()); ps != "[m0 m1 m1 m1 m2 m3]" {
+		t.Fatalf("delivered %s, want m1 redelivered in order before m2 and m3", ps)
+	}
+	got.mu.Lock()
+	defer got.mu.Unlock()
+	if d := got.at[2].Sub(got.at[1]); d < delay {
+		t.Errorf("first redelivery after %s, want at least %s", d, delay)
+	}
+	if d := got.at[3].Sub(got.at[2]); d < 2*delay {
+		t.Errorf("second redelivery after %s, want at least %s", d, 2*delay)
+	}
+}
@@ -0,0 +1,352 @@
+package messaging
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// CloudEvents spec version stamped on messages
+const SpecVersion = "1.0"
+
+// Content types of messages
+const (
+	ContentTypeJSON        = "application/json"
+	ContentTypeCloudEvents = "application/cloudevents+json"
+)
+
+// MetadataContentType is the Metadata key holding the content type of the
+// payload
+const MetadataContentType = "content-type"
+
+// Metadata keys of the envelope attributes in binary mode, following the
+// CloudEvents Kafka protocol binding
+const (
+	MetadataEventID          = "ce_id"
+	MetadataEventType        = "ce_type"
+	MetadataEventSource      = "ce_source"
+	MetadataEventTime        = "ce_time"
+	MetadataEventSubject     = "ce_subject"
+	MetadataEventSpecVersion = "ce_specversion"
+)
+
+// ErrInvalidEnvelope is returned for a message with a malformed envelope
+var ErrInvalidEnvelope = errors.New("invalid envelope")
+
+// Envelope holds the CloudEvents attributes of a message, see
+// https://github.com/cloudevents/spec
+type Envelope struct {
+	ID              string
+	Type            MessageType
+	Source          string
+	Time            time.Time
+	Subject         string
+	DataContentType string
+	SpecVersion     string
+}
+
+// EnvelopeMode is how the envelope is carried by a message
+type EnvelopeMode string
+
+const (
+	// BinaryMode carries the attributes in the Metadata of the message and
+	// the event data as its Payload. Consumers can route messages without
+	// parsing the payload.
+	BinaryMode EnvelopeMode = "binary"
+	// StructuredMode carries the attributes and the event data together as
+	// a JSON document in the Payload of the message
+	StructuredMode EnvelopeMode = "structured"
+)
+
+// structuredEvent is the JSON format of a structured mode message
+type structuredEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Type            MessageType     `json:"type"`
+	Source          string          `json:"source"`
+	Time            string          `json:"time,omitempty"`
+	Subject         string          `json:"subject,omitempty"`
+	DataContentType string          `json:"datacontenttype,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"`
+	DataBase64      string          `json:"data_base64,omitempty"`
+}
+
+// validate checks the attributes required by the CloudEvents spec are set
+func (e Envelope) validate() error {
+	var missing []string
+	if e.ID == "" {
+		missing = append(missing, "id")
+	}
+	if e.Type == "" {
+		missing = append(missing, "type")
+	}
+	if e.Source == "" {
+		missing = append(missing, "source")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: missing %s", ErrInvalidEnvelope, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// isJSON reports whether the data content type of the envelope is JSON
+func (e Envelope) isJSON() bool {
+	mediaType := strings.TrimSpace(strings.Split(e.DataContentType, ";")[0])
+	return mediaType == "" || mediaType == ContentTypeJSON || strings.HasSuffix(mediaType, "+json")
+}
+
+// EnvelopeFromMetadata extracts a binary mode envelope from message metadata.
+// It reports false if the metadata carries no envelope.
+func EnvelopeFromMetadata(metadata map[string]string) (Envelope, bool, error) {
+	specVersion, ok := metadata[MetadataEventSpecVersion]
+	if !ok {
+		return Envelope{}, false, nil
+	}
+
+	e := Envelope{
+		ID:              metadata[MetadataEventID],
+		Type:            MessageType(metadata[MetadataEventType]),
+		Source:          metadata[MetadataEventSource],
+		Subject:         metadata[MetadataEventSubject],
+		DataContentType: metadata[MetadataContentType],
+		SpecVersion:     specVersion,
+	}
+	if value := metadata[MetadataEventTime]; value != "" {
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return Envelope{}, true, fmt.Errorf("%w: time: %v", ErrInvalidEnvelope, err)
+		}
+		e.Time = t
+	}
+	return e, true, e.validate()
+}
+
+// SetMetadata writes the envelope to message metadata, in binary mode
+func (e Envelope) SetMetadata(metadata map[string]string) {
+	metadata[MetadataEventSpecVersion] = e.SpecVersion
+	metadata[MetadataEventID] = e.ID
+	metadata[MetadataEventType] = e.Type.String()
+	metadata[MetadataEventSource] = e.Source
+	if !e.Time.IsZero() {
+		metadata[MetadataEventTime] = e.Time.UTC().Format(time.RFC3339Nano)
+	}
+	if e.Subject != "" {
+		metadata[MetadataEventSubject] = e.Subject
+	}
+	if e.DataContentType != "" {
+		metadata[MetadataContentType] = e.DataContentType
+	}
+}
+
+// EncodeStructured returns a structured mode payload of the envelope and data
+func (e Envelope) EncodeStructured(data []byte) ([]byte, error) {
+	event := structuredEvent{
+		SpecVersion:     e.SpecVersion,
+		ID:              e.ID,
+		Type:            e.Type,
+		Source:          e.Source,
+		Subject:         e.Subject,
+		DataContentType: e.DataContentType,
+	}
+	if !e.Time.IsZero() {
+		event.Time = e.Time.UTC().Format(time.RFC3339Nano)
+	}
+
+	switch {
+	case len(data) == 0:
+	case e.isJSON() && json.Valid(data):
+		event.Data = data
+	default:
+		event.DataBase64 = base64.StdEncoding.EncodeToString(data)
+	}
+	return json.Marshal(event)
+}
+
+// DecodeStructured parses a structured mode payload into its envelope and
+// data
+func DecodeStructured(payload []byte) (Envelope, []byte, error) {
+	var event structuredEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return Envelope{}, nil, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+	if event.SpecVersion == "" {
+		return Envelope{}, nil, fmt.Errorf("%w: missing specversion", ErrInvalidEnvelope)
+	}
+
+	e := Envelope{
+		ID:              event.ID,
+		Type:            event.Type,
+		Source:          event.Source,
+		Subject:         event.Subject,
+		DataContentType: event.DataContentType,
+		SpecVersion:     event.SpecVersion,
+	}
+	if event.Time != "" {
+		t, err := time.Parse(time.RFC3339Nano, event.Time)
+		if err != nil {
+			return Envelope{}, nil, fmt.Errorf("%w: time: %v", ErrInvalidEnvelope, err)
+		}
+		e.Time = t
+	}
+	if err := e.validate(); err != nil {
+		return Envelope{}, nil, err
+	}
+
+	data := []byte(event.Data)
+	if event.DataBase64 != "" {
+		decoded, err := base64.StdEncoding.DecodeString(event.DataBase64)
+		if err != nil {
+			return Envelope{}, nil, fmt.Errorf("%w: data_base64: %v", ErrInvalidEnvelope, err)
+		}
+		data = decoded
+	}
+	return e, data, nil
+}
+
+// isStructured reports whether metadata marks a structured mode payload
+func isStructured(metadata map[string]string) bool {
+	return strings.HasPrefix(metadata[MetadataContentType], ContentTypeCloudEvents)
+}
+
+// ReadEnvelope returns the envelope of a received message. A structured mode
+// message is converted to binary mode in place, so that its Payload is the
+// event data whatever the mode it was sent in. It reports false for a message
+// without an envelope.
+func ReadEnvelope(msg *Message) (Envelope, bool, error) {
+	if msg.Metadata == nil || !isStructured(msg.Metadata) {
+		return EnvelopeFromMetadata(msg.Metadata)
+	}
+
+	e, data, err := DecodeStructured(msg.Payload)
+	if err != nil {
+		return Envelope{}, true, err
+	}
+
+	delete(msg.Metadata, MetadataContentType)
+	e.SetMetadata(msg.Metadata)
+	msg.Payload = data
+	if msg.ID == "" {
+		msg.ID = e.ID
+	}
+	return e, true, nil
+}
+
+// Stamp returns the payload and metadata of a message to publish with an
+// envelope in the specified mode. Messages that already have one keep it, so
+// that republished messages, e.g. replayed from a dead letter topic, keep
+// their identity. Otherwise the attributes are derived from the message:
+//
+//   - id is the MetadataMessageID metadata, or a new UUID
+//   - type is the "event_type" metadata, or the "event_type" or "type" field
+//     of a JSON payload
+//   - subject is the partition key of the message, see MetadataKey
+//   - time is now
+//
+// The metadata passed in is not modified.
+func Stamp(payload []byte, metadata map[string]string, source string, mode EnvelopeMode) ([]byte, map[string]string, error) {
+	stamped := make(map[string]string, len(metadata)+7)
+	for k, v := range metadata {
+		stamped[k] = v
+	}
+
+	if isStructured(stamped) {
+		if mode == StructuredMode {
+			return payload, stamped, nil
+		}
+		msg := &Message{Payload: payload, Metadata: stamped}
+		if _, _, err := ReadEnvelope(msg); err != nil {
+			return nil, nil, err
+		}
+		return msg.Payload, msg.Metadata, nil
+	}
+
+	e, ok, err := EnvelopeFromMetadata(stamped)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		e = newEnvelope(payload, stamped, source)
+	}
+
+	if mode != StructuredMode {
+		e.SetMetadata(stamped)
+		return payload, stamped, nil
+	}
+
+	for _, key := range []string{MetadataEventSpecVersion, MetadataEventID, MetadataEventType,
+		MetadataEventSource, MetadataEventTime, MetadataEventSubject} {
+		delete(stamped, key)
+	}
+	structured, err := e.EncodeStructured(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	stamped[MetadataContentType] = ContentTypeCloudEvents
+	return structured, stamped, nil
+}
+
+// newEnvelope derives the envelope of a message without one
+func newEnvelope(payload []byte, metadata map[string]string, source string) Envelope {
+	e := Envelope{
+		ID:              metadata[MetadataMessageID],
+		Type:            MessageType(metadata["event_type"]),
+		Source:          source,
+		Time:            time.Now(),
+		Subject:         metadata[MetadataKey],
+		DataContentType: metadata[MetadataContentType],
+		SpecVersion:     SpecVersion,
+	}
+	if e.ID == "" {
+		e.ID = uuid.Must(uuid.NewV4()).String()
+	}
+
+	if e.Type == "" || e.DataContentType == "" {
+		var data struct {
+			EventType MessageType `json:"event_type"`
+			Type      MessageType `json:"type"`
+		}
+		if json.Unmarshal(payload, &data) == nil {
+			if e.DataContentType == "" {
+				e.DataContentType = ContentTypeJSON
+			}
+			if e.Type == "" {
+				e.Type = data.EventType
+			}
+			if e.Type == "" {
+				e.Type = data.Type
+			}
+		}
+	}
+	if e.Type == "" {
+		e.Type = "unknown"
+	}
+	return e
+}
+
+// envelopeProducer stamps an envelope on the messages it publishes
+type envelopeProducer struct {
+	Producer
+	source string
+	mode   EnvelopeMode
+}
+
+// WithEnvelope returns a producer stamping an envelope in the specified mode
+// on the messages published with producer, see Stamp
+func WithEnvelope(producer Producer, source string, mode EnvelopeMode) Producer {
+	return &envelopeProducer{Producer: producer, source: source, mode: mode}
+}
+
+// Publish stamps the message and publishes it
+func (p *envelopeProducer) Publish(ctx context.Context, topic string, message []byte, metadata map[string]string) error {
+	payload, stamped, err := Stamp(message, metadata, p.source, p.mode)
+	if err != nil {
+		return err
+	}
+	return p.Producer.Publish(ctx, topic, payload, stamped)
+}
@@ -9,3 +9,45 @@ var (
 	ErrHandlerNotSet    = errors.New("message handler not set")
 	ErrInvalidConfig    = errors.New("invalid configuration")
 )
+
+// HandlerError classifies an error returned by a MessageHandler as permanent
+// or retryable. Errors that are not wrapped are retryable.
+type HandlerError struct {
+	Err       error
+	Permanent bool
+}
+
+func (e *HandlerError) Error() string {
+	if e.Permanent {
+		return "permanent: " + e.Err.Error()
+	}
+	return e.Err.Error()
+}
+
+func (e *HandlerError) Unwrap() error {
+	return e.Err
+}
+
+// Permanent marks err as permanent, the message is not retried.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &HandlerError{Err: err, Permanent: true}
+}
+
+// Retryable marks err as retryable, the message is handled again after a
+// backoff until the retry policy gives up.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &HandlerError{Err: err}
+}
+
+// IsPermanent reports whether err must not be retried. The outermost
+// HandlerError in the chain decides.
+func IsPermanent(err error) bool {
+	var he *HandlerError
+	return errors.As(err, &he) && he.Permanent
+}
@@ -0,0 +1,352 @@
+package memory
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/trranminhquang/go-boilerplate/pkg/messaging"
+)
+
+// DefaultPartitions is the number of partitions of the topics of the default
+// broker
+const DefaultPartitions = 4
+
+var defaultBroker = NewBroker(DefaultPartitions)
+
+// Default returns the broker of the consumers and producers created without
+// a "broker" in their configuration. It is shared by the whole process, so
+// e.g. the outbox relay and the queue worker exchange messages through it.
+func Default() *Broker {
+	return defaultBroker
+}
+
+// Broker is an in-memory message broker. Topics are created on first use and
+// split into partitions, each an append-only log of messages. Consumers of
+// the same group share the partitions of their topics and commit their
+// offsets to the group.
+//
+// Delivery is deterministic: messages with the same key go to the same
+// partition, messages without a key are spread over the partitions in turn,
+// and every consumer delivers the messages of its partitions in partition
+// then offset order.
+type Broker struct {
+	partitions int32
+
+	mu     sync.Mutex
+	topics map[string]*topic
+	groups map[string]*group
+	// browsers are the consumers reading every partition of their topics
+	// outside of a group
+	browsers []*Consumer
+}
+
+// topic is the log of every partition of a topic
+type topic struct {
+	partitions [][]record
+	// next is the partition of the next message without a key
+	next int32
+}
+
+type record struct {
+	payload  []byte
+	metadata map[string]string
+}
+
+// group holds the members of a consumer group and the offsets they
+// committed. Each offset is the offset of the next message to consume.
+type group struct {
+	members   []*Consumer
+	committed map[messaging.TopicPartition]int64
+}
+
+// NewBroker creates a broker whose topics have the specified number of
+// partitions
+func NewBroker(partitions int) *Broker {
+	if partitions < 1 {
+		partitions = 1
+	}
+	return &Broker{
+		partitions: int32(partitions),
+		topics:     make(map[string]*topic),
+		groups:     make(map[string]*group),
+	}
+}
+
+// topic returns the topic with the specified name, creating it if needed.
+// The caller must hold b.mu.
+func (b *Broker) topic(name string) *topic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = &topic{partitions: make([][]record, b.partitions)}
+		b.topics[name] = t
+	}
+	return t
+}
+
+// publish appends a message to a partition of the topic, chosen from the
+// message key, and wakes the consumers of the topic up
+func (b *Broker) publish(name string, payload []byte, metadata map[string]string) (messaging.TopicPartition, int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t := b.topic(name)
+
+	var partition int32
+	if key, ok := metadata[messaging.MetadataKey]; ok && key != "" {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(key))
+		partition = int32(h.Sum32() % uint32(b.partitions))
+	} else {
+		partition = t.next
+		t.next = (t.next + 1) % b.partitions
+	}
+
+	offset := int64(len(t.partitions[partition]))
+	t.partitions[partition] = append(t.partitions[partition], record{payload: payload, metadata: metadata})
+
+	for _, g := range b.groups {
+		for _, c := range g.members {
+			if c.subscribed(name) {
+				c.wake()
+			}
+		}
+	}
+	for _, c := range b.browsers {
+		if c.subscribed(name) {
+			c.wake()
+		}
+	}
+	return messaging.TopicPartition{Topic: name, Partition: partition}, offset
+}
+
+// join adds a consumer to its group and rebalances the group. Browse
+// consumers are assigned every partition of their topics instead.
+func (b *Broker) join(c *Consumer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c.browse {
+		b.browsers = append(b.browsers, c)
+		c.assign(b.browseAssignment(c))
+		return
+	}
+
+	g, ok := b.groups[c.groupID]
+	if !ok {
+		g = &group{committed: make(map[messaging.TopicPartition]int64)}
+		b.groups[c.groupID] = g
+	}
+	for _, name := range c.topics {
+		b.topic(name)
+	}
+
+	g.members = append(g.members, c)
+	b.rebalance(g)
+}
+
+// leave removes a consumer from its group and rebalances the group
+func (b *Broker) leave(c *Consumer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c.browse {
+		for i, browser := range b.browsers {
+			if browser == c {
+				b.browsers = append(b.browsers[:i], b.browsers[i+1:]...)
+				break
+			}
+		}
+		c.assign(nil)
+		return
+	}
+
+	g, ok := b.groups[c.groupID]
+	if !ok {
+		return
+	}
+	for i, member := range g.members {
+		if member == c {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	c.assign(nil)
+	b.rebalance(g)
+}
+
+// rebalance assigns the partitions of every topic to the members of the
+// group subscribed to it, in turn and in the order they joined. The caller
+// must hold b.mu.
+func (b *Broker) rebalance(g *group) {
+	assignments := make(map[*Consumer]map[messaging.TopicPartition]int64, len(g.members))
+	for _, c := range g.members {
+		assignments[c] = make(map[messaging.TopicPartition]int64)
+	}
+
+	names := make([]string, 0, len(b.topics))
+	for name := range b.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var subscribers []*Consumer
+		for _, c := range g.members {
+			if c.subscribed(name) {
+				subscribers = append(subscribers, c)
+			}
+		}
+		if len(subscribers) == 0 {
+			continue
+		}
+
+		t := b.topics[name]
+		for p := int32(0); p < b.partitions; p++ {
+			tp := messaging.TopicPartition{Topic: name, Partition: p}
+			c := subscribers[int(p)%len(subscribers)]
+
+			start, ok := g.committed[tp]
+			if !ok {
+				start = 0
+				if c.initialOffset == OffsetLatest {
+					start = int64(len(t.partitions[p]))
+				}
+			}
+			assignments[c][tp] = start
+		}
+	}
+
+	for c, assignment := range assignments {
+		c.assign(assignment)
+	}
+}
+
+// browseAssignment returns every partition of the topics of a browse
+// consumer, starting at its initial offset. The caller must hold b.mu.
+func (b *Broker) browseAssignment(c *Consumer) map[messaging.TopicPartition]int64 {
+	assignment := make(map[messaging.TopicPartition]int64)
+	for _, name := range c.topics {
+		t := b.topic(name)
+		for p := int32(0); p < b.partitions; p++ {
+			start := int64(0)
+			if c.initialOffset == OffsetLatest {
+				start = int64(len(t.partitions[p]))
+			}
+			assignment[messaging.TopicPartition{Topic: name, Partition: p}] = start
+		}
+	}
+	return assignment
+}
+
+// fetch returns the messages of the partitions assigned to c from their
+// position onwards, in partition then offset order, and advances the
+// positions past them. The messages are tracked until they are acknowledged.
+func (b *Broker) fetch(c *Consumer) []*messaging.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var msgs []*messaging.Message
+	for _, tp := range c.partitions() {
+		log := b.topics[tp.Topic].partitions[tp.Partition]
+		for offset := c.positions[tp]; offset < int64(len(log)); offset++ {
+			msgs = append(msgs, log[offset].message(tp, offset))
+			c.offsets.Track(tp, offset)
+		}
+		c.positions[tp] = int64(len(log))
+	}
+	return msgs
+}
+
+// commit records the offset of the next message of a partition the group
+// consumes. Offsets only move forward.
+func (b *Broker) commit(groupID string, tp messaging.TopicPartition, offset int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	g, ok := b.groups[groupID]
+	if !ok {
+		return
+	}
+	if committed, ok := g.committed[tp]; !ok || offset > committed {
+		g.committed[tp] = offset
+	}
+}
+
+// message returns a copy of the record, as delivered to a consumer
+func (r record) message(tp messaging.TopicPartition, offset int64) *messaging.Message {
+	metadata := make(map[string]string, len(r.metadata)+3)
+	for k, v := range r.metadata {
+		metadata[k] = v
+	}
+	metadata[messaging.MetadataTopic] = tp.Topic
+	metadata[messaging.MetadataPartition] = itoa(int64(tp.Partition))
+	metadata[messaging.MetadataOffset] = itoa(offset)
+
+	return &messaging.Message{
+		ID:       messaging.PositionMessageID(metadata, tp, offset),
+		Payload:  append([]byte(nil), r.payload...),
+		Metadata: metadata,
+		Source:   tp.String(),
+	}
+}
+
+// Messages returns the messages published to a topic, in partition then
+// offset order, e.g. to check what a test published
+func (b *Broker) Messages(name string) []*messaging.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t, ok := b.topics[name]
+	if !ok {
+		return nil
+	}
+
+	var msgs []*messaging.Message
+	for p, log := range t.partitions {
+		tp := messaging.TopicPartition{Topic: name, Partition: int32(p)}
+		for offset, r := range log {
+			msgs = append(msgs, r.message(tp, int64(offset)))
+		}
+	}
+	return msgs
+}
+
+// Lag returns the number of messages of a topic the group has not committed
+// yet. A test can wait for it to drop to zero before checking the effects of
+// the messages it published.
+func (b *Broker) Lag(groupID, name string) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t, ok := b.topics[name]
+	if !ok {
+		return 0
+	}
+
+	var committed map[messaging.TopicPartition]int64
+	if g, ok := b.groups[groupID]; ok {
+		committed = g.committed
+	}
+
+	var lag int64
+	for p, log := range t.partitions {
+		tp := messaging.TopicPartition{Topic: name, Partition: int32(p)}
+		lag += int64(len(log)) - committed[tp]
+	}
+	return lag
+}
+
+// WaitIdle waits until the group committed every message of the topic, or
+// the timeout elapsed. It reports whether the group caught up.
+func (b *Broker) WaitIdle(groupID, name string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for b.Lag(groupID, name) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return true
+}
@@ -0,0 +1,374 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trranminhquang/go-boilerplate/pkg/messaging"
+)
+
+// Initial offsets of a consumer group without committed offsets
+const (
+	OffsetEarliest = "earliest"
+	OffsetLatest   = "latest"
+)
+
+// ErrProducerClosed is returned when publishing with a closed producer
+var ErrProducerClosed = errors.New("producer closed")
+
+// Consumer implements the messaging.Consumer interface for the in-memory
+// broker
+type Consumer struct {
+	broker        *Broker
+	topics        []string
+	groupID       string
+	initialOffset string
+	browse        bool
+	handler       messaging.MessageHandler
+	cancel        context.CancelFunc
+	wg            sync.WaitGroup
+	logger        *logrus.Logger
+	offsets       *messaging.OffsetTracker
+	wakeup        chan struct{}
+
+	// positions holds the offset of the next message to fetch of every
+	// partition assigned to the consumer. It is guarded by the mutex of
+	// the broker.
+	positions map[messaging.TopicPartition]int64
+
+	// redeliveries holds the messages that were not acknowledged
+	mu           sync.Mutex
+	redeliveries []*messaging.Message
+}
+
+// broker returns the broker from the configuration, or the default broker
+func broker(config map[string]interface{}) (*Broker, error) {
+	b, ok := config["broker"]
+	if !ok {
+		return Default(), nil
+	}
+	if b, ok := b.(*Broker); ok && b != nil {
+		return b, nil
+	}
+	return nil, fmt.Errorf("%w: broker must be a *memory.Broker", messaging.ErrInvalidConfig)
+}
+
+// NewConsumer creates a consumer of the in-memory broker. The configuration
+// holds the topics to consume, the group_id of the consumer and optionally
+// its initial_offset, "earliest" or "latest" (the default), the broker,
+// which defaults to the process-wide broker, and browse mode. Browse
+// consumers read every partition of their topics without joining a group,
+// so they need no group_id, and Ack and Nack have no effect.
+func NewConsumer(config map[string]interface{}) (messaging.Consumer, error) {
+	b, err := broker(config)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Consumer{
+		broker:        b,
+		initialOffset: OffsetLatest,
+		logger:        logrus.StandardLogger(),
+		offsets:       messaging.NewOffsetTracker(),
+		wakeup:        make(chan struct{}, 1),
+	}
+
+	// Extract topics
+	if topics, ok := config["topics"].([]string); ok {
+		c.topics = topics
+	} else if topicsStr, ok := config["topics"].(string); ok {
+		c.topics = strings.Split(topicsStr, ",")
+	} else {
+		return nil, fmt.Errorf("%w: topics must be a string or []string", messaging.ErrInvalidConfig)
+	}
+
+	if err := messaging.BoolOption(config, "browse", &c.browse); err != nil {
+		return nil, err
+	}
+
+	// Extract group ID, which browse consumers don't need
+	if groupID, ok := config["group_id"].(string); ok {
+		c.groupID = groupID
+	} else if !c.browse {
+		return nil, fmt.Errorf("%w: group_id must be a string", messaging.ErrInvalidConfig)
+	}
+
+	// Extract initial offset
+	if offset, ok := config["initial_offset"]; ok {
+		offset, _ := offset.(string)
+		if offset != OffsetEarliest && offset != OffsetLatest {
+			return nil, fmt.Errorf("%w: initial_offset must be %q or %q", messaging.ErrInvalidConfig, OffsetEarliest, OffsetLatest)
+		}
+		c.initialOffset = offset
+	}
+
+	return c, nil
+}
+
+// Start joins the consumer group and begins delivering the messages of the
+// partitions assigned to the consumer
+func (c *Consumer) Start(ctx context.Context) error {
+	if c.handler == nil {
+		return messaging.ErrHandlerNotSet
+	}
+
+	c.logger.WithFields(logrus.Fields{
+		"topics":  c.topics,
+		"groupID": c.groupID,
+	}).Info("Starting in-memory consumer")
+
+	ctx, c.cancel = context.WithCancel(ctx)
+	c.broker.join(c)
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		for {
+			msgs := append(c.takeRedeliveries(), c.broker.fetch(c)...)
+			for _, msg := range msgs {
+				if ctx.Err() != nil {
+					return
+				}
+				c.deliver(ctx, msg)
+			}
+			if len(msgs) > 0 {
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.wakeup:
+			}
+		}
+	}()
+
+	return nil
+}
+
+// deliver passes msg to the handler. Messages the handler does not accept are
+// delivered again.
+func (c *Consumer) deliver(ctx context.Context, msg *messaging.Message) {
+	if err := c.handler(ctx, msg); err != nil {
+		c.logger.WithError(err).WithFields(logrus.Fields{
+			"messageID": msg.ID,
+			"source":    msg.Source,
+		}).Error("Failed to process message")
+
+		if err := c.Nack(msg); err != nil {
+			c.logger.WithError(err).Error("Failed to nack message")
+		}
+	}
+}
+
+// wake signals the delivery loop that messages may be available
+func (c *Consumer) wake() {
+	select {
+	case c.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// subscribed reports whether the consumer consumes the topic
+func (c *Consumer) subscribed(name string) bool {
+	for _, t := range c.topics {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// assign replaces the partitions assigned to the consumer, starting each
+// newly assigned one at the specified offset. It is called by the broker
+// with its mutex held.
+func (c *Consumer) assign(assignment map[messaging.TopicPartition]int64) {
+	positions := make(map[messaging.TopicPartition]int64, len(assignment))
+	for tp, start := range assignment {
+		if position, ok := c.positions[tp]; ok {
+			positions[tp] = position
+		} else {
+			positions[tp] = start
+		}
+	}
+	for tp := range c.positions {
+		if _, ok := positions[tp]; !ok {
+			c.offsets.Revoke(tp)
+		}
+	}
+	c.positions = positions
+	c.wake()
+}
+
+// partitions returns the partitions assigned to the consumer, in order. It
+// is called by the broker with its mutex held.
+func (c *Consumer) partitions() []messaging.TopicPartition {
+	tps := make([]messaging.TopicPartition, 0, len(c.positions))
+	for tp := range c.positions {
+		tps = append(tps, tp)
+	}
+	sort.Slice(tps, func(i, j int) bool {
+		if tps[i].Topic != tps[j].Topic {
+			return tps[i].Topic < tps[j].Topic
+		}
+		return tps[i].Partition < tps[j].Partition
+	})
+
+	return tps
+}
+
+// takeRedeliveries returns the messages to deliver again, dropping those of
+// partitions that were assigned to another consumer in the meantime
+func (c *Consumer) takeRedeliveries() []*messaging.Message {
+	c.mu.Lock()
+	msgs := c.redeliveries
+	c.redeliveries = nil
+	c.mu.Unlock()
+
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+
+	kept := msgs[:0]
+	for _, msg := range msgs {
+		tp, _, err := messaging.MessagePosition(msg)
+		if _, ok := c.positions[tp]; err == nil && ok {
+			kept = append(kept, msg)
+		}
+	}
+	return kept
+}
+
+// Ack marks a message as handled and commits the offset of its partition
+// once all earlier messages were acknowledged
+func (c *Consumer) Ack(msg *messaging.Message) error {
+	tp, offset, err := messaging.MessagePosition(msg)
+	if err != nil {
+		return err
+	}
+
+	if commit, ok := c.offsets.Done(tp, offset); ok && !c.browse {
+		c.broker.commit(c.groupID, tp, commit)
+	}
+	return nil
+}
+
+// Nack marks a message as not handled. Its offset is not committed and the
+// message is delivered again.
+func (c *Consumer) Nack(msg *messaging.Message) error {
+	// Browse consumers only stop tracking the message
+	if c.browse {
+		return c.Ack(msg)
+	}
+
+	c.mu.Lock()
+	c.redeliveries = append(c.redeliveries, msg)
+	c.mu.Unlock()
+
+	c.wake()
+	return nil
+}
+
+// Stop stops delivering messages and leaves the consumer group, whose
+// partitions are assigned to the remaining members
+func (c *Consumer) Stop() error {
+	c.logger.Info("Stopping in-memory consumer")
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.wg.Wait()
+	c.broker.leave(c)
+	return nil
+}
+
+// Subscribe registers a handler for processing messages
+func (c *Consumer) Subscribe(handler messaging.MessageHandler) error {
+	c.handler = handler
+	return nil
+}
+
+// Name returns the name of the consumer implementation
+func (c *Consumer) Name() string {
+	return "memory"
+}
+
+// Producer implements the messaging.Producer interface for the in-memory
+// broker
+type Producer struct {
+	broker *Broker
+	logger *logrus.Logger
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewProducer creates a producer of the in-memory broker. The configuration
+// optionally holds the broker, which defaults to the process-wide broker.
+func NewProducer(config map[string]interface{}) (messaging.Producer, error) {
+	b, err := broker(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Producer{
+		broker: b,
+		logger: logrus.StandardLogger(),
+	}, nil
+}
+
+// Publish appends a message to the topic. Messages with the same "key"
+// metadata go to the same partition.
+func (p *Producer) Publish(ctx context.Context, topic string, message []byte, metadata map[string]string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		return ErrProducerClosed
+	}
+
+	copied := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		copied[k] = v
+	}
+	tp, offset := p.broker.publish(topic, append([]byte(nil), message...), copied)
+
+	p.logger.WithFields(logrus.Fields{
+		"partition": tp.String(),
+		"offset":    offset,
+		"messageID": metadata[messaging.MetadataMessageID],
+	}).Debug("Message published")
+	return nil
+}
+
+// Close closes the producer. Published messages stay in the broker.
+func (p *Producer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+	return nil
+}
+
+// Name returns the name of the producer implementation
+func (p *Producer) Name() string {
+	return "memory"
+}
+
+// Register registers the in-memory implementations with the registry
+func Register(registry *messaging.Registry) {
+	registry.RegisterConsumerFactory("memory", NewConsumer)
+	registry.RegisterProducerFactory("memory", NewProducer)
+}
+
+func itoa(i int64) string {
+	return strconv.FormatInt(i, 10)
+}
@@ -0,0 +1,237 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trranminhquang/go-boilerplate/pkg/messaging"
+)
+
+const testTopic = "events"
+
+var errHandler = errors.New("handler failed")
+
+// deliveries records the messages delivered to the consumers of a test
+type deliveries struct {
+	mu   sync.Mutex
+	msgs map[string][]*messaging.Message
+}
+
+func (d *deliveries) add(consumer string, msg *messaging.Message) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.msgs == nil {
+		d.msgs = make(map[string][]*messaging.Message)
+	}
+	d.msgs[consumer] = append(d.msgs[consumer], msg)
+}
+
+func (d *deliveries) get(consumer string) []*messaging.Message {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*messaging.Message{}, d.msgs[consumer]...)
+}
+
+// startConsumer starts a consumer of the test topic in group that calls
+// handler for every message and acknowledges those it accepts
+func startConsumer(t *testing.T, b *Broker, group string, handler func(*messaging.Message) error) *Consumer {
+	t.Helper()
+
+	consumer, err := NewConsumer(map[string]interface{}{
+		"broker":         b,
+		"topics":         testTopic,
+		"group_id":       group,
+		"initial_offset": OffsetEarliest,
+	})
+	if err != nil {
+		t.Fatalf("NewConsumer: %v", err)
+	}
+	c := consumer.(*Consumer)
+	c.logger = quietLogger()
+
+	if err := c.Subscribe(func(_ context.Context, msg *messaging.Message) error {
+		if err := handler(msg); err != nil {
+			return err
+		}
+		return c.Ack(msg)
+	}); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = c.Stop()
+	})
+	return c
+}
+
+// publish publishes a message with the specified key, if any, to the test
+// topic
+func publish(t *testing.T, p messaging.Producer, payload, key string) {
+	t.Helper()
+
+	metadata := map[string]string{}
+	if key != "" {
+		metadata[messaging.MetadataKey] = key
+	}
+	if err := p.Publish(context.Background(), testTopic, []byte(payload), metadata); err != nil {
+		t.Fatalf("Publish(%s): %v", payload, err)
+	}
+}
+
+func newTestProducer(t *testing.T, b *Broker) messaging.Producer {
+	t.Helper()
+
+	producer, err := NewProducer(map[string]interface{}{"broker": b})
+	if err != nil {
+		t.Fatalf("NewProducer: %v", err)
+	}
+	producer.(*Producer).logger = quietLogger()
+	return producer
+}
+
+func quietLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+// payloads returns the payloads of msgs, sorted
+func payloads(msgs []*messaging.Message) []string {
+	var ps []string
+	for _, msg := range msgs {
+		ps = append(ps, string(msg.Payload))
+	}
+	sort.Strings(ps)
+	return ps
+}
+
+func TestPublishConsumeAckNack(t *testing.T) {
+	b := NewBroker(2)
+	producer := newTestProducer(t, b)
+
+	publish(t, producer, "a", "user-1")
+	publish(t, producer, "b", "user-2")
+	publish(t, producer, "c", "user-1")
+
+	// The first delivery of b fails and is nacked by the consumer
+	var got deliveries
+	var failOnce sync.Once
+	startConsumer(t, b, "group", func(msg *messaging.Message) error {
+		got.add("consumer", msg)
+
+		var err error
+		if string(msg.Payload) == "b" {
+			failOnce.Do(func() {
+				err = errHandler
+			})
+		}
+		return err
+	})
+
+	if !b.WaitIdle("group", testTopic, 2*time.Second) {
+		t.Fatalf("group did not catch up, lag %d", b.Lag("group", testTopic))
+	}
+
+	if ps := fmt.Sprint(payloads(got.get("consumer"))); ps != "[a b b c]" {
+		t.Errorf("delivered %s, want a, c once and b twice", ps)
+	}
+
+	// Messages with the same key are delivered in order
+	var user1 []string
+	for _, msg := range got.get("consumer") {
+		if msg.Metadata[messaging.MetadataKey] == "user-1" {
+			user1 = append(user1, string(msg.Payload))
+		}
+	}
+	if fmt.Sprint(user1) != "[a c]" {
+		t.Errorf("delivered %v with key user-1, want [a c]", user1)
+	}
+
+	msgs := b.Messages(testTopic)
+	if ps := fmt.Sprint(payloads(msgs)); ps != "[a b c]" {
+		t.Errorf("topic holds %s, want [a b c]", ps)
+	}
+	for _, msg := range msgs {
+		if msg.Metadata[messaging.MetadataTopic] != testTopic || msg.Metadata[messaging.MetadataKey] == "" {
+			t.Errorf("message %s has metadata %v, want its topic and key", msg.ID, msg.Metadata)
+		}
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	b := NewBroker(4)
+	producer := newTestProducer(t, b)
+
+	var got deliveries
+	record := func(name string) func(*messaging.Message) error {
+		return func(msg *messaging.Message) error {
+			got.add(name, msg)
+			return nil
+		}
+	}
+	startConsumer(t, b, "group", record("first"))
+	second := startConsumer(t, b, "group", record("second"))
+
+	// Messages without a key are spread over the partitions, which are
+	// shared by the two members
+	for i := 0; i < 8; i++ {
+		publish(t, producer, fmt.Sprintf("m%d", i), "")
+	}
+	if !b.WaitIdle("group", testTopic, 2*time.Second) {
+		t.Fatalf("group did not catch up, lag %d", b.Lag("group", testTopic))
+	}
+
+	partitions := func(name string) map[string]bool {
+		ps := make(map[string]bool)
+		for _, msg := range got.get(name) {
+			ps[msg.Source] = true
+		}
+		return ps
+	}
+	first, seconds := partitions("first"), partitions("second")
+	if len(first) != 2 || len(seconds) != 2 {
+		t.Fatalf("members consumed partitions %v and %v, want two each", first, seconds)
+	}
+	for p := range first {
+		if seconds[p] {
+			t.Errorf("partition %s was consumed by both members", p)
+		}
+	}
+
+	// Once the second member leaves, the first one takes over its
+	// partitions from the committed offsets
+	if err := second.Stop(); err != nil {
+		t.Fatalf("Stop: %v", err)
+	}
+	for i := 8; i < 12; i++ {
+		publish(t, producer, fmt.Sprintf("m%d", i), "")
+	}
+	if !b.WaitIdle("group", testTopic, 2*time.Second) {
+		t.Fatalf("group did not catch up, lag %d", b.Lag("group", testTopic))
+	}
+
+	if n := len(got.get("second")); n != 4 {
+		t.Errorf("second member consumed %d messages, want 4", n)
+	}
+	firstMsgs := got.get("first")
+	if n := len(firstMsgs); n != 8 {
+		t.Errorf("first member consumed %d messages, want 8", n)
+	}
+	if ps := partitions("first"); len(ps) != 4 {
+		t.Errorf("first member consumed partitions %v after the rebalance, want all 4", ps)
+	}
+	all := payloads(append(firstMsgs, got.get("second")...))
+	if fmt.Sprint(all) != "[m0 m1 m10 m11 m2 m3 m4 m5 m6 m7 m8 m9]" {
+		t.Errorf("consumed %v, want every message once", all)
+	}
+}
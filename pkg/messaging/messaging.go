@@ -19,10 +19,29 @@ type Message struct {
 	Source string
 }
 
+// MetadataKey is the Metadata key holding the partition key of the message.
+// Messages with the same key are processed in order.
+const MetadataKey = "key"
+
+// MetadataMessageID is the Metadata key holding the ID of a message published
+// without an envelope, e.g. from the outbox. The envelope ID, see
+// MetadataEventID, takes precedence over it.
+const MetadataMessageID = "messageID"
+
+// MetadataAttempt is the Metadata key holding the number of times the
+// message has been handled, starting at 1.
+const MetadataAttempt = "attempt"
+
 // MessageHandler represents a function that processes a message
 type MessageHandler func(context.Context, *Message) error
 
-// Consumer interface abstracts the message consuming functionality
+// Consumer interface abstracts the message consuming functionality.
+//
+// Delivery is at-least-once: a message is only considered handled once it is
+// acknowledged with Ack, which may happen after the subscribed handler
+// returned. Messages that are not acknowledged, because they were passed to
+// Nack, the handler returned an error or the process crashed, are delivered
+// again.
 type Consumer interface {
 	// Start begins consuming messages from the queue
 	Start(context.Context) error
@@ -33,13 +52,22 @@ type Consumer interface {
 	// Subscribe registers a handler for processing messages
 	Subscribe(handler MessageHandler) error
 
+	// Ack marks a message as handled. For partitioned queues its offset is
+	// committed once all earlier messages of its partition were acknowledged.
+	Ack(*Message) error
+
+	// Nack marks a message as not handled so that it is delivered again
+	Nack(*Message) error
+
 	// Name returns the name of the consumer implementation
 	Name() string
 }
 
 // Producer interface abstracts the message producing functionality
 type Producer interface {
-	// Publish sends a message to the queue
+	// Publish sends a message to the queue. It returns once the queue
+	// accepted the message, so a nil error means the message was published,
+	// e.g. for the outbox relay to mark it sent.
 	Publish(ctx context.Context, topic string, message []byte, metadata map[string]string) error
 
 	// Close gracefully closes the producer
@@ -88,11 +116,28 @@ func (r *Registry) CreateConsumer(name string, config map[string]interface{}) (C
 	return factory(config)
 }
 
-// CreateProducer creates a producer with the specified implementation name
+// DefaultEventSource is the source of the envelope of published messages when
+// the producer configuration has no "event_source"
+const DefaultEventSource = "go-boilerplate"
+
+// CreateProducer creates a producer with the specified implementation name.
+// The producer stamps an envelope on the messages it publishes, with the
+// "event_source" and "event_mode" of the configuration, see WithEnvelope.
 func (r *Registry) CreateProducer(name string, config map[string]interface{}) (Producer, error) {
 	factory, ok := r.producerFactories[name]
 	if !ok {
 		return nil, ErrProducerNotFound
 	}
-	return factory(config)
+
+	producer, err := factory(config)
+	if err != nil {
+		return nil, err
+	}
+
+	source, _ := config["event_source"].(string)
+	if source == "" {
+		source = DefaultEventSource
+	}
+	mode, _ := config["event_mode"].(string)
+	return WithEnvelope(producer, source, EnvelopeMode(mode)), nil
 }
@@ -0,0 +1,150 @@
+package messaging
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Metadata keys identifying the position of a message in a partitioned queue
+const (
+	MetadataTopic     = "topic"
+	MetadataPartition = "partition"
+	MetadataOffset    = "offset"
+)
+
+// TopicPartition identifies a partition of a topic
+type TopicPartition struct {
+	Topic     string
+	Partition int32
+}
+
+func (tp TopicPartition) String() string {
+	return fmt.Sprintf("%s-%d", tp.Topic, tp.Partition)
+}
+
+// MessagePosition returns the partition and offset of a message from its
+// metadata
+func MessagePosition(msg *Message) (TopicPartition, int64, error) {
+	partition, err := strconv.ParseInt(msg.Metadata[MetadataPartition], 10, 32)
+	if err != nil {
+		return TopicPartition{}, 0, fmt.Errorf("invalid %s metadata: %w", MetadataPartition, err)
+	}
+	offset, err := strconv.ParseInt(msg.Metadata[MetadataOffset], 10, 64)
+	if err != nil {
+		return TopicPartition{}, 0, fmt.Errorf("invalid %s metadata: %w", MetadataOffset, err)
+	}
+	return TopicPartition{Topic: msg.Metadata[MetadataTopic], Partition: int32(partition)}, offset, nil
+}
+
+// PositionMessageID returns the ID of a message received from a partitioned
+// queue: the id of its envelope or its MetadataMessageID metadata, falling
+// back to its position, which is unique too
+func PositionMessageID(metadata map[string]string, tp TopicPartition, offset int64) string {
+	if id := metadata[MetadataEventID]; id != "" {
+		return id
+	}
+	if id := metadata[MetadataMessageID]; id != "" {
+		return id
+	}
+	return tp.String() + "-" + strconv.FormatInt(offset, 10)
+}
+
+// OffsetTracker keeps track of the messages in flight per partition. Since
+// messages are handled concurrently they can complete out of order, but an
+// offset may only be committed once every earlier message of its partition
+// was handled, otherwise a crash would lose the messages still in flight.
+type OffsetTracker struct {
+	mu         sync.Mutex
+	partitions map[TopicPartition]*partitionOffsets
+}
+
+// partitionOffsets holds the offsets delivered but not yet committable, in
+// delivery order, and which of them are done.
+type partitionOffsets struct {
+	pending []int64
+	done    map[int64]bool
+}
+
+// NewOffsetTracker creates an empty offset tracker
+func NewOffsetTracker() *OffsetTracker {
+	return &OffsetTracker{
+		partitions: make(map[TopicPartition]*partitionOffsets),
+	}
+}
+
+// Track records that the message at offset was delivered. Offsets must be
+// tracked in increasing order per partition.
+func (t *OffsetTracker) Track(tp TopicPartition, offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.partitions[tp]
+	if !ok {
+		p = &partitionOffsets{done: make(map[int64]bool)}
+		t.partitions[tp] = p
+	}
+	p.pending = append(p.pending, offset)
+}
+
+// Done marks the message at offset as handled. It returns the offset to
+// commit, which is the offset of the next message to consume, when the
+// committable position of the partition advanced.
+func (t *OffsetTracker) Done(tp TopicPartition, offset int64) (int64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.partitions[tp]
+	if !ok {
+		return 0, false
+	}
+	// Offsets that are no longer tracked, e.g. acknowledged after a rewind,
+	// must be delivered and handled again
+	if i := sort.Search(len(p.pending), func(i int) bool { return p.pending[i] >= offset }); i == len(p.pending) || p.pending[i] != offset {
+		return 0, false
+	}
+	p.done[offset] = true
+
+	var commit int64
+	advanced := false
+	for len(p.pending) > 0 && p.done[p.pending[0]] {
+		commit = p.pending[0] + 1
+		delete(p.done, p.pending[0])
+		p.pending = p.pending[1:]
+		advanced = true
+	}
+	return commit, advanced
+}
+
+// Rewind forgets the messages in flight of a partition from offset onwards,
+// e.g. when the partition is consumed again from offset
+func (t *OffsetTracker) Rewind(tp TopicPartition, offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.partitions[tp]
+	if !ok {
+		return
+	}
+	for i, pending := range p.pending {
+		if pending >= offset {
+			p.pending = p.pending[:i]
+			break
+		}
+	}
+	for done := range p.done {
+		if done >= offset {
+			delete(p.done, done)
+		}
+	}
+}
+
+// Revoke forgets the messages in flight of a partition, e.g. when it was
+// assigned to another consumer which delivers them again
+func (t *OffsetTracker) Revoke(tp TopicPartition) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.partitions, tp)
+}
@@ -0,0 +1,115 @@
+package messaging
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Helpers extracting settings from the configuration map passed to the
+// ConsumerFactory and ProducerFactory of an implementation. They return an
+// error wrapping ErrInvalidConfig for values of the wrong type.
+
+// StringsOption extracts a required list, given as a []string or a
+// comma-separated string
+func StringsOption(config map[string]interface{}, key string) ([]string, error) {
+	var values []string
+	switch v := config[key].(type) {
+	case []string:
+		values = v
+	case string:
+		values = strings.Split(v, ",")
+	default:
+		return nil, fmt.Errorf("%w: %s must be a string or []string", ErrInvalidConfig, key)
+	}
+
+	var result []string
+	for _, value := range values {
+		if value = strings.TrimSpace(value); value != "" {
+			result = append(result, value)
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("%w: %s must not be empty", ErrInvalidConfig, key)
+	}
+	return result, nil
+}
+
+// StringOption extracts an optional string into dst, which must be one of
+// allowed if any
+func StringOption(config map[string]interface{}, key string, dst *string, allowed ...string) error {
+	value, ok := config[key]
+	if !ok {
+		return nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return fmt.Errorf("%w: %s must be a string", ErrInvalidConfig, key)
+	}
+	if s == "" {
+		return nil
+	}
+
+	if len(allowed) > 0 {
+		valid := false
+		for _, a := range allowed {
+			valid = valid || s == a
+		}
+		if !valid {
+			return fmt.Errorf("%w: %s must be one of %s, got %q", ErrInvalidConfig, key, strings.Join(allowed, ", "), s)
+		}
+	}
+	*dst = s
+	return nil
+}
+
+// DurationOption extracts an optional duration into dst, given as a
+// time.Duration or a string such as "5ms"
+func DurationOption(config map[string]interface{}, key string, dst *time.Duration) error {
+	switch v := config[key].(type) {
+	case nil:
+		return nil
+	case time.Duration:
+		*dst = v
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidConfig, key, err)
+		}
+		*dst = d
+	default:
+		return fmt.Errorf("%w: %s must be a duration", ErrInvalidConfig, key)
+	}
+	if *dst < 0 {
+		return fmt.Errorf("%w: %s must not be negative", ErrInvalidConfig, key)
+	}
+	return nil
+}
+
+// IntOption extracts an optional non-negative int into dst
+func IntOption(config map[string]interface{}, key string, dst *int) error {
+	value, ok := config[key]
+	if !ok {
+		return nil
+	}
+	i, ok := value.(int)
+	if !ok || i < 0 {
+		return fmt.Errorf("%w: %s must be a non-negative int", ErrInvalidConfig, key)
+	}
+	*dst = i
+	return nil
+}
+
+// BoolOption extracts an optional bool into dst
+func BoolOption(config map[string]interface{}, key string, dst *bool) error {
+	value, ok := config[key]
+	if !ok {
+		return nil
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return fmt.Errorf("%w: %s must be a bool", ErrInvalidConfig, key)
+	}
+	*dst = b
+	return nil
+}
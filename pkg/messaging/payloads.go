@@ -0,0 +1,125 @@
+package messaging
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Payloads of the message types. Fields tagged `required:"true"` must be set
+// for a payload to be valid, see DecodePayload.
+
+// UserEvent is the payload of the UserCreated, UserUpdated and UserDeleted
+// messages
+type UserEvent struct {
+	EventType MessageType `json:"event_type"`
+	UserID    string      `json:"user_id" required:"true"`
+	Email     string      `json:"email,omitempty"`
+	Phone     string      `json:"phone,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+// OrderItem is a line of an order
+type OrderItem struct {
+	ProductID string `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+	// UnitPrice is in the minor unit of the currency of the order
+	UnitPrice int64 `json:"unit_price"`
+}
+
+// OrderEvent is the payload of the OrderPlaced, OrderPaid, OrderShipped,
+// OrderDelivered and OrderCanceled messages
+type OrderEvent struct {
+	EventType MessageType `json:"event_type"`
+	OrderID   string      `json:"order_id" required:"true"`
+	UserID    string      `json:"user_id" required:"true"`
+	// Total is in the minor unit of Currency, e.g. cents
+	Total      int64       `json:"total"`
+	Currency   string      `json:"currency,omitempty"`
+	Items      []OrderItem `json:"items,omitempty"`
+	OccurredAt time.Time   `json:"occurred_at"`
+}
+
+// PaymentEvent is the payload of the PaymentReceived, PaymentFailed and
+// PaymentRefunded messages
+type PaymentEvent struct {
+	EventType MessageType `json:"event_type"`
+	PaymentID string      `json:"payment_id" required:"true"`
+	OrderID   string      `json:"order_id" required:"true"`
+	// Amount is in the minor unit of Currency, e.g. cents
+	Amount   int64  `json:"amount"`
+	Currency string `json:"currency" required:"true"`
+	Method   string `json:"method,omitempty"`
+	// Reason explains why a payment failed or was refunded
+	Reason     string    `json:"reason,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// NotificationEvent is the payload of the NotificationSent and
+// NotificationFailed messages
+type NotificationEvent struct {
+	EventType      MessageType `json:"event_type"`
+	NotificationID string      `json:"notification_id" required:"true"`
+	UserID         string      `json:"user_id,omitempty"`
+	// Channel is how the notification is delivered, e.g. "email" or "sms"
+	Channel  string `json:"channel" required:"true"`
+	Template string `json:"template,omitempty"`
+	// Error explains why a notification failed
+	Error      string    `json:"error,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// Validator is implemented by payloads with validation rules beyond the
+// required fields
+type Validator interface {
+	Validate() error
+}
+
+// DecodePayload decodes a JSON payload into v, a pointer to a struct, and
+// validates it: fields tagged `required:"true"` must not be empty, and v is
+// validated with its Validate method if it implements Validator. Unknown
+// fields are ignored so producers can add fields.
+func DecodePayload(payload []byte, v interface{}) error {
+	if err := json.Unmarshal(payload, v); err != nil {
+		return err
+	}
+
+	if err := checkRequired(v); err != nil {
+		return err
+	}
+	if validator, ok := v.(Validator); ok {
+		return validator.Validate()
+	}
+	return nil
+}
+
+// checkRequired reports the required fields of the struct v points to that
+// are empty
+func checkRequired(v interface{}) error {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var missing []string
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		if field.Tag.Get("required") != "true" || !rv.Field(i).IsZero() {
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+		missing = append(missing, name)
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required fields: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,539 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/trranminhquang/go-boilerplate/internal/db"
+	"github.com/trranminhquang/go-boilerplate/pkg/messaging"
+)
+
+// MetadataRunAt is the metadata key of a published message holding when it
+// is due, in RFC 3339 format. Messages are due right away by default.
+const MetadataRunAt = "run_at"
+
+// MetadataJobID is the metadata key of a received message holding the ID of
+// its row in the jobs table
+const MetadataJobID = "job_id"
+
+// Default settings of the configuration keys that are optional
+const (
+	DefaultPollInterval      = time.Second
+	DefaultVisibilityTimeout = 30 * time.Second
+	DefaultBatchSize         = 10
+	DefaultRetryDelay        = time.Second
+	DefaultMaxRetryDelay     = 5 * time.Minute
+)
+
+// ConsumerConfig defines configuration for the postgres consumer
+type ConsumerConfig struct {
+	Topics  []string
+	GroupID string
+	// PollInterval is how often due jobs are looked for when no job was
+	// inserted in the meantime
+	PollInterval time.Duration
+	// VisibilityTimeout is how long a claimed job is hidden from the other
+	// consumers. It is extended while the job is in flight.
+	VisibilityTimeout time.Duration
+	BatchSize         int
+	// RetryDelay and MaxRetryDelay bound the backoff of the jobs that were
+	// not acknowledged
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+	// Browse consumers read the jobs without claiming them, e.g. to list
+	// them. They need no GroupID, and Ack and Nack have no effect.
+	Browse bool
+}
+
+// Consumer implements the messaging.Consumer interface with the jobs table.
+// Consumers compete for the jobs of their topics whatever their group: each
+// job is claimed by a single consumer at a time, and removed once it was
+// acknowledged.
+type Consumer struct {
+	conn    *db.Connection
+	config  ConsumerConfig
+	owner   string
+	handler messaging.MessageHandler
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	logger  *logrus.Logger
+	wakeup  chan struct{}
+
+	// inFlight holds the number of attempts of the jobs claimed by the
+	// consumer, by ID
+	mu       sync.Mutex
+	inFlight map[int64]int
+}
+
+// NewConsumer creates a consumer of the jobs table of conn. The
+// configuration holds the topics and group_id of the consumer, and
+// optionally its poll_interval, visibility_timeout, batch_size, retry_delay,
+// max_retry_delay and browse mode.
+func NewConsumer(conn *db.Connection, config map[string]interface{}) (*Consumer, error) {
+	cfg := ConsumerConfig{
+		PollInterval:      DefaultPollInterval,
+		VisibilityTimeout: DefaultVisibilityTimeout,
+		BatchSize:         DefaultBatchSize,
+		RetryDelay:        DefaultRetryDelay,
+		MaxRetryDelay:     DefaultMaxRetryDelay,
+	}
+
+	var err error
+	if cfg.Topics, err = messaging.StringsOption(config, "topics"); err != nil {
+		return nil, err
+	}
+
+	for key, dst := range map[string]*time.Duration{
+		"poll_interval":      &cfg.PollInterval,
+		"visibility_timeout": &cfg.VisibilityTimeout,
+		"retry_delay":        &cfg.RetryDelay,
+		"max_retry_delay":    &cfg.MaxRetryDelay,
+	} {
+		if err := messaging.DurationOption(config, key, dst); err != nil {
+			return nil, err
+		}
+	}
+	if err := messaging.IntOption(config, "batch_size", &cfg.BatchSize); err != nil {
+		return nil, err
+	}
+	if err := messaging.BoolOption(config, "browse", &cfg.Browse); err != nil {
+		return nil, err
+	}
+
+	// Extract group ID, which browse consumers don't need
+	if groupID, ok := config["group_id"].(string); ok && groupID != "" {
+		cfg.GroupID = groupID
+	} else if !cfg.Browse {
+		return nil, fmt.Errorf("%w: group_id must be a string", messaging.ErrInvalidConfig)
+	}
+	if cfg.PollInterval <= 0 || cfg.VisibilityTimeout < time.Second || cfg.BatchSize < 1 {
+		return nil, fmt.Errorf("%w: poll_interval and batch_size must be positive, visibility_timeout at least 1s", messaging.ErrInvalidConfig)
+	}
+
+	// Create context
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Consumer{
+		conn:     conn,
+		config:   cfg,
+		owner:    cfg.GroupID + "-" + uuid.Must(uuid.NewV4()).String(),
+		ctx:      ctx,
+		cancel:   cancel,
+		logger:   logrus.StandardLogger(),
+		wakeup:   make(chan struct{}, 1),
+		inFlight: make(map[int64]int),
+	}, nil
+}
+
+// Start begins claiming jobs. New jobs are picked up as soon as they are
+// notified, due jobs every poll interval.
+func (c *Consumer) Start(ctx context.Context) error {
+	if c.handler == nil {
+		return messaging.ErrHandlerNotSet
+	}
+
+	c.logger.WithFields(logrus.Fields{
+		"topics":  c.config.Topics,
+		"groupID": c.config.GroupID,
+		"owner":   c.owner,
+	}).Info("Starting postgres consumer")
+
+	// Stop consuming when either the context or the consumer is done
+	ctx, cancel := context.WithCancel(ctx)
+	context.AfterFunc(c.ctx, cancel)
+
+	if c.config.Browse {
+		c.wg.Add(1)
+		go func() {
+			defer c.wg.Done()
+			c.browse(ctx)
+		}()
+		return nil
+	}
+
+	c.wg.Add(3)
+	go func() {
+		defer c.wg.Done()
+		c.listen(ctx)
+	}()
+	go func() {
+		defer c.wg.Done()
+		c.poll(ctx)
+	}()
+	go func() {
+		defer c.wg.Done()
+		c.heartbeat(ctx)
+	}()
+
+	return nil
+}
+
+// listen wakes the poll loop up when a job is inserted for one of the
+// topics of the consumer, reconnecting when the listener fails
+func (c *Consumer) listen(ctx context.Context) {
+	for {
+		err := c.conn.Listen(ctx, db.JobsChannel, func(topic string) {
+			if c.subscribed(topic) {
+				c.wake()
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		c.logger.WithError(err).Warn("Job listener failed, relying on polling until it reconnects")
+
+		if !c.sleep(ctx, c.config.PollInterval) {
+			return
+		}
+	}
+}
+
+// poll claims and delivers batches of due jobs. It only waits when the
+// previous batch did not fill up, so a backlog is drained as fast as
+// possible.
+func (c *Consumer) poll(ctx context.Context) {
+	for {
+		n, err := c.claim(ctx)
+		if err != nil && ctx.Err() == nil {
+			c.logger.WithError(err).Error("Failed to claim jobs")
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil && n == c.config.BatchSize {
+			continue
+		}
+
+		if !c.sleep(ctx, c.config.PollInterval) {
+			return
+		}
+	}
+}
+
+// claim claims a batch of due jobs and delivers them. Jobs that were claimed
+// but not delivered because ctx is done are released by Stop.
+func (c *Consumer) claim(ctx context.Context) (int, error) {
+	jobs, err := c.conn.WithContext(ctx).ClaimJobs(c.owner, c.config.Topics, c.config.BatchSize, c.config.VisibilityTimeout)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	for _, job := range jobs {
+		c.inFlight[job.ID] = job.Attempts
+	}
+	c.mu.Unlock()
+
+	for i := range jobs {
+		if ctx.Err() != nil {
+			break
+		}
+		c.deliver(ctx, message(&jobs[i]))
+	}
+	return len(jobs), nil
+}
+
+// browse delivers every job of the topics once, in insertion order, without
+// claiming them
+func (c *Consumer) browse(ctx context.Context) {
+	var after int64
+	for {
+		jobs, err := c.conn.WithContext(ctx).BrowseJobs(c.config.Topics, after, c.config.BatchSize)
+		if err != nil && ctx.Err() == nil {
+			c.logger.WithError(err).Error("Failed to browse jobs")
+		}
+
+		for i := range jobs {
+			if ctx.Err() != nil {
+				return
+			}
+			c.deliver(ctx, message(&jobs[i]))
+			after = jobs[i].ID
+		}
+		if len(jobs) == c.config.BatchSize {
+			continue
+		}
+
+		if !c.sleep(ctx, c.config.PollInterval) {
+			return
+		}
+	}
+}
+
+// heartbeat extends the visibility timeout of the jobs in flight, so that
+// slow jobs are not claimed by another consumer while they are handled
+func (c *Consumer) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(c.config.VisibilityTimeout / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		ids := make([]int64, 0, len(c.inFlight))
+		for id := range c.inFlight {
+			ids = append(ids, id)
+		}
+		c.mu.Unlock()
+
+		if len(ids) == 0 {
+			continue
+		}
+		if err := c.conn.WithContext(ctx).ExtendJobs(c.owner, ids, c.config.VisibilityTimeout); err != nil && ctx.Err() == nil {
+			c.logger.WithError(err).Error("Failed to extend the visibility timeout of jobs")
+		}
+	}
+}
+
+// sleep waits for the delay, a notification or ctx to be done. It reports
+// false when ctx is done.
+func (c *Consumer) sleep(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-c.wakeup:
+	case <-timer.C:
+	}
+	return true
+}
+
+// wake signals the poll loop that jobs may be due
+func (c *Consumer) wake() {
+	select {
+	case c.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// subscribed reports whether the consumer consumes the topic
+func (c *Consumer) subscribed(topic string) bool {
+	for _, t := range c.config.Topics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver passes msg to the handler. Messages the handler does not accept are
+// delivered again after a backoff.
+func (c *Consumer) deliver(ctx context.Context, msg *messaging.Message) {
+	if err := c.handler(ctx, msg); err != nil {
+		c.logger.WithError(err).WithFields(logrus.Fields{
+			"messageID": msg.ID,
+			"source":    msg.Source,
+		}).Error("Failed to process message")
+
+		if err := c.Nack(msg); err != nil {
+			c.logger.WithError(err).Error("Failed to nack message")
+		}
+	}
+}
+
+// message converts a job to a message
+func message(job *db.Job) *messaging.Message {
+	metadata := make(map[string]string, len(job.Metadata)+3)
+	for k, v := range job.Metadata {
+		metadata[k] = v
+	}
+	delete(metadata, MetadataRunAt)
+	if job.Key != "" {
+		metadata[messaging.MetadataKey] = job.Key
+	}
+	metadata[messaging.MetadataTopic] = job.Topic
+	metadata[MetadataJobID] = strconv.FormatInt(job.ID, 10)
+
+	return &messaging.Message{
+		ID:       job.MessageID,
+		Payload:  job.Payload,
+		Metadata: metadata,
+		Source:   job.Topic,
+	}
+}
+
+// jobID returns the ID of the job msg was received from
+func jobID(msg *messaging.Message) (int64, error) {
+	id, err := strconv.ParseInt(msg.Metadata[MetadataJobID], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s metadata: %w", MetadataJobID, err)
+	}
+	return id, nil
+}
+
+// Ack marks a message as handled, removing its job from the jobs table
+func (c *Consumer) Ack(msg *messaging.Message) error {
+	if c.config.Browse {
+		return nil
+	}
+
+	id, err := jobID(msg)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	delete(c.inFlight, id)
+	c.mu.Unlock()
+
+	return c.conn.CompleteJob(c.owner, id)
+}
+
+// Nack marks a message as not handled. Its job is released and claimed again
+// after an exponential backoff.
+func (c *Consumer) Nack(msg *messaging.Message) error {
+	if c.config.Browse {
+		return nil
+	}
+
+	id, err := jobID(msg)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	attempts := c.inFlight[id]
+	delete(c.inFlight, id)
+	c.mu.Unlock()
+
+	return c.conn.RetryJob(c.owner, id, time.Now().Add(c.retryDelay(attempts)))
+}
+
+// retryDelay returns the backoff of a job that was claimed attempts times
+func (c *Consumer) retryDelay(attempts int) time.Duration {
+	delay := c.config.RetryDelay
+	for i := 1; i < attempts && delay < c.config.MaxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, c.config.MaxRetryDelay)
+}
+
+// Stop stops claiming jobs and releases the jobs still claimed by the
+// consumer, so that other consumers can claim them right away
+func (c *Consumer) Stop() error {
+	c.logger.Info("Stopping postgres consumer")
+	c.cancel()
+	c.wg.Wait()
+
+	if c.config.Browse {
+		return nil
+	}
+	return c.conn.ReleaseJobs(c.owner)
+}
+
+// Subscribe registers a handler for processing messages
+func (c *Consumer) Subscribe(handler messaging.MessageHandler) error {
+	c.handler = handler
+	return nil
+}
+
+// Name returns the name of the consumer implementation
+func (c *Consumer) Name() string {
+	return "postgres"
+}
+
+// Producer implements the messaging.Producer interface with the jobs table
+type Producer struct {
+	conn   *db.Connection
+	logger *logrus.Logger
+}
+
+// NewProducer creates a producer inserting jobs into the jobs table of conn
+func NewProducer(conn *db.Connection) *Producer {
+	return &Producer{
+		conn:   conn,
+		logger: logrus.StandardLogger(),
+	}
+}
+
+// Publish inserts a job for the message, due at its "run_at" metadata if
+// set. Messages with the same "key" metadata are handled in order. The job
+// takes the ID of the envelope of the message, else its MetadataMessageID
+// metadata, else a new UUID.
+func (p *Producer) Publish(ctx context.Context, topic string, message []byte, metadata map[string]string) error {
+	job := &db.Job{
+		MessageID: metadata[messaging.MetadataEventID],
+		Topic:     topic,
+		Key:       metadata[messaging.MetadataKey],
+		Payload:   message,
+		Metadata:  db.StringMap{},
+	}
+	for k, v := range metadata {
+		job.Metadata[k] = v
+	}
+	if job.MessageID == "" {
+		job.MessageID = metadata[messaging.MetadataMessageID]
+	}
+	if job.MessageID == "" {
+		job.MessageID = uuid.Must(uuid.NewV4()).String()
+	}
+
+	if runAt := metadata[MetadataRunAt]; runAt != "" {
+		t, err := time.Parse(time.RFC3339Nano, runAt)
+		if err != nil {
+			return fmt.Errorf("invalid %s metadata: %w", MetadataRunAt, err)
+		}
+		job.RunAt = t
+	}
+
+	if err := p.conn.WithContext(ctx).EnqueueJob(job); err != nil {
+		return err
+	}
+
+	p.logger.WithFields(logrus.Fields{
+		"topic":     topic,
+		"jobID":     job.ID,
+		"messageID": job.MessageID,
+	}).Debug("Message published")
+	return nil
+}
+
+// Close closes the producer. The database connection is left open since it
+// is shared.
+func (p *Producer) Close() error {
+	return nil
+}
+
+// Name returns the name of the producer implementation
+func (p *Producer) Name() string {
+	return "postgres"
+}
+
+// Register registers the postgres implementations with the registry. The
+// consumers and producers share conn, which is left open when they are
+// closed. A nil conn makes them fail to be created.
+func Register(registry *messaging.Registry, conn *db.Connection) {
+	connect := func() (*db.Connection, error) {
+		if conn == nil {
+			return nil, fmt.Errorf("%w: postgres needs a database connection", messaging.ErrInvalidConfig)
+		}
+		return conn, nil
+	}
+
+	registry.RegisterConsumerFactory("postgres", func(config map[string]interface{}) (messaging.Consumer, error) {
+		conn, err := connect()
+		if err != nil {
+			return nil, err
+		}
+		return NewConsumer(conn, config)
+	})
+	registry.RegisterProducerFactory("postgres", func(config map[string]interface{}) (messaging.Producer, error) {
+		conn, err := connect()
+		if err != nil {
+			return nil, err
+		}
+		return NewProducer(conn), nil
+	})
+}
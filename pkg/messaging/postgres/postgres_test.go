@@ -0,0 +1,157 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/trranminhquang/go-boilerplate/internal/conf"
+	"github.com/trranminhquang/go-boilerplate/internal/db"
+	"github.com/trranminhquang/go-boilerplate/pkg/messaging"
+)
+
+const testTopic = "events"
+
+// dialTest connects to the PostgreSQL database of TEST_DATABASE_URL, creates
+// the jobs table with its migration, and skips the test unless it is set
+func dialTest(t *testing.T) *db.Connection {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	conn, err := db.Dial(&conf.GlobalConfiguration{DB: conf.DBConfiguration{URL: url}})
+	if err != nil {
+		t.Fatalf("dialing %s: %v", url, err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	if conn.Dialect.Name() != "postgres" {
+		t.Skipf("the jobs table needs PostgreSQL, not %s", conn.Dialect.Name())
+	}
+
+	migrate := func(name string) {
+		b, err := os.ReadFile("../../../migrations/20261018000001_create_jobs." + name + ".sql")
+		if err != nil {
+			t.Fatalf("reading the jobs migration: %v", err)
+		}
+		if err := conn.RawQuery(string(b)).Exec(); err != nil {
+			t.Fatalf("running the jobs %s migration: %v", name, err)
+		}
+	}
+	migrate("down")
+	migrate("up")
+	t.Cleanup(func() {
+		migrate("down")
+	})
+	return conn
+}
+
+func quietLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+func TestRetryDelay(t *testing.T) {
+	c := &Consumer{config: ConsumerConfig{RetryDelay: time.Second, MaxRetryDelay: 5 * time.Second}}
+
+	for attempts, want := range map[int]time.Duration{
+		0: time.Second,
+		1: time.Second,
+		2: 2 * time.Second,
+		3: 4 * time.Second,
+		4: 5 * time.Second,
+		9: 5 * time.Second,
+	} {
+		if got := c.retryDelay(attempts); got != want {
+			t.Errorf("retryDelay(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestConsumerRetryBackoff(t *testing.T) {
+	conn := dialTest(t)
+
+	producer := NewProducer(conn)
+	producer.logger = quietLogger()
+	if err := producer.Publish(context.Background(), testTopic, []byte("a"), map[string]string{
+		messaging.MetadataMessageID: "a",
+	}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+
+	c, err := NewConsumer(conn, map[string]interface{}{
+		"topics":          testTopic,
+		"group_id":        "group",
+		"poll_interval":   "50ms",
+		"retry_delay":     "200ms",
+		"max_retry_delay": "1s",
+	})
+	if err != nil {
+		t.Fatalf("NewConsumer: %v", err)
+	}
+	c.logger = quietLogger()
+
+	// The message fails twice, and is delivered again after 200ms then 400ms
+	var (
+		mu         sync.Mutex
+		deliveries []time.Time
+	)
+	done := make(chan struct{})
+	errFailed := errors.New("handler failed")
+	if err := c.Subscribe(func(_ context.Context, msg *messaging.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if msg.ID != "a" {
+			t.Errorf("delivered message %q, want a", msg.ID)
+		}
+		deliveries = append(deliveries, time.Now())
+		if len(deliveries) < 3 {
+			return errFailed
+		}
+		defer close(done)
+		return c.Ack(msg)
+	}); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+	if err := c.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	defer func() {
+		if err := c.Stop(); err != nil {
+			t.Errorf("Stop: %v", err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not acknowledged")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for i, want := range []time.Duration{200 * time.Millisecond, 400 * time.Millisecond} {
+		if gap := deliveries[i+1].Sub(deliveries[i]); gap < want {
+			t.Errorf("attempt %d was delivered %s after the previous one, want at least %s", i+2, gap, want)
+		}
+	}
+
+	jobs, err := conn.BrowseJobs([]string{testTopic}, 0, 10)
+	if err != nil {
+		t.Fatalf("BrowseJobs: %v", err)
+	}
+	if len(jobs) != 0 {
+		t.Errorf("%d jobs left once the message was acknowledged, want none", len(jobs))
+	}
+}
@@ -0,0 +1,97 @@
+package messaging
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// Metadata keys of the W3C trace context propagated with messages
+const (
+	MetadataTraceParent = "traceparent"
+	MetadataTraceState  = "tracestate"
+)
+
+// ErrInvalidTraceParent is returned for a malformed traceparent value
+var ErrInvalidTraceParent = errors.New("invalid traceparent")
+
+// TraceContext is a W3C trace context, see https://www.w3.org/TR/trace-context/
+type TraceContext struct {
+	TraceID  string
+	ParentID string
+	Flags    string
+	State    string
+}
+
+// ParseTraceParent parses a traceparent value of the form
+// "00-<trace id>-<parent id>-<flags>"
+func ParseTraceParent(value string) (TraceContext, error) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return TraceContext{}, ErrInvalidTraceParent
+	}
+
+	tc := TraceContext{TraceID: parts[1], ParentID: parts[2], Flags: parts[3]}
+	if !isHex(tc.TraceID, 32) || !isHex(tc.ParentID, 16) || !isHex(tc.Flags, 2) {
+		return TraceContext{}, ErrInvalidTraceParent
+	}
+	if strings.Trim(tc.TraceID, "0") == "" || strings.Trim(tc.ParentID, "0") == "" {
+		return TraceContext{}, ErrInvalidTraceParent
+	}
+	return tc, nil
+}
+
+func isHex(s string, n int) bool {
+	if len(s) != n || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// TraceParent formats the trace context as a traceparent value
+func (tc TraceContext) TraceParent() string {
+	return "00-" + tc.TraceID + "-" + tc.ParentID + "-" + tc.Flags
+}
+
+// Sampled reports whether the caller recorded the trace
+func (tc TraceContext) Sampled() bool {
+	b, err := hex.DecodeString(tc.Flags)
+	return err == nil && len(b) == 1 && b[0]&1 == 1
+}
+
+// TraceFromMetadata extracts the trace context from message metadata
+func TraceFromMetadata(metadata map[string]string) (TraceContext, bool) {
+	tc, err := ParseTraceParent(metadata[MetadataTraceParent])
+	if err != nil {
+		return TraceContext{}, false
+	}
+	tc.State = metadata[MetadataTraceState]
+	return tc, true
+}
+
+// InjectTrace adds the trace context of ctx, if any, to message metadata
+func InjectTrace(ctx context.Context, metadata map[string]string) {
+	tc, ok := TraceFromContext(ctx)
+	if !ok {
+		return
+	}
+	metadata[MetadataTraceParent] = tc.TraceParent()
+	if tc.State != "" {
+		metadata[MetadataTraceState] = tc.State
+	}
+}
+
+type traceContextKey struct{}
+
+// ContextWithTrace returns a copy of ctx carrying tc
+func ContextWithTrace(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+// TraceFromContext returns the trace context carried by ctx
+func TraceFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return tc, ok
+}